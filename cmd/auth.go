@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"flag"
+	"github.com/kmfk/stan-demo/internal"
+	"strconv"
+)
+
+// Adds the TLS and authentication flags for the NATS connection, shared by every command
+func AuthFlags(fs *flag.FlagSet, auth *internal.ConnectionAuth) {
+	fs.StringVar(&auth.User,
+		"user",
+		"",
+		"The user to authenticate with. \nCan be set from the NATS_USER environment variable")
+	fs.StringVar(&auth.Password,
+		"password",
+		"",
+		"The password to authenticate with, along with the user. \nCan be set from the NATS_PASSWORD environment variable")
+	fs.StringVar(&auth.Token,
+		"token",
+		"",
+		"A token to authenticate with. \nCan be set from the NATS_TOKEN environment variable")
+	fs.StringVar(&auth.NKeyFile,
+		"nkey",
+		"",
+		"A file holding an NKey seed to authenticate with. \nCan be set from the NATS_NKEY environment variable")
+	fs.StringVar(&auth.CredsFile,
+		"creds",
+		"",
+		"A .creds file, holding a user JWT and NKey seed, to authenticate with. \nCan be set from the NATS_CREDS environment variable")
+	fs.StringVar(&auth.TLSCert,
+		"tls-cert",
+		"",
+		"A client certificate for TLS, along with tls-key. \nCan be set from the NATS_TLS_CERT environment variable")
+	fs.StringVar(&auth.TLSKey,
+		"tls-key",
+		"",
+		"The key for the TLS client certificate. \nCan be set from the NATS_TLS_KEY environment variable")
+	fs.StringVar(&auth.TLSCACert,
+		"tls-ca",
+		"",
+		"A CA certificate to verify the server with. \nCan be set from the NATS_TLS_CA environment variable")
+	fs.Var(optionalBoolFlag{&auth.TLSInsecure},
+		"tls-insecure",
+		`Skips verifying the server certificate - only for local testing.
+Can be set from the NATS_TLS_INSECURE environment variable.
+Defaults to false`,
+	)
+}
+
+// Parses a boolean which is only set when given - so that, ie, -tls-insecure=false overrides the environment
+type optionalBoolFlag struct {
+	value **bool
+}
+
+func (f optionalBoolFlag) String() string {
+	if f.value == nil || *f.value == nil {
+		return ""
+	}
+
+	return strconv.FormatBool(**f.value)
+}
+
+func (f optionalBoolFlag) Set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+
+	*f.value = &b
+	return nil
+}
+
+// Allows the flag to be given without a value, like any other boolean flag
+func (f optionalBoolFlag) IsBoolFlag() bool {
+	return true
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kmfk/stan-demo/internal"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BenchFlagOptions struct {
+	internal.BenchOptions
+
+	// How the results are written, and the file they're written to - stdout if empty
+	Format string
+	Out    string
+}
+
+// Runs a producer and consumer together for every combination of the given parameters, and writes the throughput,
+// latency and redeliveries of each as CSV or markdown.
+func Bench(opts *BenchFlagOptions) error {
+	if err := internal.ValidateBenchFormat(opts.Format); err != nil {
+		return err
+	}
+
+	b := internal.Bench{}
+	if err := b.SetOptions(opts.BenchOptions); err != nil {
+		return err
+	}
+
+	if err := b.Start(); err != nil {
+		return err
+	}
+	defer b.End()
+
+	cells := b.Cells()
+	results := make([]internal.BenchResult, 0, len(cells))
+
+	for i, cell := range cells {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf(
+			"Cell %d/%d  | Batch: %d  | Sync: %v  | Inflight Acks: %d  | Consumer Inflight: %d  | AckWait: %d  | Size: %d",
+			i+1,
+			len(cells),
+			cell.BatchSize,
+			cell.Sync,
+			cell.MaxInFlightAcks,
+			cell.ConsumerInFlight,
+			cell.AckWait,
+			cell.MessageSize,
+		))
+
+		result := b.Run(i, cell)
+		if result.Error != "" {
+			fmt.Fprintln(os.Stderr, "  Failed:", result.Error)
+		}
+
+		results = append(results, result)
+	}
+
+	var w io.Writer = os.Stdout
+	if opts.Out != "" {
+		f, err := os.Create(opts.Out)
+		if err != nil {
+			return fmt.Errorf("failed to create results file: %v", err)
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	return internal.WriteBenchResults(w, opts.Format, results)
+}
+
+func BenchFlags(fs *flag.FlagSet, opts *BenchFlagOptions) {
+	fs.StringVar(&opts.Cluster,
+		"cluster",
+		"",
+		`The Nats Streaming cluster name.
+Can be set from the NATS_CLUSTER environment variable`,
+	)
+	fs.StringVar(&opts.ClientId,
+		"client",
+		"",
+		"The prefix for the Nats Streaming Client IDs of the producer and consumer. \nDefaults to ascii-bench")
+	fs.StringVar(&opts.ConnectionString,
+		"nats-url",
+		"",
+		`The NATS Connection String, or a comma separated list of servers to fail over between.
+Can be set from the NATS_CONNECTION_STRING environment variable.
+Defaults to nats://0.0.0.0:4222`,
+	)
+	fs.BoolVar(&opts.NoRandomize,
+		"no-randomize",
+		false,
+		`Connects to the servers in the order they're listed in nats-url, rather than in a random order.
+Defaults to false`,
+	)
+	fs.BoolVar(&opts.Embedded,
+		"embedded",
+		false,
+		"Runs an in-memory NATS Streaming server in process, instead of connecting to one. \nDefaults to false")
+	fs.StringVar(&opts.Subject,
+		"subject",
+		"",
+		"The prefix of the subject each cell publishes to. \nDefaults to ascii.bench")
+	fs.IntVar(&opts.Messages,
+		"messages",
+		1000,
+		"How many characters to publish for each cell. \nDefaults to 1000")
+	fs.DurationVar(&opts.Timeout,
+		"timeout",
+		60*time.Second,
+		"How long to wait for every message of a cell to be received. \nDefaults to 60s")
+	fs.Var(intsFlag{&opts.BatchSizes},
+		"batch",
+		"A comma separated list of the characters sent in each message. \nDefaults to 1")
+	fs.Var(boolsFlag{&opts.Sync},
+		"sync",
+		"A comma separated list of whether to publish synchronously, ie 'false,true'. \nDefaults to false")
+	fs.Var(intsFlag{&opts.MaxInFlightAcks},
+		"inflight",
+		"A comma separated list of the producer Max Acks In Flight. \nDefaults to 16384")
+	fs.Var(intsFlag{&opts.ConsumerInFlight},
+		"consumer-inflight",
+		"A comma separated list of the messages allowed in flight for the consumer. \nDefaults to 512")
+	fs.Var(intsFlag{&opts.AckWaits},
+		"ackwait",
+		"A comma separated list of the consumer AckWait in seconds. \nDefaults to 10")
+	fs.Var(intsFlag{&opts.MessageSizes},
+		"size",
+		"A comma separated list of the size in bytes of each character - each message is batch * size bytes. \nDefaults to 1")
+	fs.StringVar(&opts.Format,
+		"format",
+		internal.BenchFormatCSV,
+		"How to write the results - allows 'csv' or 'markdown'. \nDefaults to csv")
+	fs.StringVar(&opts.Out,
+		"out",
+		"",
+		"A file to write the results to. \nDefaults to stdout")
+
+	AuthFlags(fs, &opts.ConnectionAuth)
+
+	fs.Usage = func() {
+		fmt.Println(fmt.Sprintf("\nUsage: %s bench -embedded -batch 1,10,100 -sync false,true", os.Args[0]))
+		fmt.Println("Options:")
+		fs.PrintDefaults()
+	}
+}
+
+// Parses a comma separated list of integers
+type intsFlag struct {
+	values *[]int
+}
+
+func (f intsFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+
+	s := make([]string, len(*f.values))
+	for i, v := range *f.values {
+		s[i] = strconv.Itoa(v)
+	}
+
+	return strings.Join(s, ",")
+}
+
+func (f intsFlag) Set(value string) error {
+	var values []int
+
+	for _, s := range strings.Split(value, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+
+		values = append(values, v)
+	}
+
+	*f.values = values
+	return nil
+}
+
+// Parses a comma separated list of booleans
+type boolsFlag struct {
+	values *[]bool
+}
+
+func (f boolsFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+
+	s := make([]string, len(*f.values))
+	for i, v := range *f.values {
+		s[i] = strconv.FormatBool(v)
+	}
+
+	return strings.Join(s, ",")
+}
+
+func (f boolsFlag) Set(value string) error {
+	var values []bool
+
+	for _, s := range strings.Split(value, ",") {
+		v, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+
+		values = append(values, v)
+	}
+
+	*f.values = values
+	return nil
+}
@@ -1,12 +1,15 @@
 package cmd
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"github.com/kmfk/stan-demo/internal"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -14,12 +17,36 @@ import (
 // Creates a Subscriber or QueueSubscriber to a channel in NATS Streaming to listen for ASCII Characters and prints
 // them to the console.
 func Consumer(opts *internal.ConsumerOptions) error {
+	out, err := internal.NewOutput(opts.Output, opts.ArtFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := consume(opts, out); err != nil {
+		return reportError(out, err)
+	}
+
+	return nil
+}
+
+func consume(opts *internal.ConsumerOptions, out *internal.Output) error {
 	c := internal.Consumer{}
+	c.SetOutput(out)
 
 	if err := c.SetOptions(*opts); err != nil {
 		return err
 	}
 
+	if opts.MsgDropPercent > 0 || opts.AckFailPercent > 0 {
+		seed := *c.GetOptions().Seed
+		out.Event("chaos", map[string]interface{}{
+			"seed":             seed,
+			"drop_percent":     opts.MsgDropPercent,
+			"ack_fail_percent": opts.AckFailPercent,
+		}, fmt.Sprintf("\nChaos seed: %d - run again with -seed %d to drop and fail the same messages\n", seed, seed))
+	}
+
 	if err := c.Connect(); err != nil {
 		return err
 	}
@@ -35,6 +62,27 @@ func Consumer(opts *internal.ConsumerOptions) error {
 
 	var current string
 	stats := MessageStats{}
+	verifier := internal.SeriesVerifier{}
+
+	// Where to send the receipt of each series, once it's verified
+	replies := map[string]string{}
+	verify := func(seriesId string) {
+		result := verifier.Verify(seriesId)
+		printVerification(out, result)
+
+		if reply := replies[seriesId]; reply != "" {
+			if err := c.SendReceipt(reply, result); err != nil {
+				out.Error(err)
+			}
+		}
+
+		delete(replies, seriesId)
+	}
+
+	// Series are verified once complete, or once any missing messages have had time to be redelivered
+	grace := c.GetOptions().VerifyGrace
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
@@ -42,37 +90,95 @@ func Consumer(opts *internal.ConsumerOptions) error {
 			if current != msg.MessageSeriesId {
 				current = msg.MessageSeriesId
 				stats.start = time.Now()
+
+				out.Event("series_start", map[string]interface{}{"message_series_id": current}, "")
 			}
 
-			fmt.Print(msg.Body)
+			out.Art(msg.Body)
 			stats.MessagesReceived++
 
+			if msg.End && msg.Reply != "" {
+				replies[msg.MessageSeriesId] = msg.Reply
+			}
+
+			complete := verifier.Add(msg)
+
 			if msg.End {
 				stats.end = time.Now()
 
-				fmt.Println(fmt.Sprintf(
+				out.Event("series_end", map[string]interface{}{
+					"message_series_id":   current,
+					"messages_received":   stats.MessagesReceived,
+					"duration_ms":         stats.GetDuration().Milliseconds(),
+					"messages_per_second": stats.GetMessagesPerSecond(),
+				}, fmt.Sprintln(fmt.Sprintf(
 					"\n Image: %s  |  Total Sent: %d  |  Time Taken: %s  | Messages/Sec: %v \n",
 					current,
 					stats.MessagesReceived,
 					stats.GetDuration(),
 					stats.GetMessagesPerSecond(),
-				))
+				)))
 
 				current = ""
 			}
+
+			if complete {
+				verify(msg.MessageSeriesId)
+			}
+		case <-ticker.C:
+			for _, id := range verifier.Due(time.Now(), grace, internal.DefaultSeriesExpiry) {
+				verify(id)
+			}
 		case <-ctlc:
 			if err := c.End(); err != nil {
 				return err
 			}
 
-			stats := c.GetSubscriptionStats()
-			fmt.Println("\nTotal Messages:", stats.Received, "| Total Acknowledged:", stats.AcksSent, "| Total Dropped:", stats.FailedAcks)
+			// Nothing more will arrive, so verify the series which have ended without waiting out the grace period
+			for _, id := range verifier.Due(time.Now(), 0, internal.DefaultSeriesExpiry) {
+				verify(id)
+			}
 
-			return nil
+			return summarize(out, opts, c.GetSubscriptionStats())
+		case <-c.Crashed():
+			return summarize(out, opts, c.GetSubscriptionStats())
 		}
 	}
 }
 
+// Prints the stats for the subscription, and exports them if a stats file was given
+func summarize(out *internal.Output, opts *internal.ConsumerOptions, stats internal.ConsumerStats) error {
+	text := fmt.Sprintln("\nTotal Messages:", stats.Received, "| Total Acknowledged:", stats.AcksSent, "| Total Dropped:", stats.FailedAcks)
+	text += sequenceStatsText(stats.SequenceStats)
+
+	if opts.RepublishSubject != "" {
+		text += fmt.Sprintln(
+			"Total Forwarded:", stats.Forwarded,
+			"| Forward Failures:", stats.ForwardFailures,
+			"| Deduplicated:", stats.Deduplicated,
+			"| Skipped:", stats.ForwardSkipped,
+		)
+	}
+
+	if opts.Partitions > 0 {
+		text += fmt.Sprintln("Total Skipped While Merging Partitions:", stats.SkippedMessages)
+	}
+
+	if stats.DecompressErrors > 0 {
+		text += fmt.Sprintln("Total Decompress Errors:", stats.DecompressErrors)
+	}
+
+	out.Event("stats", stats, text)
+
+	if opts.StatsFile != "" {
+		if err := writeStats(opts.StatsFile, stats); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func ConsumerFlags(fs *flag.FlagSet, opts *internal.ConsumerOptions) {
 	fs.StringVar(&opts.Cluster,
 		"cluster",
@@ -83,14 +189,44 @@ Can be set from the NATS_CLUSTER environment variable`,
 	fs.StringVar(&opts.ClientId,
 		"client",
 		"",
-		"The Nats Streaming Client ID. \nDefaults to ascii-producer")
+		"The Nats Streaming Client ID, which must be unique among the connected clients. \nDefaults to <client-prefix>-<hostname>-<pid>, or <client-prefix>-<hostname>-<durable> for durable subscriptions outside a queue group")
+	fs.StringVar(&opts.ClientIdPrefix,
+		"client-prefix",
+		"",
+		"The prefix of the generated Client ID, when -client isn't given. \nDefaults to ascii-consumer")
+	fs.IntVar(&opts.ClientIdRetries,
+		"client-retries",
+		0,
+		"How many times to retry connecting with a numbered suffix on the Client ID, while it's already in use. \nDefaults to 0")
 	fs.StringVar(&opts.ConnectionString,
 		"nats-url",
 		"",
-		`The NATS Connection String. 
+		`The NATS Connection String, or a comma separated list of servers to fail over between. 
 Can be set from the NATS_CONNECTION_STRING environment variable. 
 Defaults to nats://0.0.0.0:4222`,
 	)
+	fs.BoolVar(&opts.NoRandomize,
+		"no-randomize",
+		false,
+		`Connects to the servers in the order they're listed in nats-url, rather than in a random order.
+Defaults to false`,
+	)
+	fs.IntVar(&opts.PingInterval,
+		"ping-interval",
+		0,
+		"How often to ping the server, in seconds, to detect a lost connection. \nDefaults to 5")
+	fs.IntVar(&opts.PingMaxOut,
+		"ping-max-out",
+		0,
+		"How many pings can go unanswered before the connection is considered lost - at least 2. \nDefaults to 3")
+	fs.DurationVar(&opts.ReconnectWait,
+		"reconnect-wait",
+		0,
+		"The initial wait before reconnecting once the connection is lost, doubling with each attempt up to 30s. \nDefaults to 1s")
+	fs.IntVar(&opts.MaxReconnects,
+		"max-reconnects",
+		0,
+		"How many attempts to make to reconnect once the connection is lost. \nDefaults to 0 (keep trying)")
 	fs.StringVar(&opts.Subject,
 		"subject",
 		"",
@@ -99,14 +235,23 @@ Defaults to nats://0.0.0.0:4222`,
 		"queue-group",
 		"",
 		"A queue group name - starts the subscriber as part of a QueueGroup")
+	fs.DurationVar(&opts.Heartbeat,
+		"heartbeat",
+		0,
+		"With -queue-group, how often to send this member's counts to the group, for group-status. " +
+			"\nDefaults to 0 (disabled)")
 	fs.StringVar(&opts.DurableSubscription,
 		"durable",
 		"",
-		"The name to use for a durable subscription")
+		"The name to use for a durable subscription - with -queue-group, the queue group itself is durable")
 	fs.IntVar(&opts.AckWait,
 		"ackwait",
 		0,
 		"The wait time in seconds for the subscriber to manually acknowledge messages. \nDefaults to 10")
+	fs.DurationVar(&opts.VerifyGrace,
+		"verify-grace",
+		0,
+		"How long after a series' End message to wait for missing messages to be redelivered, before verifying it anyway. \nDefaults to the ackwait plus 1s")
 	fs.Float64Var(&opts.AckFailPercent,
 		"ack-fail-percent",
 		0.00,
@@ -120,6 +265,44 @@ Defaults to 0`,
 hat arrive out of order. 
 Defaults to 0`,
 	)
+	fs.Var(seedFlag{&opts.Seed},
+		"seed",
+		`Seeds which messages are dropped and which acks fail - with the same seed, the same deliveries of the same 
+messages are dropped or fail, so a run can be reproduced.
+Defaults to a random seed, which is printed on start`,
+	)
+	fs.StringVar(&opts.ProcessingLatency,
+		"latency",
+		"",
+		`How long processing each message takes, from a distribution - the handler is blocked while processing.
+- '<duration>' or 'fixed:<duration>' takes the same time for every message, ie '50ms'.
+- 'uniform:<min>-<max>' takes anywhere between min and max, ie 'uniform:10ms-100ms'.
+- 'normal:<mean>,<stddev>' is normally distributed around the mean, ie 'normal:50ms,10ms'.
+- 'exp:<mean>' is exponentially distributed - mostly quick, with a long tail, ie 'exp:20ms'.
+Defaults to no latency`,
+	)
+	fs.DurationVar(&opts.AckDelay,
+		"ack-delay",
+		0,
+		`Delays acknowledging each message by this long after processing it, without blocking the handler - useful for 
+showing AckWait redeliveries and MaxInflight stalls.
+Defaults to 0`,
+	)
+	fs.IntVar(&opts.CrashAfter,
+		"crash-after",
+		0,
+		`Simulates a crash after processing this many messages, closing the connection without closing or 
+unsubscribing - a durable subscription resumes from where it was when started again.
+Defaults to 0 (never crash)`,
+	)
+	fs.DurationVar(&opts.PauseEvery,
+		"pause-every",
+		0,
+		"Pauses processing periodically, after processing for this long - used with pause-for. \nDefaults to 0 (never pause)")
+	fs.DurationVar(&opts.PauseFor,
+		"pause-for",
+		0,
+		"How long each periodic pause lasts. \nDefaults to 0")
 	fs.BoolVar(&opts.BufferMessages,
 		"buffer",
 		false,
@@ -130,32 +313,72 @@ Defaults to false`,
 		"inflight",
 		1000,
 		"The total messages allowed in flight for the consumer, awaiting to be Ack'd. \nDefaults to 1000")
+	fs.IntVar(&opts.Partitions,
+		"partitions",
+		0,
+		`Subscribes to this many partitions of the subject (<subject>.0, <subject>.1, ...) and merges 
+the messages back into order.
+Defaults to 0 (not partitioned)`,
+	)
 	fs.StringVar(&opts.RepublishSubject,
 		"republish",
 		"",
 		`The name of a new Subject that this consumer will publish all received messages to.
 This can help to show a pattern that fans out via a Queue Group and then 
 consolidates all messages.`,
+	)
+	fs.StringVar(&opts.Output,
+		"output",
+		internal.OutputText,
+		`The output format - allows 'text' or 'json'.
+- 'json' writes events and stats as newline delimited JSON to stdout, and the ASCII art to stderr or the art file.
+Defaults to text`,
+	)
+	fs.StringVar(&opts.ArtFile,
+		"art-file",
+		"",
+		"With '-output json', a file to write the ASCII art to instead of stderr")
+	fs.StringVar(&opts.StatsFile,
+		"stats-file",
+		"",
+		"A file to export the consumer stats to as JSON on shutdown")
+	fs.BoolVar(&opts.Forward,
+		"forward",
+		false,
+		`Used with republish - forwards messages in sequence order, only acknowledging each once the republished
+message has been acknowledged, and skips republishing redelivered messages that were already forwarded.
+Defaults to false`,
 	)
 	fs.BoolVar(&opts.UnsubscribeOnClose,
 		"unsubscribe",
 		false,
 		`Whether subscriptions should be removed (true) or closed (false).
-This really only affects Durable subscriptions. 
+This really only affects Durable subscriptions - a durable queue group is only removed once its last member unsubscribes.
 Defaults to false`,
 	)
 	fs.StringVar(&opts.StartingOffset,
 		"offset",
 		"now",
-		`The starting offset - allows 'now' or 'all'. If a starting sequence is given, this is ignored. 
+		`The starting offset - allows 'now', 'all', 'last', a time, a duration ago or 'series:<id>'. If a starting sequence is given, this is ignored. 
 - 'now' sets the Subscription to receive messages from current time, forward.
-- 'all' will set the Subscription to receive all messages available for the topic.`,
+- 'all' will set the Subscription to receive all messages available for the topic.
+- 'last' starts with the last message published to the topic.
+- An RFC3339 time, ie 2020-03-01T12:30:00Z, starts with the first message published at or after it.
+- A duration, ie 90s or 1h30m, starts with messages published that long before the Subscription started.
+- 'series:<id>' scans the topic for the first message of the MessageSeriesId, and starts there.`,
 	)
+	fs.StringVar(&opts.IndexFile,
+		"index",
+		"",
+		"With -offset series:<id>, an index file written by the index command to look up where the series starts, "+
+			"instead of scanning the subject for it")
 	fs.Uint64Var(&opts.StartingSequence,
 		"sequence",
 		0,
 		"A starting Sequence ID for the Subscription. Setting this value will override the `offset` option above.")
 
+	AuthFlags(fs, &opts.ConnectionAuth)
+
 	fs.Usage = func() {
 		fmt.Println(fmt.Sprintf("\nUsage: %s consumer -subject <subject>", os.Args[0]))
 		fmt.Println("Options:")
@@ -163,6 +386,77 @@ Defaults to false`,
 	}
 }
 
+// The redelivery and ordering stats, along with how late out of order messages were
+func sequenceStatsText(stats internal.SequenceStats) string {
+	text := fmt.Sprintln(
+		"Redelivered:", stats.Redelivered,
+		"| Out of Order:", stats.OutOfOrder,
+		"| Duplicate Sequences:", stats.DuplicateSequences,
+		"| Sequence Gaps:", stats.SequenceGaps,
+		"| Missing Sequences:", stats.MissingSequences,
+	)
+
+	if stats.OutOfOrder == 0 {
+		return text
+	}
+
+	text += fmt.Sprintln("Out of Order Lateness (sequences behind):")
+	for _, bucket := range stats.Lateness.Buckets {
+		text += fmt.Sprintln(fmt.Sprintf("  %8s | %d", bucket.Range, bucket.Count))
+	}
+
+	return text
+}
+
+// Exports the stats as JSON to the given file
+func writeStats(path string, stats internal.ConsumerStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write stats: %v", err)
+	}
+
+	return nil
+}
+
+// Prints whether the reassembled series matched what the producer published
+func printVerification(out *internal.Output, result internal.VerificationResult) {
+	status := "MATCH"
+	if !result.Match() {
+		status = "MISMATCH"
+	}
+
+	text := fmt.Sprintln(fmt.Sprintf(
+		" Verification: %s  |  Received: %d/%d  |  Missing: %d  |  Duplicated: %d  |  Corrupt: %d",
+		status,
+		result.Received,
+		result.Expected,
+		len(result.Missing),
+		len(result.Duplicates),
+		len(result.Corrupt),
+	))
+
+	if len(result.Missing) > 0 {
+		text += fmt.Sprintln(" Missing MessageIds:", result.Missing)
+	}
+
+	if len(result.Duplicates) > 0 {
+		text += fmt.Sprintln(" Duplicated MessageIds:", result.Duplicates)
+	}
+
+	if len(result.Corrupt) > 0 {
+		text += fmt.Sprintln(" Corrupt MessageIds:", result.Corrupt)
+	}
+
+	out.Event("verification", struct {
+		internal.VerificationResult
+		Match bool `json:"match"`
+	}{result, result.Match()}, text)
+}
+
 // Basic stats on messages on the Subscriber
 type MessageStats struct {
 	// Start Time
@@ -199,4 +493,27 @@ func (s *MessageStats) GetMessagesPerSecond() float64 {
 	}
 
 	return 0.0
-}
\ No newline at end of file
+}
+
+// Parses the chaos seed, which is only set when given - so that 0 can be chosen like any other seed
+type seedFlag struct {
+	seed **int64
+}
+
+func (f seedFlag) String() string {
+	if f.seed == nil || *f.seed == nil {
+		return ""
+	}
+
+	return strconv.FormatInt(**f.seed, 10)
+}
+
+func (f seedFlag) Set(value string) error {
+	seed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid seed %q", value)
+	}
+
+	*f.seed = &seed
+	return nil
+}
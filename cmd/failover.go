@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kmfk/stan-demo/internal"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FailoverFlagOptions struct {
+	internal.FailoverOptions
+
+	// The output format - text or json
+	Output string
+}
+
+// Starts an embedded cluster and runs a producer and consumer against it, while stopping each node in turn - then
+// reports any messages which were lost, duplicated or delayed.
+func Failover(opts *FailoverFlagOptions) error {
+	out, err := internal.NewOutput(opts.Output, "")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := failover(opts, out); err != nil {
+		return reportError(out, err)
+	}
+
+	return nil
+}
+
+func failover(opts *FailoverFlagOptions, out *internal.Output) error {
+	f := internal.Failover{}
+	f.SetOutput(out)
+
+	if err := f.SetOptions(opts.FailoverOptions); err != nil {
+		return err
+	}
+
+	if err := f.Start(); err != nil {
+		return err
+	}
+	defer f.End()
+
+	report := f.Run()
+	out.Event("failover_report", report, failoverReportText(report, f.GetOptions().DelayThreshold))
+
+	return nil
+}
+
+func failoverReportText(report internal.FailoverReport, threshold time.Duration) string {
+	var b strings.Builder
+
+	b.WriteString("\n\nFAILOVER REPORT\n")
+	for _, stop := range report.Stops {
+		b.WriteString(fmt.Sprintf(" Stopped %s  |  Recovered in: %s", stop.Node, stop.Recovery.Round(time.Millisecond)))
+		if stop.Error != "" {
+			b.WriteString("  |  Error: " + stop.Error)
+		}
+
+		b.WriteString("\n")
+	}
+
+	b.WriteString(fmt.Sprintf("\nMessages: %d  |  Acked: %d  |  Retries: %d  |  Received: %d\n",
+		report.Messages, report.Acked, report.Retries, report.Received))
+	b.WriteString(fmt.Sprintf("Unpublished: %d %s\n", len(report.Unpublished), idRanges(report.Unpublished)))
+	b.WriteString(fmt.Sprintf("Lost: %d %s\n", len(report.Lost), idRanges(report.Lost)))
+	b.WriteString(fmt.Sprintf("Duplicated: %d, received %d extra times %s\n",
+		len(report.Duplicated), report.Duplicates, idRanges(report.Duplicated)))
+	b.WriteString(fmt.Sprintf("Delayed over %s: %d %s\n", threshold, len(report.Delayed), idRanges(report.Delayed)))
+	b.WriteString(fmt.Sprintf("Latency  |  P50: %s  |  P90: %s  |  P99: %s  |  Max: %s\n",
+		report.Latency.P50, report.Latency.P90, report.Latency.P99, report.Latency.Max))
+
+	if report.Error != "" {
+		b.WriteString("Error: " + report.Error + "\n")
+	}
+
+	return b.String()
+}
+
+// Shortens sorted MessageIds into ranges, ie [1-3 7 9-10]
+func idRanges(ids []int) string {
+	var ranges []string
+
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(ids[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", ids[i], ids[j]))
+		}
+
+		i = j + 1
+	}
+
+	return "[" + strings.Join(ranges, " ") + "]"
+}
+
+func FailoverFlags(fs *flag.FlagSet, opts *FailoverFlagOptions) {
+	fs.StringVar(&opts.Cluster,
+		"cluster",
+		"",
+		"The Nats Streaming cluster name of the embedded cluster. \nDefaults to test-cluster")
+	fs.StringVar(&opts.ClientId,
+		"client",
+		"",
+		"The prefix for the Nats Streaming Client IDs of the producer and consumer. \nDefaults to ascii-failover")
+	fs.BoolVar(&opts.NoRandomize,
+		"no-randomize",
+		false,
+		"Connects to the nodes in order, rather than in a random order. \nDefaults to false")
+	fs.StringVar(&opts.Subject,
+		"subject",
+		"",
+		"The prefix of the subject to publish to. \nDefaults to ascii.failover")
+	fs.IntVar(&opts.Nodes,
+		"nodes",
+		3,
+		"How many nodes the embedded cluster has - at least 3, so a majority is left while one is stopped. \nDefaults to 3")
+	fs.IntVar(&opts.Messages,
+		"messages",
+		2000,
+		"How many characters to publish, spread evenly over the run. \nDefaults to 2000")
+	fs.DurationVar(&opts.Downtime,
+		"downtime",
+		5*time.Second,
+		"How long each node is stopped for. \nDefaults to 5s")
+	fs.DurationVar(&opts.Uptime,
+		"uptime",
+		5*time.Second,
+		"How long every node runs for, before and after each node is stopped. \nDefaults to 5s")
+	fs.DurationVar(&opts.DelayThreshold,
+		"delay-threshold",
+		time.Second,
+		"Messages taking longer than this from being published to being received are reported as delayed. \nDefaults to 1s")
+	fs.DurationVar(&opts.Timeout,
+		"timeout",
+		60*time.Second,
+		"How long to wait for the remaining messages to be received, once publishing has finished. \nDefaults to 60s")
+	fs.StringVar(&opts.Output,
+		"output",
+		internal.OutputText,
+		`The output format - allows 'text' or 'json'.
+- 'json' writes events and the report as newline delimited JSON to stdout.
+Defaults to text`,
+	)
+
+	fs.Usage = func() {
+		fmt.Println(fmt.Sprintf("\nUsage: %s failover -nodes 3 -downtime 5s", os.Args[0]))
+		fmt.Println("Options:")
+		fs.PrintDefaults()
+	}
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kmfk/stan-demo/internal"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type GroupStatusFlagOptions struct {
+	internal.GroupMonitorOptions
+
+	// How often the status is written, and the output format - text or json
+	Interval time.Duration
+	Output   string
+}
+
+// A summary of the queue group, as written by group-status
+type groupSummary struct {
+	Members  []internal.GroupMember `json:"members"`
+	Active   int                    `json:"active"`
+	Moved    int                    `json:"moved"`
+	Fairness float64                `json:"fairness"`
+}
+
+// Listens to the heartbeats of a queue group's members, writing each member's share of the messages and redeliveries
+// on every interval, and as members join or leave - until interrupted.
+func GroupStatus(opts *GroupStatusFlagOptions) error {
+	out, err := internal.NewOutput(opts.Output, "")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := groupStatus(opts, out); err != nil {
+		return reportError(out, err)
+	}
+
+	return nil
+}
+
+func groupStatus(opts *GroupStatusFlagOptions, out *internal.Output) error {
+	if opts.Interval <= 0 {
+		return errors.New("the interval to write the status on must be more than 0")
+	}
+
+	g := internal.GroupMonitor{}
+	g.SetOutput(out)
+
+	if err := g.SetOptions(opts.GroupMonitorOptions); err != nil {
+		return err
+	}
+
+	if err := g.Connect(); err != nil {
+		return err
+	}
+
+	if err := g.Start(); err != nil {
+		_ = g.End()
+		return err
+	}
+
+	out.Event("watching", map[string]string{
+		"subject":     g.GetOptions().Subject,
+		"queue_group": g.GetOptions().QueueGroup,
+	}, fmt.Sprintf("\nWatching queue group %s on %s - members send heartbeats when started with -heartbeat \n",
+		g.GetOptions().QueueGroup, g.GetOptions().Subject))
+
+	ctlc := make(chan os.Signal, 2)
+	signal.Notify(ctlc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(ctlc)
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			writeGroupStatus(out, g.Status())
+		case <-ctlc:
+			writeGroupStatus(out, g.Status())
+			return g.End()
+		}
+	}
+}
+
+func writeGroupStatus(out *internal.Output, status *internal.GroupStatus) {
+	members := status.Members()
+	summary := groupSummary{Members: members, Moved: status.Moved(), Fairness: internal.GroupFairness(members)}
+
+	var b strings.Builder
+	b.WriteString("\nGROUP STATUS\n")
+
+	for _, m := range members {
+		state := "active"
+		if m.Left {
+			state = "left"
+		} else if m.Lost {
+			state = "lost"
+		} else {
+			summary.Active++
+		}
+
+		b.WriteString(fmt.Sprintf(
+			" %s  |  %s  |  Received: %d (%.1f%%)  |  Acked: %d  |  Redelivered: %d  |  Moved In: %d\n",
+			m.ClientId,
+			state,
+			m.Received,
+			m.Share*100,
+			m.AcksSent,
+			m.Redelivered,
+			m.MovedIn,
+		))
+	}
+
+	b.WriteString(fmt.Sprintf("Active Members: %d  |  Moved Between Members: %d  |  Fairness: %.3f\n",
+		summary.Active, summary.Moved, summary.Fairness))
+
+	out.Event("group_status", summary, b.String())
+}
+
+func GroupStatusFlags(fs *flag.FlagSet, opts *GroupStatusFlagOptions) {
+	fs.StringVar(&opts.Cluster,
+		"cluster",
+		"",
+		`The Nats Streaming cluster name.
+Can be set from the NATS_CLUSTER environment variable`,
+	)
+	fs.StringVar(&opts.ClientId,
+		"client",
+		"",
+		"The Nats Streaming Client ID. \nDefaults to ascii-group-status-<hostname>-<pid>")
+	fs.StringVar(&opts.ConnectionString,
+		"nats-url",
+		"",
+		`The NATS Connection String, or a comma separated list of servers to fail over between.
+Can be set from the NATS_CONNECTION_STRING environment variable.
+Defaults to nats://0.0.0.0:4222`,
+	)
+	fs.BoolVar(&opts.NoRandomize,
+		"no-randomize",
+		false,
+		`Connects to the servers in the order they're listed in nats-url, rather than in a random order.
+Defaults to false`,
+	)
+	fs.StringVar(&opts.Subject,
+		"subject",
+		"",
+		"The subject the queue group subscribes to. \nDefaults to ascii")
+	fs.StringVar(&opts.QueueGroup,
+		"queue-group",
+		"",
+		"The queue group to watch")
+	fs.DurationVar(&opts.Interval,
+		"interval",
+		5*time.Second,
+		"How often to write the status of the group. \nDefaults to 5s")
+	fs.StringVar(&opts.Output,
+		"output",
+		internal.OutputText,
+		`The output format - allows 'text' or 'json'.
+- 'json' writes membership changes and the status as newline delimited JSON to stdout.
+Defaults to text`,
+	)
+
+	AuthFlags(fs, &opts.ConnectionAuth)
+
+	fs.Usage = func() {
+		fmt.Println(fmt.Sprintf("\nUsage: %s group-status -queue-group <group>", os.Args[0]))
+		fmt.Println("Options:")
+		fs.PrintDefaults()
+	}
+}
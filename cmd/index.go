@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kmfk/stan-demo/internal"
+	"os"
+	"strings"
+	"time"
+)
+
+type IndexFlagOptions struct {
+	internal.IndexOptions
+
+	// The file to write the index to, and the output format - text or json
+	File   string
+	Output string
+}
+
+// Reads a channel from the beginning and writes an index of the series stored in it to a file, which the consumer and
+// replay-series can use to find where a series starts without scanning the channel.
+func Index(opts *IndexFlagOptions) error {
+	out, err := internal.NewOutput(opts.Output, "")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := index(opts, out); err != nil {
+		return reportError(out, err)
+	}
+
+	return nil
+}
+
+func index(opts *IndexFlagOptions, out *internal.Output) error {
+	i := internal.Indexer{}
+	i.SetOutput(out)
+
+	if err := i.SetOptions(opts.IndexOptions); err != nil {
+		return err
+	}
+
+	if err := i.Connect(); err != nil {
+		return err
+	}
+	defer i.End()
+
+	out.Event("indexing", map[string]string{"subject": i.GetOptions().Subject},
+		fmt.Sprintf("\nIndexing %s... \n", i.GetOptions().Subject))
+
+	idx, err := i.Run()
+	if err != nil {
+		return err
+	}
+
+	if err := idx.Save(opts.File); err != nil {
+		return fmt.Errorf("failed to save the index: %v", err)
+	}
+
+	out.Event("index", idx, indexText(idx, opts.File))
+
+	return nil
+}
+
+func indexText(idx internal.ChannelIndex, file string) string {
+	var b strings.Builder
+
+	b.WriteString(fmt.Sprintf("\nCHANNEL INDEX  %s  |  Messages: %d  |  Series: %d  |  Unindexed: %d\n",
+		idx.Subject, idx.Messages, len(idx.Series), idx.Unindexed))
+
+	for _, s := range idx.Series {
+		state := "complete"
+		if !s.Complete {
+			state = "incomplete"
+		}
+
+		b.WriteString(fmt.Sprintf(" %s  |  Sequences: %d-%d  |  Messages: %d/%d  |  %s  |  %s - %s\n",
+			s.MessageSeriesId,
+			s.FirstSequence,
+			s.LastSequence,
+			s.Unique,
+			s.Expected,
+			state,
+			s.FirstTimestamp.Format(time.RFC3339),
+			s.LastTimestamp.Format(time.RFC3339),
+		))
+	}
+
+	b.WriteString(fmt.Sprintf("Saved to %s\n", file))
+
+	return b.String()
+}
+
+func IndexFlags(fs *flag.FlagSet, opts *IndexFlagOptions) {
+	fs.StringVar(&opts.Cluster,
+		"cluster",
+		"",
+		`The Nats Streaming cluster name.
+Can be set from the NATS_CLUSTER environment variable`,
+	)
+	fs.StringVar(&opts.ClientId,
+		"client",
+		"",
+		"The Nats Streaming Client ID. \nDefaults to ascii-index-<hostname>-<pid>")
+	fs.StringVar(&opts.ConnectionString,
+		"nats-url",
+		"",
+		`The NATS Connection String, or a comma separated list of servers to fail over between.
+Can be set from the NATS_CONNECTION_STRING environment variable.
+Defaults to nats://0.0.0.0:4222`,
+	)
+	fs.BoolVar(&opts.NoRandomize,
+		"no-randomize",
+		false,
+		`Connects to the servers in the order they're listed in nats-url, rather than in a random order.
+Defaults to false`,
+	)
+	fs.StringVar(&opts.Subject,
+		"subject",
+		"",
+		"The subject to index. \nDefaults to ascii")
+	fs.StringVar(&opts.File,
+		"file",
+		internal.DefaultIndexFile,
+		"The file to write the index to. \nDefaults to "+internal.DefaultIndexFile)
+	fs.DurationVar(&opts.Timeout,
+		"timeout",
+		30*time.Second,
+		"Gives up if no message arrives for this long while reading the channel. \nDefaults to 30s")
+	fs.StringVar(&opts.Output,
+		"output",
+		internal.OutputText,
+		`The output format - allows 'text' or 'json'.
+- 'json' writes the index as newline delimited JSON to stdout.
+Defaults to text`,
+	)
+
+	AuthFlags(fs, &opts.ConnectionAuth)
+
+	fs.Usage = func() {
+		fmt.Println(fmt.Sprintf("\nUsage: %s index -subject <subject>", os.Args[0]))
+		fmt.Println("Options:")
+		fs.PrintDefaults()
+	}
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import "github.com/kmfk/stan-demo/internal"
+
+// An error which has already been written to the output as an error event, so only needs to be reflected in the exit
+// status rather than printed again
+type ReportedError struct {
+	Err error
+}
+
+func (e *ReportedError) Error() string {
+	return e.Err.Error()
+}
+
+// Writes the error as an error event when the output is json, so a script reading the events sees why the command
+// failed, and returns it as a ReportedError - or returns it as it is to be printed otherwise
+func reportError(out *internal.Output, err error) error {
+	if !out.JSON() {
+		return err
+	}
+
+	out.Error(err)
+
+	return &ReportedError{Err: err}
+}
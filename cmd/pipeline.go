@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kmfk/stan-demo/internal"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Runs a chain of stages, each subscribing to a subject, transforming the ASCII characters and publishing them on to
+// the next subject - until the last stage publishes to the output subject.
+func Pipeline(opts *internal.PipelineOptions) error {
+	p := internal.Pipeline{}
+
+	if err := p.SetOptions(*opts); err != nil {
+		return err
+	}
+
+	if err := p.Start(); err != nil {
+		_ = p.End()
+		return err
+	}
+
+	fmt.Println("\nPIPELINE")
+	for i, stage := range p.GetStages() {
+		fmt.Println(fmt.Sprintf(" %d. %s  |  %s -> %s", i+1, stage.Name, stage.Input, stage.Output))
+	}
+
+	ctlc := make(chan os.Signal, 2)
+	signal.Notify(ctlc, os.Interrupt, syscall.SIGTERM)
+	<-ctlc
+
+	if err := p.End(); err != nil {
+		return err
+	}
+
+	fmt.Println("\nSTAGE STATS")
+	for i, stage := range p.GetStages() {
+		stats := stage.GetStageStats()
+		fmt.Println(fmt.Sprintf(
+			" %d. %s  |  Received: %d  |  Published: %d  |  Errors: %d  |  Avg Latency: %s  |  Max Latency: %s",
+			i+1,
+			stage.Name,
+			stats.Received,
+			stats.Published,
+			stats.Errors,
+			stats.GetAverageLatency(),
+			stats.LatencyMax,
+		))
+	}
+
+	return nil
+}
+
+func PipelineFlags(fs *flag.FlagSet, opts *internal.PipelineOptions) {
+	fs.StringVar(&opts.Cluster,
+		"cluster",
+		"",
+		`The Nats Streaming cluster name.
+Can be set from the NATS_CLUSTER environment variable`,
+	)
+	fs.StringVar(&opts.ClientId,
+		"client",
+		"",
+		"The prefix for the Nats Streaming Client ID of each stage. \nDefaults to ascii-pipeline-<hostname>-<pid>")
+	fs.StringVar(&opts.ConnectionString,
+		"nats-url",
+		"",
+		`The NATS Connection String, or a comma separated list of servers to fail over between. 
+Can be set from the NATS_CONNECTION_STRING environment variable. 
+Defaults to nats://0.0.0.0:4222`,
+	)
+	fs.BoolVar(&opts.NoRandomize,
+		"no-randomize",
+		false,
+		`Connects to the servers in the order they're listed in nats-url, rather than in a random order.
+Defaults to false`,
+	)
+	fs.StringVar(&opts.Subject,
+		"subject",
+		"",
+		"The subject the first stage subscribes to. \nDefaults to ascii")
+	fs.StringVar(&opts.OutputSubject,
+		"output",
+		"",
+		"The subject the last stage publishes to. \nDefaults to <subject>.out")
+	fs.Var(stagesFlag{&opts.Stages},
+		"stages",
+		`A comma separated list of the transform for each stage, in order:
+- 'invert' swaps light and dark characters.
+- 'upper' upper-cases every character.
+- 'mirror' reverses each row of the image.
+- 'color' or 'color=<name>' colors every character - red, green, yellow, blue, magenta, cyan or white.
+- 'filter' or 'filter=<chars>' blanks out the given characters, defaulting to the lightest (.,:)`,
+	)
+	fs.IntVar(&opts.AckWait,
+		"ackwait",
+		0,
+		"The wait time in seconds for each stage to acknowledge messages. \nDefaults to 10")
+
+	AuthFlags(fs, &opts.ConnectionAuth)
+
+	fs.Usage = func() {
+		fmt.Println(fmt.Sprintf("\nUsage: %s pipeline -stages <transform,...>", os.Args[0]))
+		fmt.Println("Options:")
+		fs.PrintDefaults()
+	}
+}
+
+// Parses a comma separated list of stages
+type stagesFlag struct {
+	stages *[]string
+}
+
+func (f stagesFlag) String() string {
+	if f.stages == nil {
+		return ""
+	}
+
+	return strings.Join(*f.stages, ",")
+}
+
+func (f stagesFlag) Set(value string) error {
+	*f.stages = strings.Split(value, ",")
+	return nil
+}
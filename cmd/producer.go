@@ -5,15 +5,55 @@ import (
 	"fmt"
 	"github.com/kmfk/stan-demo/internal"
 	"os"
+	"sort"
+	"time"
 )
 
+// The common behavior of a single Producer and a MultiProducer
+type publisher interface {
+	Connect() error
+	GetAscii() ([]string, error)
+	Publish(messages []string) error
+	DrainAndClose() error
+	GetPublishStats() internal.ProducerStats
+	GetReceipts() map[string][]internal.Receipt
+}
+
 // Uses the given image file and converts to ASCII text and pushes each ASCII character through NATS Streaming.
 func Producer(opts *internal.ProducerOptions) error {
-	p := internal.Producer{}
-
-	if err := p.SetOptions(*opts); err != nil {
+	out, err := internal.NewOutput(opts.Output, opts.ArtFile)
+	if err != nil {
 		return err
 	}
+	defer out.Close()
+
+	if err := produce(opts, out); err != nil {
+		return reportError(out, err)
+	}
+
+	return nil
+}
+
+func produce(opts *internal.ProducerOptions, out *internal.Output) error {
+	var p publisher
+
+	if opts.Publishers > 1 {
+		mp := &internal.MultiProducer{}
+		if err := mp.SetOptions(*opts); err != nil {
+			return err
+		}
+
+		mp.SetOutput(out)
+		p = mp
+	} else {
+		sp := &internal.Producer{}
+		if err := sp.SetOptions(*opts); err != nil {
+			return err
+		}
+
+		sp.SetOutput(out)
+		p = sp
+	}
 
 	if err := p.Connect(); err != nil {
 		return err
@@ -27,15 +67,33 @@ func Producer(opts *internal.ProducerOptions) error {
 		}
 	}
 
-	fmt.Print("\nClosing down... ")
+	out.Event("closing", nil, "\nClosing down... ")
 	if err := p.DrainAndClose(); err != nil {
 		return err
 	} else {
-		fmt.Print("done.")
+		out.Event("closed", nil, "done.")
+	}
+
+	if sp, ok := p.(*internal.Producer); ok && sp.Interrupted() && opts.CheckpointFile != "" {
+		out.Event("interrupted", map[string]string{"checkpoint": opts.CheckpointFile},
+			fmt.Sprint("\nInterrupted - run again with -resume to continue from ", opts.CheckpointFile))
+	}
+
+	if mp, ok := p.(*internal.MultiProducer); ok {
+		for i, stats := range mp.GetPublisherStats() {
+			out.Event("publisher_stats", publishStats(stats, map[string]interface{}{"publisher": i + 1}), fmt.Sprintln(fmt.Sprintf(
+				"\nPublisher %d  | Sent: %d  | Acks: %d  |  Time Taken: %s  | Messages/Sec: %v",
+				i+1,
+				stats.MessagesSent,
+				stats.AcksReceived,
+				stats.GetDuration(),
+				stats.GetMessagesPerSecond(),
+			)))
+		}
 	}
 
 	stats := p.GetPublishStats()
-	fmt.Println(fmt.Sprintf(
+	text := fmt.Sprintln(fmt.Sprintf(
 		"\nTotal Sent: %d  | Total Acks: %d  |  Time Taken: %s  | Messages/Sec: %v",
 		stats.MessagesSent,
 		stats.AcksReceived,
@@ -43,9 +101,96 @@ func Producer(opts *internal.ProducerOptions) error {
 		stats.GetMessagesPerSecond(),
 	))
 
+	if stats.Retries > 0 || stats.PermanentFailures > 0 {
+		text += fmt.Sprintln(fmt.Sprintf(
+			"Retries: %d  | Permanent Failures: %d",
+			stats.Retries,
+			stats.PermanentFailures,
+		))
+	}
+
+	if len(stats.FailedMessageIds) > 0 {
+		text += fmt.Sprintln("Failed MessageIds:", stats.FailedMessageIds)
+	}
+
+	if stats.TargetRate > 0 || stats.TargetByteRate > 0 {
+		text += fmt.Sprintln(fmt.Sprintf(
+			"Target Messages/Sec: %v  | Achieved: %v  | Target Bytes/Sec: %v  | Achieved: %v",
+			stats.TargetRate,
+			stats.GetMessagesPerSecond(),
+			stats.TargetByteRate,
+			stats.GetBytesPerSecond(),
+		))
+	}
+
+	if opts.Compression != internal.CompressionNone {
+		text += fmt.Sprintln(fmt.Sprintf(
+			"Compressed: %d  | Raw Bytes: %d  | Bytes Sent: %d  | Ratio: %v",
+			stats.CompressedMessages,
+			stats.RawBytes,
+			stats.BytesSent,
+			stats.GetCompressionRatio(),
+		))
+	}
+
+	out.Event("stats", publishStats(stats, nil), text)
+
+	if opts.Receipts > 0 {
+		printReceipts(out, p.GetReceipts(), opts.Receipts)
+	}
+
 	return nil
 }
 
+// The stats as event data, along with the computed rates and any extra fields
+func publishStats(stats internal.ProducerStats, extra map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{
+		"messages_sent":       stats.MessagesSent,
+		"acks_received":       stats.AcksReceived,
+		"retries":             stats.Retries,
+		"permanent_failures":  stats.PermanentFailures,
+		"failed_message_ids":  stats.FailedMessageIds,
+		"raw_bytes":           stats.RawBytes,
+		"bytes_sent":          stats.BytesSent,
+		"compressed_messages": stats.CompressedMessages,
+		"compression_ratio":   stats.GetCompressionRatio(),
+		"target_rate":         stats.TargetRate,
+		"target_byte_rate":    stats.TargetByteRate,
+		"duration_ms":         stats.GetDuration().Milliseconds(),
+		"messages_per_second": stats.GetMessagesPerSecond(),
+		"bytes_per_second":    stats.GetBytesPerSecond(),
+	}
+
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	return data
+}
+
+// Prints which consumers confirmed they processed each series
+func printReceipts(out *internal.Output, receipts map[string][]internal.Receipt, expected int) {
+	for id, rs := range receipts {
+		text := fmt.Sprintln(fmt.Sprintf("Receipts for %s: %d of %d consumers completed", id, len(rs), expected))
+
+		sort.Slice(rs, func(i, j int) bool { return rs[i].ClientId < rs[j].ClientId })
+		for _, r := range rs {
+			status := "verified"
+			if !r.Verified {
+				status = "not verified"
+			}
+
+			text += fmt.Sprintln(fmt.Sprintf("  - %s  | Received: %d/%d  | %s", r.ClientId, r.Received, r.Expected, status))
+		}
+
+		out.Event("receipts", map[string]interface{}{
+			"message_series_id": id,
+			"expected":          expected,
+			"receipts":          rs,
+		}, text)
+	}
+}
+
 func ProducerFlags(fs *flag.FlagSet, opts *internal.ProducerOptions) {
 	fs.StringVar(&opts.Cluster,
 		"cluster",
@@ -54,12 +199,42 @@ func ProducerFlags(fs *flag.FlagSet, opts *internal.ProducerOptions) {
 	fs.StringVar(&opts.ClientId,
 		"client",
 		"",
-		"The Nats Streaming Client ID. \nDefaults to ascii-producer")
+		"The Nats Streaming Client ID, which must be unique among the connected clients. \nDefaults to <client-prefix>-<hostname>-<pid>")
+	fs.StringVar(&opts.ClientIdPrefix,
+		"client-prefix",
+		"",
+		"The prefix of the generated Client ID, when -client isn't given. \nDefaults to ascii-producer")
+	fs.IntVar(&opts.ClientIdRetries,
+		"client-retries",
+		0,
+		"How many times to retry connecting with a numbered suffix on the Client ID, while it's already in use. \nDefaults to 0")
 	fs.StringVar(&opts.ConnectionString,
 		"nats-url",
 		"",
-		"The NATS Connection String. Can be set from the NATS_CONNECTION_STRING environment variable." +
+		"The NATS Connection String, or a comma separated list of servers to fail over between. " +
+			"Can be set from the NATS_CONNECTION_STRING environment variable." +
 			"\nDefaults to nats://0.0.0.0:4222")
+	fs.BoolVar(&opts.NoRandomize,
+		"no-randomize",
+		false,
+		"Connects to the servers in the order they're listed in nats-url, rather than in a random order." +
+			"\nDefaults to false")
+	fs.IntVar(&opts.PingInterval,
+		"ping-interval",
+		0,
+		"How often to ping the server, in seconds, to detect a lost connection. \nDefaults to 5")
+	fs.IntVar(&opts.PingMaxOut,
+		"ping-max-out",
+		0,
+		"How many pings can go unanswered before the connection is considered lost - at least 2. \nDefaults to 3")
+	fs.DurationVar(&opts.ReconnectWait,
+		"reconnect-wait",
+		0,
+		"The initial wait before reconnecting once the connection is lost, doubling with each attempt up to 30s. \nDefaults to 1s")
+	fs.IntVar(&opts.MaxReconnects,
+		"max-reconnects",
+		0,
+		"How many attempts to make to reconnect once the connection is lost. \nDefaults to 0 (keep trying)")
 	fs.StringVar(&opts.LocalFile,
 		"file",
 		"",
@@ -83,6 +258,111 @@ func ProducerFlags(fs *flag.FlagSet, opts *internal.ProducerOptions) {
 		"batch",
 		1,
 		"Amount of characters sent in each message. \nDefaults to 1")
+	fs.DurationVar(&opts.AckTimeout,
+		"ack-timeout",
+		0,
+		"How long to wait for STAN to acknowledge a published message before it is retried. \nDefaults to 30s")
+	fs.IntVar(&opts.MaxAttempts,
+		"max-attempts",
+		internal.DefaultMaxPublishAttempts,
+		"The maximum number of attempts to publish each message, before it is reported as failed. \nDefaults to 3")
+	fs.DurationVar(&opts.RetryBackoff,
+		"retry-backoff",
+		100*time.Millisecond,
+		"The initial backoff before retrying a failed publish, doubling with each attempt. \nDefaults to 100ms")
+	fs.DurationVar(&opts.RetryMaxBackoff,
+		"retry-max-backoff",
+		5*time.Second,
+		"The maximum backoff between attempts to publish a message. \nDefaults to 5s")
+	fs.IntVar(&opts.Partitions,
+		"partitions",
+		0,
+		"Shards messages across this many subjects - <subject>.0, <subject>.1, ... \nDefaults to 0 (not partitioned)")
+	fs.StringVar(&opts.PartitionKey,
+		"partition-key",
+		internal.PartitionKeyId,
+		`How messages are assigned to a partition - allows 'row', 'id' or 'series'.
+- 'row' keeps each row of the image on the same partition.
+- 'id' assigns messages by MessageId mod the number of partitions.
+- 'series' keeps each image entirely on one partition.
+Defaults to id`,
+	)
+	fs.IntVar(&opts.Receipts,
+		"receipts",
+		0,
+		"Wait for processing receipts from this many consumers once the image has been published. \nDefaults to 0 (don't wait)")
+	fs.DurationVar(&opts.ReceiptTimeout,
+		"receipt-timeout",
+		30*time.Second,
+		"How long to wait for processing receipts from consumers. \nDefaults to 30s")
+	fs.StringVar(&opts.CheckpointFile,
+		"checkpoint",
+		internal.DefaultCheckpointFile,
+		"A file to save the series ID and last acknowledged MessageId to, so an interrupted producer can be resumed. "+
+			"\nSet to an empty string to disable. \nDefaults to "+internal.DefaultCheckpointFile)
+	fs.DurationVar(&opts.CheckpointInterval,
+		"checkpoint-interval",
+		0,
+		"How often to save the checkpoint while messages are being acknowledged, so a killed producer can still be resumed. \nDefaults to 1s")
+	fs.BoolVar(&opts.Resume,
+		"resume",
+		false,
+		"Resume the series in the checkpoint file, from the first message that wasn't acknowledged. \nDefaults to false")
+	fs.IntVar(&opts.Publishers,
+		"publishers",
+		1,
+		"The number of publishers to run in parallel, each with their own client ID and connection. \nDefaults to 1")
+	fs.StringVar(&opts.PublisherMode,
+		"publisher-mode",
+		internal.PublisherModeSplit,
+		`How multiple publishers share the work - allows 'split' or 'series'.
+- 'split' has the publishers take turns publishing the messages of a single image.
+- 'series' has each publisher publish the whole image as its own series.
+Defaults to split`,
+	)
+	fs.Float64Var(&opts.RateLimit,
+		"rate",
+		0,
+		"Limits publishing to this many messages per second, using a token bucket. \nDefaults to 0 (no limit)")
+	fs.Float64Var(&opts.ByteRateLimit,
+		"byte-rate",
+		0,
+		"Limits publishing to this many bytes per second, using a token bucket. \nDefaults to 0 (no limit)")
+	fs.IntVar(&opts.Burst,
+		"burst",
+		1,
+		"How many messages can be published at once before the rate limit applies. \nDefaults to 1")
+	fs.StringVar(&opts.RampProfile,
+		"ramp",
+		"",
+		`Varies the rate limit over time - allows 'linear', 'step' or 'sine'.
+- 'linear' ramps up to the full rate over the ramp period, then holds.
+- 'step' increases the rate in four steps over the ramp period, then starts over.
+- 'sine' oscillates between nothing and the full rate over the ramp period.`,
+	)
+	fs.DurationVar(&opts.RampPeriod,
+		"ramp-period",
+		10*time.Second,
+		"The period of the ramp profile. \nDefaults to 10s")
+	fs.StringVar(&opts.Compression,
+		"compress",
+		"",
+		"Compress message bodies with 'gzip', 'zstd' or 'snappy' - most useful along with -batch. \nDefaults to no compression")
+	fs.IntVar(&opts.CompressThreshold,
+		"compress-threshold",
+		internal.DefaultCompressThreshold,
+		"The minimum size in bytes of a message body before it will be compressed. \nDefaults to 64")
+	fs.StringVar(&opts.Output,
+		"output",
+		internal.OutputText,
+		`The output format - allows 'text' or 'json'.
+- 'json' writes events and stats as newline delimited JSON to stdout, and the ASCII art to stderr or the art file.
+Defaults to text`,
+	)
+	fs.StringVar(&opts.ArtFile,
+		"art-file",
+		"",
+		"With '-output json', a file to write the ASCII art to instead of stderr")
 	fs.StringVar(&opts.Subject,
 		"subject",
 		"",
@@ -97,6 +377,8 @@ func ProducerFlags(fs *flag.FlagSet, opts *internal.ProducerOptions) {
 		"Adds artificial delay to publishing - set to 0 to disable the delay. When running stan" +
 		"\nlocally and memory back, its actually a bit too fast for good visual effect. \nDefaults to 3ms")
 
+	AuthFlags(fs, &opts.ConnectionAuth)
+
 	fs.Usage = func() {
 		fmt.Println(fmt.Sprintf("\nUsage: %s producer -file <image-file>", os.Args[0]))
 		fmt.Println("Options:")
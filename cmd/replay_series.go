@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kmfk/stan-demo/internal"
+	"os"
+	"time"
+)
+
+type ReplaySeriesFlagOptions struct {
+	internal.ReplayOptions
+
+	// The output format, and where the ASCII art goes when it isn't text
+	Output  string
+	ArtFile string
+}
+
+// Finds where a series begins in the channel and replays it, writing out the reconstructed image and verifying it.
+func ReplaySeries(opts *ReplaySeriesFlagOptions) error {
+	out, err := internal.NewOutput(opts.Output, opts.ArtFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := replaySeries(opts, out); err != nil {
+		return reportError(out, err)
+	}
+
+	return nil
+}
+
+func replaySeries(opts *ReplaySeriesFlagOptions, out *internal.Output) error {
+	r := internal.SeriesReplay{}
+	r.SetOutput(out)
+
+	if err := r.SetOptions(opts.ReplayOptions); err != nil {
+		return err
+	}
+
+	if err := r.Connect(); err != nil {
+		return err
+	}
+	defer r.End()
+
+	result, err := r.Run()
+	if err != nil {
+		return err
+	}
+
+	for _, body := range result.Bodies {
+		out.Art(body)
+	}
+
+	out.Event("replay_end", result, fmt.Sprintln(fmt.Sprintf(
+		"\n Image: %s  |  Sequences: %d-%d  |  Messages Read: %d  |  Decompress Errors: %d \n",
+		result.MessageSeriesId,
+		result.StartSequence,
+		result.EndSequence,
+		result.Read,
+		result.DecompressErrors,
+	)))
+
+	printVerification(out, result.VerificationResult)
+
+	return nil
+}
+
+func ReplaySeriesFlags(fs *flag.FlagSet, opts *ReplaySeriesFlagOptions) {
+	fs.StringVar(&opts.Cluster,
+		"cluster",
+		"",
+		`The Nats Streaming cluster name.
+Can be set from the NATS_CLUSTER environment variable`,
+	)
+	fs.StringVar(&opts.ClientId,
+		"client",
+		"",
+		"The Nats Streaming Client ID. \nDefaults to ascii-replay-<hostname>-<pid>")
+	fs.StringVar(&opts.ConnectionString,
+		"nats-url",
+		"",
+		`The NATS Connection String, or a comma separated list of servers to fail over between.
+Can be set from the NATS_CONNECTION_STRING environment variable.
+Defaults to nats://0.0.0.0:4222`,
+	)
+	fs.BoolVar(&opts.NoRandomize,
+		"no-randomize",
+		false,
+		`Connects to the servers in the order they're listed in nats-url, rather than in a random order.
+Defaults to false`,
+	)
+	fs.StringVar(&opts.Subject,
+		"subject",
+		"",
+		"The subject the series was published to. \nDefaults to ascii")
+	fs.StringVar(&opts.SeriesId,
+		"series",
+		"",
+		"The MessageSeriesId of the series to replay")
+	fs.StringVar(&opts.IndexFile,
+		"index",
+		"",
+		"An index file written by the index command, to look up where the series starts instead of scanning the subject for it")
+	fs.DurationVar(&opts.Timeout,
+		"timeout",
+		30*time.Second,
+		"How long finding the series, and then replaying it, can each take. \nDefaults to 30s")
+	fs.StringVar(&opts.Output,
+		"output",
+		internal.OutputText,
+		`The output format - allows 'text' or 'json'.
+- 'json' writes events and the verification as newline delimited JSON to stdout, and the ASCII art to stderr or the art file.
+Defaults to text`,
+	)
+	fs.StringVar(&opts.ArtFile,
+		"art-file",
+		"",
+		"With '-output json', a file to write the ASCII art to instead of stderr")
+
+	AuthFlags(fs, &opts.ConnectionAuth)
+
+	fs.Usage = func() {
+		fmt.Println(fmt.Sprintf("\nUsage: %s replay-series -series <id>", os.Args[0]))
+		fmt.Println("Options:")
+		fs.PrintDefaults()
+	}
+}
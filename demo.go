@@ -15,6 +15,12 @@ func main() {
 		fmt.Println("Supported commands are: ")
 		fmt.Println("producer - Take image files and produce ascii characters into STAN")
 		fmt.Println("consumer - Listen for messages broad casted from the producer.")
+		fmt.Println("pipeline - Transform messages through a chain of stages, each publishing to the next subject.")
+		fmt.Println("bench - Benchmark the producer and consumer over a matrix of settings.")
+		fmt.Println("failover - Stop the nodes of an embedded cluster one at a time, while producing and consuming.")
+		fmt.Println("group-status - Report how a queue group shares messages between its members.")
+		fmt.Println("replay-series - Find a single image in a channel and replay it.")
+		fmt.Println("index - Build an index of the images stored in a channel.")
 	}
 
 	if len(os.Args) == 1 {
@@ -39,8 +45,7 @@ func main() {
 		}
 
 		if err := cmd.Consumer(&opts); err != nil {
-			fmt.Println(err)
-			return
+			fail(err)
 		}
 	case "producer":
 		p := flag.NewFlagSet("producer", flag.ExitOnError)
@@ -58,11 +63,127 @@ func main() {
 		}
 
 		if err := cmd.Producer(&opts); err != nil {
+			fail(err)
+		}
+	case "pipeline":
+		p := flag.NewFlagSet("pipeline", flag.ExitOnError)
+		opts := internal.PipelineOptions{}
+		cmd.PipelineFlags(p, &opts)
+
+		if len(os.Args) == 3 && os.Args[2] == "help" {
+			p.Usage()
+			return
+		}
+
+		if err := p.Parse(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		if err := cmd.Pipeline(&opts); err != nil {
+			fail(err)
+		}
+	case "bench":
+		b := flag.NewFlagSet("bench", flag.ExitOnError)
+		opts := cmd.BenchFlagOptions{}
+		cmd.BenchFlags(b, &opts)
+
+		if len(os.Args) == 3 && os.Args[2] == "help" {
+			b.Usage()
+			return
+		}
+
+		if err := b.Parse(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		if err := cmd.Bench(&opts); err != nil {
+			fail(err)
+		}
+	case "failover":
+		f := flag.NewFlagSet("failover", flag.ExitOnError)
+		opts := cmd.FailoverFlagOptions{}
+		cmd.FailoverFlags(f, &opts)
+
+		if len(os.Args) == 3 && os.Args[2] == "help" {
+			f.Usage()
+			return
+		}
+
+		if err := f.Parse(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		if err := cmd.Failover(&opts); err != nil {
+			fail(err)
+		}
+	case "group-status":
+		g := flag.NewFlagSet("group-status", flag.ExitOnError)
+		opts := cmd.GroupStatusFlagOptions{}
+		cmd.GroupStatusFlags(g, &opts)
+
+		if len(os.Args) == 3 && os.Args[2] == "help" {
+			g.Usage()
+			return
+		}
+
+		if err := g.Parse(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		if err := cmd.GroupStatus(&opts); err != nil {
+			fail(err)
+		}
+	case "replay-series":
+		r := flag.NewFlagSet("replay-series", flag.ExitOnError)
+		opts := cmd.ReplaySeriesFlagOptions{}
+		cmd.ReplaySeriesFlags(r, &opts)
+
+		if len(os.Args) == 3 && os.Args[2] == "help" {
+			r.Usage()
+			return
+		}
+
+		if err := r.Parse(os.Args[2:]); err != nil {
 			fmt.Println(err)
 			return
 		}
+
+		if err := cmd.ReplaySeries(&opts); err != nil {
+			fail(err)
+		}
+	case "index":
+		i := flag.NewFlagSet("index", flag.ExitOnError)
+		opts := cmd.IndexFlagOptions{}
+		cmd.IndexFlags(i, &opts)
+
+		if len(os.Args) == 3 && os.Args[2] == "help" {
+			i.Usage()
+			return
+		}
+
+		if err := i.Parse(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		if err := cmd.Index(&opts); err != nil {
+			fail(err)
+		}
 	default:
 		fmt.Printf("%q is not valid command.\n", os.Args[1])
 		os.Exit(2)
 	}
 }
+
+// Prints the error a command failed with, unless it's already been written as an event, and exits non-zero
+func fail(err error) {
+	if _, ok := err.(*cmd.ReportedError); !ok {
+		fmt.Println(err)
+	}
+
+	os.Exit(1)
+}
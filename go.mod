@@ -6,8 +6,11 @@ require (
 	github.com/aws/aws-lambda-go v1.15.0
 	github.com/aybabtme/rgbterm v0.0.0-20170906152045-cc83f3b3ce59 // indirect
 	github.com/imdario/mergo v0.3.8
+	github.com/klauspost/compress v1.10.3
 	github.com/mattn/go-isatty v0.0.12 // indirect
-	github.com/nats-io/nats-streaming-server v0.17.0 // indirect
+	github.com/nats-io/nats-server/v2 v2.1.4
+	github.com/nats-io/nats-streaming-server v0.17.0
+	github.com/nats-io/nats.go v1.9.1
 	github.com/nats-io/stan.go v0.6.0
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
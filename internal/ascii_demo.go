@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/stan.go"
 	"os"
 	"time"
@@ -11,12 +12,30 @@ const (
 	DefaultClusterId          string  = "test-cluster"
 	DefaultProducerClientId   string  = "ascii-producer"
 	DefaultConsumerClientId   string  = "ascii-consumer"
+	DefaultPipelineClientId   string  = "ascii-pipeline"
+	DefaultBenchClientId      string  = "ascii-bench"
+	DefaultFailoverClientId   string  = "ascii-failover"
+	DefaultGroupClientId      string  = "ascii-group-status"
+	DefaultReplayClientId     string  = "ascii-replay"
+	DefaultIndexClientId      string  = "ascii-index"
 	DefaultSubject            string  = "ascii"
 	DefaultConnectionString   string  = "nats://0.0.0.0:4222"
 	DefaultMaxPubAcksInflight int     = 16384
 	DefaultMaxAcksInFlight    int     = 512
 	DefaultImageSizeRatio     float64 = 0.08
 	DefaultPublishDelay               = 5 * time.Millisecond
+	DefaultCompressThreshold  int     = 64
+	DefaultMaxPublishAttempts int     = 3
+	DefaultCheckpointFile     string  = ".stan-demo-checkpoint.json"
+	DefaultCheckpointInterval         = time.Second
+	DefaultIndexFile          string  = ".stan-demo-index.json"
+	DefaultForwardDedupWindow int     = 100000
+	DefaultDeliveryWindow     int     = 100000
+	DefaultMergedSeriesWindow int     = 1000
+	DefaultReconnectWait              = time.Second
+	DefaultReconnectMaxWait           = 30 * time.Second
+	DefaultSeriesScanTimeout          = 10 * time.Second
+	DefaultSeriesExpiry               = time.Minute
 )
 
 type Message struct {
@@ -24,6 +43,20 @@ type Message struct {
 	MessageId       int    `json:"id"`
 	Body            string `json:"body"`
 	End             bool   `json:"end,omitempty"`
+
+	// CRC32 of the Body, and the digest of the whole series which is only set on the End message
+	Checksum uint32 `json:"crc,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+
+	// When the producer published the message, in unix nanoseconds
+	Timestamp int64 `json:"ts,omitempty"`
+
+	// The subject consumers should send a processing Receipt to, once the series has been processed
+	Reply string `json:"reply,omitempty"`
+
+	// Compression used for the Payload, when the Body has been compressed
+	Compression string `json:"compression,omitempty"`
+	Payload     []byte `json:"payload,omitempty"`
 }
 
 type ConnectionInfo struct {
@@ -31,6 +64,27 @@ type ConnectionInfo struct {
 	ClientId         string
 	ConnectionString string
 	Subject          string
+	PubAckWait       time.Duration
+
+	// How many published messages can be waiting on an ack before publishing blocks
+	MaxPubAcksInflight int
+
+	// The ConnectionString can list several comma separated servers, which are tried in a random order unless set
+	NoRandomize bool
+
+	// How many times to retry connecting with a numbered suffix on the ClientId, while it's already in use
+	ClientIdRetries int
+
+	// How often to ping the server, in seconds, and how many pings can go unanswered before the connection is lost
+	PingInterval int
+	PingMaxOut   int
+
+	// How long to wait between attempts to reconnect once the connection is lost, and how many attempts to make
+	ReconnectWait    time.Duration
+	ReconnectMaxWait time.Duration
+	MaxReconnects    int
+
+	ConnectionAuth
 }
 
 func (nc *NatsClient) SetConnection(ci ConnectionInfo) {
@@ -53,30 +107,131 @@ func (nc *NatsClient) SetConnection(ci ConnectionInfo) {
 		}
 	}
 
+	ci.ConnectionAuth = ci.ConnectionAuth.withEnv()
+
+	if ci.ReconnectWait <= 0 {
+		ci.ReconnectWait = DefaultReconnectWait
+	}
+
+	if ci.ReconnectMaxWait <= 0 {
+		ci.ReconnectMaxWait = DefaultReconnectMaxWait
+	}
+
 	nc.conn = ci
 }
 
 type NatsClient struct {
 	DrainableStan
-	conn ConnectionInfo
+	conn   ConnectionInfo
+	output *Output
+
+	// The connection, which is replaced on reconnecting, and what to do once reconnected
+	rc          *reconnectableConn
+	reconnected []func() error
+}
+
+// Sets where events are written to
+func (nc *NatsClient) SetOutput(o *Output) {
+	nc.output = o
+}
+
+// Returns where events are written to
+func (nc *NatsClient) Output() *Output {
+	if nc.output == nil {
+		return defaultOutput
+	}
+
+	return nc.output
 }
 
 // Connect to NATS Streaming
 func (nc *NatsClient) Connect() error {
-	fmt.Println("\n\nCONNECTION DETAILS")
-	fmt.Println(
+	nc.Output().Event("connecting", map[string]string{
+		"cluster":   nc.conn.Cluster,
+		"client_id": nc.conn.ClientId,
+		"nats_url":  nc.conn.ConnectionString,
+		"subject":   nc.conn.Subject,
+	}, fmt.Sprintln("\n\nCONNECTION DETAILS")+fmt.Sprintln(
 		"\nCluster ID:\t\t", nc.conn.Cluster,
 		"\nClient ID:\t\t", nc.conn.ClientId,
 		"\nNATS Server Url:\t", nc.conn.ConnectionString,
 		"\nChannel:\t\t", nc.conn.Subject,
-	)
+	))
 
-	client, err := stan.Connect(nc.conn.Cluster, nc.conn.ClientId, stan.NatsURL(nc.conn.ConnectionString))
-	if err != nil {
+	client, err := nc.dial()
+
+	base := nc.conn.ClientId
+	for retry := 1; isClientIdInUse(err) && retry <= nc.conn.ClientIdRetries; retry++ {
+		id := fmt.Sprintf("%s-%d", base, retry+1)
+		nc.Output().Event("client_id_in_use", map[string]string{"client_id": nc.conn.ClientId, "retry_as": id},
+			fmt.Sprintf("Client ID %s is already in use, retrying as %s \n", nc.conn.ClientId, id))
+
+		nc.conn.ClientId = id
+		client, err = nc.dial()
+	}
+
+	if isClientIdInUse(err) {
+		return &ClientIdInUseError{ClientId: nc.conn.ClientId, Cluster: nc.conn.Cluster}
+	} else if err != nil {
 		return fmt.Errorf("\nerror connecting to NATS Server: %v", err)
 	}
 
-	nc.Conn = client
+	nc.rc = &reconnectableConn{conn: client}
+	nc.Conn = nc.rc
+	nc.Output().Event("connected", map[string]string{"client_id": nc.conn.ClientId}, "")
 
 	return nil
 }
+
+// Connects to NATS Streaming with the connection options
+func (nc *NatsClient) dial() (stan.Conn, error) {
+	natsOptions, err := nc.conn.natsOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	// The NATS connection is made separately, so that TLS and authentication can be passed through to it
+	natsOptions = append(natsOptions, nats.Name(nc.conn.ClientId))
+	if nc.conn.NoRandomize {
+		natsOptions = append(natsOptions, nats.DontRandomize())
+	}
+
+	natsConn, err := nats.Connect(nc.conn.ConnectionString, natsOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []stan.Option{
+		stan.NatsConn(natsConn),
+		stan.SetConnectionLostHandler(nc.connectionLost),
+	}
+
+	if nc.conn.PubAckWait > 0 {
+		options = append(options, stan.PubAckWait(nc.conn.PubAckWait))
+	}
+
+	if nc.conn.MaxPubAcksInflight > 0 {
+		options = append(options, stan.MaxPubAcksInflight(nc.conn.MaxPubAcksInflight))
+	}
+
+	if nc.conn.PingInterval > 0 || nc.conn.PingMaxOut > 0 {
+		interval, maxOut := nc.conn.PingInterval, nc.conn.PingMaxOut
+		if interval <= 0 {
+			interval = stan.DefaultPingInterval
+		}
+
+		if maxOut <= 0 {
+			maxOut = stan.DefaultPingMaxOut
+		}
+
+		options = append(options, stan.Pings(interval, maxOut))
+	}
+
+	client, err := stan.Connect(nc.conn.Cluster, nc.conn.ClientId, options...)
+	if err != nil {
+		natsConn.Close()
+		return nil, err
+	}
+
+	return &ownedConn{Conn: client, nc: natsConn}, nil
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"os"
+	"strconv"
+)
+
+// TLS and authentication for the NATS connection - each can also be set from the environment
+type ConnectionAuth struct {
+	// User and password, or a token
+	User     string `json:"user,omitempty"`
+	Password string `json:"-"`
+	Token    string `json:"-"`
+
+	// A file holding an NKey seed, or a .creds file holding a user JWT and NKey seed
+	NKeyFile  string `json:"nkey_file,omitempty"`
+	CredsFile string `json:"creds_file,omitempty"`
+
+	// A client certificate and key, and the CA to verify the server with - or whether to skip verifying it, which is
+	// only taken from the environment when not set
+	TLSCert     string `json:"tls_cert,omitempty"`
+	TLSKey      string `json:"tls_key,omitempty"`
+	TLSCACert   string `json:"tls_ca_cert,omitempty"`
+	TLSInsecure *bool  `json:"tls_insecure,omitempty"`
+}
+
+// Fills in anything that isn't set from the environment
+func (a ConnectionAuth) withEnv() ConnectionAuth {
+	env := func(value *string, name string) {
+		if *value == "" {
+			*value = os.Getenv(name)
+		}
+	}
+
+	env(&a.User, "NATS_USER")
+	env(&a.Password, "NATS_PASSWORD")
+	env(&a.Token, "NATS_TOKEN")
+	env(&a.NKeyFile, "NATS_NKEY")
+	env(&a.CredsFile, "NATS_CREDS")
+	env(&a.TLSCert, "NATS_TLS_CERT")
+	env(&a.TLSKey, "NATS_TLS_KEY")
+	env(&a.TLSCACert, "NATS_TLS_CA")
+
+	if a.TLSInsecure == nil {
+		if insecure, err := strconv.ParseBool(os.Getenv("NATS_TLS_INSECURE")); err == nil {
+			a.TLSInsecure = &insecure
+		}
+	}
+
+	return a
+}
+
+// Returns the options for the NATS connection
+func (a ConnectionAuth) natsOptions() ([]nats.Option, error) {
+	var options []nats.Option
+
+	methods := 0
+	for _, set := range []bool{a.User != "", a.Token != "", a.NKeyFile != "", a.CredsFile != ""} {
+		if set {
+			methods++
+		}
+	}
+
+	if methods > 1 {
+		return nil, errors.New("only one of user, token, nkey or creds authentication can be used")
+	}
+
+	switch {
+	case a.User != "":
+		options = append(options, nats.UserInfo(a.User, a.Password))
+	case a.Password != "":
+		return nil, errors.New("a password requires a user")
+	case a.Token != "":
+		options = append(options, nats.Token(a.Token))
+	case a.NKeyFile != "":
+		option, err := nats.NkeyOptionFromSeed(a.NKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, option)
+	case a.CredsFile != "":
+		options = append(options, nats.UserCredentials(a.CredsFile))
+	}
+
+	if (a.TLSCert == "") != (a.TLSKey == "") {
+		return nil, errors.New("a TLS client certificate and key must be given together")
+	}
+
+	// Secure must come first, as the CA and client certificate are added to its TLS config
+	if a.TLSInsecure != nil && *a.TLSInsecure {
+		options = append(options, nats.Secure(&tls.Config{InsecureSkipVerify: true}))
+	}
+
+	if a.TLSCACert != "" {
+		options = append(options, nats.RootCAs(a.TLSCACert))
+	}
+
+	if a.TLSCert != "" {
+		options = append(options, nats.ClientCert(a.TLSCert, a.TLSKey))
+	}
+
+	return options, nil
+}
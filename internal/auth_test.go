@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Runs NATS Streaming over a NATS server which requires a user and password
+func startAuthServer(t *testing.T, user string, password string) (*server.Server, *stand.StanServer) {
+	ns, err := server.NewServer(&server.Options{
+		Host:     "127.0.0.1",
+		Port:     -1,
+		NoLog:    true,
+		NoSigs:   true,
+		Username: user,
+		Password: password,
+	})
+	assert.NoError(t, err)
+
+	go ns.Start()
+	assert.True(t, ns.ReadyForConnections(10*time.Second))
+
+	opts := stand.GetDefaultOptions()
+	opts.NATSServerURL = ns.ClientURL()
+
+	// The streaming server takes the credentials for its own connections from the NATS server options
+	ss, err := stand.RunServerWithOpts(opts, &server.Options{Username: user, Password: password})
+	assert.NoError(t, err)
+
+	return ns, ss
+}
+
+// Generates a certificate and key for 127.0.0.1, signed by the parent - or self-signed as a CA without one - writing
+// them to <name>.pem and <name>-key.pem in the directory
+func generateTestCert(t *testing.T, dir string, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPem, 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPem, 0600))
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return cert, key
+}
+
+// Runs NATS Streaming over a NATS server which requires TLS, with a client certificate signed by the CA - generating
+// the CA, server and client certificates into the directory
+func startTLSServer(t *testing.T, dir string) (*server.Server, *stand.StanServer) {
+	ca, caKey := generateTestCert(t, dir, "ca", nil, nil)
+	generateTestCert(t, dir, "server", ca, caKey)
+	generateTestCert(t, dir, "client", ca, caKey)
+
+	tlsConfig, err := server.GenTLSConfig(&server.TLSConfigOpts{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CaFile:   filepath.Join(dir, "ca.pem"),
+		Verify:   true,
+	})
+	assert.NoError(t, err)
+
+	ns, err := server.NewServer(&server.Options{
+		Host:       "127.0.0.1",
+		Port:       -1,
+		NoLog:      true,
+		NoSigs:     true,
+		TLS:        true,
+		TLSVerify:  true,
+		TLSConfig:  tlsConfig,
+		TLSTimeout: 2,
+	})
+	assert.NoError(t, err)
+
+	go ns.Start()
+	assert.True(t, ns.ReadyForConnections(10*time.Second))
+
+	opts := stand.GetDefaultOptions()
+	opts.NATSServerURL = ns.ClientURL()
+	opts.ClientCA = filepath.Join(dir, "ca.pem")
+	opts.ClientCert = filepath.Join(dir, "client.pem")
+	opts.ClientKey = filepath.Join(dir, "client-key.pem")
+
+	ss, err := stand.RunServerWithOpts(opts, nil)
+	assert.NoError(t, err)
+
+	return ns, ss
+}
+
+// Connects and then closes a Consumer, with the given authentication
+func connectWithAuth(url string, auth ConnectionAuth) error {
+	c := &Consumer{}
+	c.SetOutput(discardOutput)
+
+	if err := c.SetOptions(ConsumerOptions{ConnectionString: url, ConnectionAuth: auth}); err != nil {
+		return err
+	}
+
+	if err := c.Connect(); err != nil {
+		return err
+	}
+
+	return c.Close()
+}
+
+// Test that a server requiring a user and password only accepts the right ones
+func TestConnectionAuth_UserAndPassword(t *testing.T) {
+	ns, ss := startAuthServer(t, "demo", "s3cret")
+	defer ns.Shutdown()
+	defer ss.Shutdown()
+
+	connect := func(auth ConnectionAuth) error {
+		return connectWithAuth(ns.ClientURL(), auth)
+	}
+
+	assert.NoError(t, connect(ConnectionAuth{User: "demo", Password: "s3cret"}))
+	assert.Error(t, connect(ConnectionAuth{User: "demo", Password: "wrong"}))
+	assert.Error(t, connect(ConnectionAuth{}))
+}
+
+// Test that a server requiring TLS is connected to with the CA and client certificate, or by skipping verification of
+// the server
+func TestConnectionAuth_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns, ss := startTLSServer(t, dir)
+	defer ns.Shutdown()
+	defer ss.Shutdown()
+
+	insecure := true
+	ca := filepath.Join(dir, "ca.pem")
+	cert := filepath.Join(dir, "client.pem")
+	key := filepath.Join(dir, "client-key.pem")
+
+	connect := func(auth ConnectionAuth) error {
+		return connectWithAuth(ns.ClientURL(), auth)
+	}
+
+	assert.NoError(t, connect(ConnectionAuth{TLSCACert: ca, TLSCert: cert, TLSKey: key}))
+	assert.NoError(t, connect(ConnectionAuth{TLSInsecure: &insecure, TLSCert: cert, TLSKey: key}))
+	assert.Error(t, connect(ConnectionAuth{TLSCert: cert, TLSKey: key}), "the server isn't trusted without the CA")
+	assert.Error(t, connect(ConnectionAuth{TLSCACert: ca}), "the server requires a client certificate")
+}
+
+// Test that conflicting or incomplete authentication is rejected
+func TestConnectionAuth_NatsOptions(t *testing.T) {
+	_, err := ConnectionAuth{User: "demo", Token: "abc"}.natsOptions()
+	assert.Error(t, err, "only one method of authentication")
+
+	_, err = ConnectionAuth{Password: "s3cret"}.natsOptions()
+	assert.Error(t, err, "a password needs a user")
+
+	_, err = ConnectionAuth{TLSCert: "client.pem"}.natsOptions()
+	assert.Error(t, err, "a certificate needs a key")
+
+	_, err = ConnectionAuth{NKeyFile: "missing.nk"}.natsOptions()
+	assert.Error(t, err, "the nkey seed file must exist")
+
+	insecure := true
+	options, err := ConnectionAuth{Token: "abc", TLSInsecure: &insecure, TLSCACert: "ca.pem"}.natsOptions()
+	assert.NoError(t, err)
+	assert.Len(t, options, 3)
+}
+
+// Test that anything not given is taken from the environment - including -tls-insecure=false overriding it
+func TestConnectionAuth_WithEnv(t *testing.T) {
+	os.Setenv("NATS_TOKEN", "from-env")
+	os.Setenv("NATS_TLS_INSECURE", "true")
+	defer os.Unsetenv("NATS_TOKEN")
+	defer os.Unsetenv("NATS_TLS_INSECURE")
+
+	auth := ConnectionAuth{User: "flag"}.withEnv()
+	assert.Equal(t, "flag", auth.User)
+	assert.Equal(t, "from-env", auth.Token)
+	assert.True(t, *auth.TLSInsecure)
+
+	auth = ConnectionAuth{Token: "flag"}.withEnv()
+	assert.Equal(t, "flag", auth.Token)
+
+	secure := false
+	auth = ConnectionAuth{TLSInsecure: &secure}.withEnv()
+	assert.False(t, *auth.TLSInsecure)
+}
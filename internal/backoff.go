@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Exponential backoff with jitter - each attempt doubles the delay, up to Max, and the actual delay is randomly chosen
+// between half and all of that so that retries from many messages don't all land at once.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Returns how long to wait after the given attempt (starting from 1) has failed
+func (b Backoff) Duration(attempt int) time.Duration {
+	d := b.ceiling(attempt)
+	if d <= 1 {
+		return d
+	}
+
+	half := d / 2
+
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// The delay for the given attempt, before jitter is applied
+func (b Backoff) ceiling(attempt int) time.Duration {
+	d := b.Initial
+	for i := 1; i < attempt; i++ {
+		d *= 2
+
+		if b.Max > 0 && d >= b.Max {
+			return b.Max
+		}
+	}
+
+	if b.Max > 0 && d > b.Max {
+		return b.Max
+	}
+
+	return d
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that the delay doubles with each attempt until it reaches the max
+func TestBackoff_Ceiling(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second}
+
+	assert.Equal(t, 100*time.Millisecond, b.ceiling(1))
+	assert.Equal(t, 200*time.Millisecond, b.ceiling(2))
+	assert.Equal(t, 800*time.Millisecond, b.ceiling(4))
+	assert.Equal(t, time.Second, b.ceiling(5))
+	assert.Equal(t, time.Second, b.ceiling(50))
+}
+
+// Test that the jittered delay stays between half and all of the ceiling
+func TestBackoff_Duration(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second}
+
+	for i := 0; i < 100; i++ {
+		d := b.Duration(3)
+
+		assert.True(t, d >= 200*time.Millisecond, "%s should be at least half the ceiling", d)
+		assert.True(t, d <= 400*time.Millisecond, "%s should be no more than the ceiling", d)
+	}
+}
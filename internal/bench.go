@@ -0,0 +1,485 @@
+package internal
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/imdario/mergo"
+	"github.com/nu7hatch/gouuid"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BenchFormatCSV      string = "csv"
+	BenchFormatMarkdown string = "markdown"
+)
+
+type BenchOptions struct {
+	// Connection Info
+	Cluster          string
+	ClientId         string
+	ConnectionString string
+	NoRandomize      bool
+	ConnectionAuth
+
+	// The prefix for the subject of each cell, which each publish to a subject of their own
+	Subject string
+
+	// Runs an in-memory NATS Streaming server in process, rather than connecting to one
+	Embedded bool
+
+	// How many characters are published for each cell, and how long to wait for them all to be received
+	Messages int
+	Timeout  time.Duration
+
+	// The parameters to sweep - every combination of these is run as a cell
+	BatchSizes       []int
+	Sync             []bool
+	MaxInFlightAcks  []int
+	ConsumerInFlight []int
+	AckWaits         []int
+	MessageSizes     []int
+}
+
+// A single combination of the parameters being benchmarked
+type BenchCell struct {
+	// Characters sent in each message
+	BatchSize int
+	// Whether messages are published synchronously
+	Sync bool
+	// Max Acks In Flight for the producer
+	MaxInFlightAcks int
+	// Max messages in flight for the consumer
+	ConsumerInFlight int
+	// The consumer AckWait in seconds
+	AckWait int
+	// The size in bytes of each character, so each message body is BatchSize * MessageSize bytes
+	MessageSize int
+}
+
+// Percentiles of the time from publishing a message to it being received
+type LatencyPercentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// The results of running a single cell
+type BenchResult struct {
+	BenchCell
+
+	// How many messages should have been received
+	Messages int
+	// Published and acknowledged by the producer
+	Sent  int
+	Acked int
+	// Unique messages received by the consumer, and their total body size
+	Received int
+	Bytes    int
+	// Messages STAN redelivered to the consumer
+	Redelivered int
+	// From the first publish to the last message received
+	Duration time.Duration
+	Latency  LatencyPercentiles
+	// Why the cell didn't complete, if it didn't
+	Error string
+}
+
+// Messages received per second
+func (r BenchResult) GetMessagesPerSecond() float64 {
+	if r.Duration <= 0 {
+		return 0.0
+	}
+
+	return float64(r.Received) / r.Duration.Seconds()
+}
+
+// Message body bytes received per second
+func (r BenchResult) GetBytesPerSecond() float64 {
+	if r.Duration <= 0 {
+		return 0.0
+	}
+
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// Runs a producer and consumer together over a matrix of parameters, measuring each combination
+type Bench struct {
+	options BenchOptions
+	server  *EmbeddedServer
+	run     string
+}
+
+// Set the options for the Bench
+func (b *Bench) SetOptions(opts BenchOptions) error {
+
+	// Set Default Values
+	d := BenchOptions{
+		ClientId:         DefaultBenchClientId,
+		Subject:          DefaultSubject + ".bench",
+		Messages:         1000,
+		Timeout:          60 * time.Second,
+		BatchSizes:       []int{1},
+		Sync:             []bool{false},
+		MaxInFlightAcks:  []int{DefaultMaxPubAcksInflight},
+		ConsumerInFlight: []int{DefaultMaxAcksInFlight},
+		AckWaits:         []int{10},
+		MessageSizes:     []int{1},
+	}
+
+	if err := mergo.Merge(&d, opts, mergo.WithOverride); err != nil {
+		return err
+	}
+
+	if d.Messages < 1 {
+		return errors.New("at least one message must be published for each cell")
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Errorf("failed to generate id: %v", err)
+	}
+
+	b.options = d
+	b.run = id.String()
+
+	return nil
+}
+
+// Returns the currently set options
+func (b *Bench) GetOptions() BenchOptions {
+	return b.options
+}
+
+// Every combination of the parameters, in the order they'll be run
+func (b *Bench) Cells() []BenchCell {
+	var cells []BenchCell
+
+	for _, batch := range b.options.BatchSizes {
+		for _, sync := range b.options.Sync {
+			for _, acks := range b.options.MaxInFlightAcks {
+				for _, inflight := range b.options.ConsumerInFlight {
+					for _, ackWait := range b.options.AckWaits {
+						for _, size := range b.options.MessageSizes {
+							cells = append(cells, BenchCell{
+								BatchSize:        batch,
+								Sync:             sync,
+								MaxInFlightAcks:  acks,
+								ConsumerInFlight: inflight,
+								AckWait:          ackWait,
+								MessageSize:      size,
+							})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return cells
+}
+
+// Starts the embedded server, if the Bench is to run against one
+func (b *Bench) Start() error {
+	if !b.options.Embedded {
+		return nil
+	}
+
+	server, err := StartEmbeddedServer(b.options.Cluster)
+	if err != nil {
+		return err
+	}
+
+	b.server = server
+	b.options.Cluster = server.ClusterId()
+	b.options.ConnectionString = server.URL()
+
+	return nil
+}
+
+// Stops the embedded server, if there is one
+func (b *Bench) End() {
+	if b.server != nil {
+		b.server.Shutdown()
+	}
+}
+
+// Runs the cell - publishing to a subject of its own, and measuring until every message has been received or the
+// Timeout is reached. Failures are recorded on the result, so the rest of the cells can still be run.
+func (b *Bench) Run(i int, cell BenchCell) BenchResult {
+	subject := fmt.Sprintf("%s.%s.%d", b.options.Subject, b.run, i)
+	messages := benchMessages(b.options.Messages, cell.MessageSize, cell.BatchSize)
+	result := BenchResult{BenchCell: cell, Messages: len(messages)}
+
+	c := &Consumer{}
+	c.SetOutput(discardOutput)
+
+	err := c.SetOptions(ConsumerOptions{
+		Cluster:          b.options.Cluster,
+		ClientId:         b.options.ClientId + "-consumer",
+		ConnectionString: b.options.ConnectionString,
+		NoRandomize:      b.options.NoRandomize,
+		ConnectionAuth:   b.options.ConnectionAuth,
+		Subject:          subject,
+		MaxInFlight:      cell.ConsumerInFlight,
+		AckWait:          cell.AckWait,
+		StartingOffset:   "all",
+	})
+
+	if err == nil {
+		err = c.Connect()
+	}
+
+	if err == nil {
+		err = c.CreateSubscription()
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+		_ = c.End()
+		return result
+	}
+
+	p := &Producer{}
+	p.SetOutput(discardOutput)
+
+	err = p.configure(ProducerOptions{
+		Cluster:          b.options.Cluster,
+		ClientId:         b.options.ClientId + "-producer",
+		ConnectionString: b.options.ConnectionString,
+		NoRandomize:      b.options.NoRandomize,
+		ConnectionAuth:   b.options.ConnectionAuth,
+		Subject:          subject,
+		BatchSize:        cell.BatchSize,
+		Sync:             cell.Sync,
+		MaxInFlightAcks:  cell.MaxInFlightAcks,
+	})
+
+	if err == nil {
+		err = p.Connect()
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+		_ = c.End()
+		return result
+	}
+
+	ch := c.Consume()
+	start := time.Now()
+
+	published := make(chan error, 1)
+	go func() {
+		if err := p.Publish(messages); err != nil {
+			published <- err
+			_ = p.Close()
+			return
+		}
+
+		published <- p.DrainAndClose()
+	}()
+
+	seen := make(map[int]bool, len(messages))
+	latencies := make([]time.Duration, 0, len(messages))
+	timeout := time.After(b.options.Timeout)
+	last := start
+
+receive:
+	for len(seen) < len(messages) {
+		select {
+		case msg := <-ch:
+			now := time.Now()
+			if seen[msg.MessageId] {
+				continue
+			}
+
+			seen[msg.MessageId] = true
+			latencies = append(latencies, now.Sub(time.Unix(0, msg.Timestamp)))
+			result.Bytes += len(msg.Body)
+			last = now
+		case err := <-published:
+			if err != nil {
+				result.Error = err.Error()
+				break receive
+			}
+
+			// Publishing finished, keep receiving
+			published = nil
+		case <-timeout:
+			result.Error = fmt.Sprintf("timed out after %s", b.options.Timeout)
+			break receive
+		}
+	}
+
+	// Keep the subscription from blocking on messages that are no longer being received
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if published != nil {
+		if err := <-published; err != nil && result.Error == "" {
+			result.Error = err.Error()
+		}
+	}
+
+	stats := c.GetSubscriptionStats()
+	if err := c.End(); err != nil && result.Error == "" {
+		result.Error = err.Error()
+	}
+
+	pstats := p.GetPublishStats()
+
+	result.Sent = pstats.MessagesSent
+	result.Acked = pstats.AcksReceived
+	result.Received = len(seen)
+	result.Redelivered = stats.Redelivered
+	result.Duration = last.Sub(start)
+	result.Latency = latencyPercentiles(latencies)
+
+	return result
+}
+
+// Generates `count` characters of `size` bytes, batched into messages of `batch` characters
+func benchMessages(count int, size int, batch int) []string {
+	if size < 1 {
+		size = 1
+	}
+
+	characters := make([]string, count)
+	for i := range characters {
+		characters[i] = strings.Repeat("#", size)
+	}
+
+	if batch > 1 {
+		return batchCharacters(characters, batch)
+	}
+
+	return characters
+}
+
+// Calculates the percentiles of the latencies, using the nearest rank
+func latencyPercentiles(latencies []time.Duration) LatencyPercentiles {
+	if len(latencies) == 0 {
+		return LatencyPercentiles{}
+	}
+
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(sorted))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+
+		return sorted[i]
+	}
+
+	return LatencyPercentiles{
+		P50: rank(0.50),
+		P90: rank(0.90),
+		P99: rank(0.99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+var benchColumns = []string{
+	"batch", "sync", "inflight_acks", "consumer_inflight", "ackwait", "size",
+	"messages", "sent", "acked", "received", "redelivered", "duration_ms",
+	"msgs_per_sec", "bytes_per_sec", "p50_ms", "p90_ms", "p99_ms", "max_ms", "error",
+}
+
+// The result as a row of values, in the order of benchColumns
+func (r BenchResult) row() []string {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	}
+
+	return []string{
+		strconv.Itoa(r.BatchSize),
+		strconv.FormatBool(r.Sync),
+		strconv.Itoa(r.MaxInFlightAcks),
+		strconv.Itoa(r.ConsumerInFlight),
+		strconv.Itoa(r.AckWait),
+		strconv.Itoa(r.MessageSize),
+		strconv.Itoa(r.Messages),
+		strconv.Itoa(r.Sent),
+		strconv.Itoa(r.Acked),
+		strconv.Itoa(r.Received),
+		strconv.Itoa(r.Redelivered),
+		ms(r.Duration),
+		strconv.FormatFloat(r.GetMessagesPerSecond(), 'f', 1, 64),
+		strconv.FormatFloat(r.GetBytesPerSecond(), 'f', 1, 64),
+		ms(r.Latency.P50),
+		ms(r.Latency.P90),
+		ms(r.Latency.P99),
+		ms(r.Latency.Max),
+		r.Error,
+	}
+}
+
+// Validates that the results can be written in the given format
+func ValidateBenchFormat(format string) error {
+	switch format {
+	case BenchFormatCSV, BenchFormatMarkdown:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported format %q - allows 'csv' or 'markdown'", format)
+}
+
+// Writes the results as CSV or a markdown table
+func WriteBenchResults(w io.Writer, format string, results []BenchResult) error {
+	switch format {
+	case BenchFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(benchColumns); err != nil {
+			return err
+		}
+
+		for _, r := range results {
+			if err := cw.Write(r.row()); err != nil {
+				return err
+			}
+		}
+
+		cw.Flush()
+
+		return cw.Error()
+	case BenchFormatMarkdown:
+		lines := []string{
+			"| " + strings.Join(benchColumns, " | ") + " |",
+			"|" + strings.Repeat(" --- |", len(benchColumns)),
+		}
+
+		for _, r := range results {
+			row := r.row()
+			for i, v := range row {
+				row[i] = strings.Replace(v, "|", "\\|", -1)
+			}
+
+			lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		}
+
+		_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+
+		return err
+	}
+
+	return ValidateBenchFormat(format)
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that the cells cover every combination of the swept settings, with the batch size varying slowest
+func TestBench_Cells(t *testing.T) {
+	b := Bench{}
+	assert.NoError(t, b.SetOptions(BenchOptions{
+		BatchSizes: []int{1, 10, 100},
+		Sync:       []bool{false, true},
+		AckWaits:   []int{1, 30},
+	}))
+
+	cells := b.Cells()
+	assert.Len(t, cells, 12)
+	assert.Equal(t, BenchCell{
+		BatchSize:        1,
+		Sync:             false,
+		MaxInFlightAcks:  DefaultMaxPubAcksInflight,
+		ConsumerInFlight: DefaultMaxAcksInFlight,
+		AckWait:          1,
+		MessageSize:      1,
+	}, cells[0])
+	assert.Equal(t, 100, cells[11].BatchSize)
+	assert.True(t, cells[11].Sync)
+	assert.Equal(t, 30, cells[11].AckWait)
+}
+
+// Test that the characters are batched into messages, with the last message holding what's left
+func TestBenchMessages(t *testing.T) {
+	messages := benchMessages(25, 4, 10)
+
+	assert.Len(t, messages, 3)
+	assert.Len(t, messages[0], 40)
+	assert.Len(t, messages[2], 20)
+}
+
+// Test that the percentiles are taken from the sorted latencies, and are all 0 without any
+func TestLatencyPercentiles(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	p := latencyPercentiles(latencies)
+	assert.Equal(t, 50*time.Millisecond, p.P50)
+	assert.Equal(t, 90*time.Millisecond, p.P90)
+	assert.Equal(t, 99*time.Millisecond, p.P99)
+	assert.Equal(t, 100*time.Millisecond, p.Max)
+
+	assert.Equal(t, LatencyPercentiles{}, latencyPercentiles(nil))
+}
+
+// Test that the results are written as CSV or a markdown table, and other formats are refused
+func TestWriteBenchResults(t *testing.T) {
+	results := []BenchResult{{
+		BenchCell: BenchCell{BatchSize: 10, MessageSize: 1},
+		Messages:  100,
+		Received:  100,
+		Bytes:     1000,
+		Duration:  time.Second,
+	}}
+
+	var csv bytes.Buffer
+	assert.NoError(t, WriteBenchResults(&csv, BenchFormatCSV, results))
+
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "batch,sync,"))
+	assert.Contains(t, lines[1], ",100.0,1000.0,")
+
+	var md bytes.Buffer
+	assert.NoError(t, WriteBenchResults(&md, BenchFormatMarkdown, results))
+
+	lines = strings.Split(strings.TrimSpace(md.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[1], "| --- |"))
+
+	assert.Error(t, WriteBenchResults(&md, "xml", results))
+}
+
+// Test that a cell is run against the embedded server, with every message sent, acknowledged and received
+func TestBench_Run(t *testing.T) {
+	b := Bench{}
+	assert.NoError(t, b.SetOptions(BenchOptions{Embedded: true, Messages: 100, Timeout: 10 * time.Second}))
+	assert.NoError(t, b.Start())
+	defer b.End()
+
+	r := b.Run(0, b.Cells()[0])
+
+	assert.Empty(t, r.Error)
+	assert.Equal(t, 100, r.Sent)
+	assert.Equal(t, 100, r.Acked)
+	assert.Equal(t, 100, r.Received)
+	assert.True(t, r.Latency.Max > 0)
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// The faults a ChaosPolicy can decide on - each is decided independently of the others
+const (
+	chaosDrop uint64 = iota + 1
+	chaosAckFail
+	chaosLatency
+	chaosLatencyJitter
+)
+
+// Decides which messages to artificially drop or fail to acknowledge, and how long processing them takes.
+//
+// Decisions are derived from the Seed, the message and which delivery attempt it is - rather than from a shared random
+// source - so the same seed always makes the same decisions, regardless of how deliveries are interleaved. A message is
+// identified by its subject as well as its sequence, since STAN numbers each subject independently.
+type ChaosPolicy struct {
+	Seed           int64
+	DropPercent    float64
+	AckFailPercent float64
+
+	// Delivery attempts of each message, until it is acknowledged
+	m        sync.Mutex
+	attempts map[string]int
+}
+
+// Creates a ChaosPolicy with the given seed - any seed, including 0, makes the same decisions every time
+func NewChaosPolicy(seed int64, dropPercent float64, ackFailPercent float64) *ChaosPolicy {
+	return &ChaosPolicy{
+		Seed:           seed,
+		DropPercent:    dropPercent,
+		AckFailPercent: ackFailPercent,
+		attempts:       map[string]int{},
+	}
+}
+
+// Records a delivery of the message, returning which attempt it is - starting at 1
+func (c *ChaosPolicy) Deliver(subject string, sequence uint64) int {
+	defer c.m.Unlock()
+
+	c.m.Lock()
+	key := fmt.Sprintf("%s:%d", subject, sequence)
+	c.attempts[key]++
+
+	return c.attempts[key]
+}
+
+// Which delivery attempt of the message was the latest
+func (c *ChaosPolicy) Attempts(subject string, sequence uint64) int {
+	defer c.m.Unlock()
+
+	c.m.Lock()
+	return c.attempts[fmt.Sprintf("%s:%d", subject, sequence)]
+}
+
+// Forgets the attempts of a message once it has been acknowledged, as it won't be delivered again
+func (c *ChaosPolicy) Done(subject string, sequence uint64) {
+	defer c.m.Unlock()
+
+	c.m.Lock()
+	delete(c.attempts, fmt.Sprintf("%s:%d", subject, sequence))
+}
+
+// Whether this delivery attempt of the message should be dropped
+func (c *ChaosPolicy) Drop(subject string, sequence uint64, attempt int) bool {
+	return c.DropPercent > 0 && c.roll(chaosDrop, subject, sequence, attempt) < c.DropPercent
+}
+
+// Whether the acknowledgement of this delivery attempt of the message should fail
+func (c *ChaosPolicy) FailAck(subject string, sequence uint64, attempt int) bool {
+	return c.AckFailPercent > 0 && c.roll(chaosAckFail, subject, sequence, attempt) < c.AckFailPercent
+}
+
+// How long processing this delivery attempt of the message takes, from the distribution
+func (c *ChaosPolicy) Latency(l LatencyDistribution, subject string, sequence uint64, attempt int) time.Duration {
+	return l.Sample(c.roll(chaosLatency, subject, sequence, attempt), c.roll(chaosLatencyJitter, subject, sequence,
+		attempt))
+}
+
+// A number in [0, 1) derived from the seed, the fault being decided, the subject, the sequence and the attempt
+func (c *ChaosPolicy) roll(fault uint64, subject string, sequence uint64, attempt int) float64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(subject))
+
+	x := uint64(c.Seed)
+	for _, v := range []uint64{fault, h.Sum64(), sequence, uint64(attempt)} {
+		x = splitmix64(x ^ v)
+	}
+
+	return float64(x>>11) / float64(1<<53)
+}
+
+// The SplitMix64 mixing function - small differences in the input give unrelated outputs
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+
+	return x ^ (x >> 31)
+}
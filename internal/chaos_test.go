@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Every drop and ack failure decision for the first deliveries of the first messages on the subject
+func chaosDecisions(c *ChaosPolicy, subject string) []bool {
+	var decisions []bool
+	for seq := uint64(1); seq <= 200; seq++ {
+		for attempt := 1; attempt <= 3; attempt++ {
+			decisions = append(decisions, c.Drop(subject, seq, attempt), c.FailAck(subject, seq, attempt))
+		}
+	}
+
+	return decisions
+}
+
+// Test that the same seed makes the same decisions, and a different seed different ones
+func TestChaosPolicy_Deterministic(t *testing.T) {
+	a := NewChaosPolicy(42, 0.2, 0.1)
+	b := NewChaosPolicy(42, 0.2, 0.1)
+	other := NewChaosPolicy(43, 0.2, 0.1)
+
+	assert.Equal(t, chaosDecisions(a, "ascii"), chaosDecisions(b, "ascii"))
+	assert.NotEqual(t, chaosDecisions(a, "ascii"), chaosDecisions(other, "ascii"))
+}
+
+// Test that 0 is a seed like any other, rather than meaning a random one
+func TestChaosPolicy_ZeroSeed(t *testing.T) {
+	a := NewChaosPolicy(0, 0.2, 0.1)
+	b := NewChaosPolicy(0, 0.2, 0.1)
+
+	assert.Zero(t, a.Seed)
+	assert.Equal(t, chaosDecisions(a, "ascii"), chaosDecisions(b, "ascii"))
+}
+
+// Test that the same sequence on different subjects - which STAN numbers independently - is decided independently
+func TestChaosPolicy_Subjects(t *testing.T) {
+	c := NewChaosPolicy(42, 0.2, 0.1)
+
+	assert.NotEqual(t, chaosDecisions(c, "ascii.0"), chaosDecisions(c, "ascii.1"))
+}
+
+// Test that messages are dropped at roughly the given rate
+func TestChaosPolicy_Drop(t *testing.T) {
+	c := NewChaosPolicy(7, 0.25, 0)
+
+	drops := 0
+	for seq := uint64(1); seq <= 10000; seq++ {
+		if c.Drop("ascii", seq, 1) {
+			drops++
+		}
+
+		assert.False(t, c.FailAck("ascii", seq, 1))
+	}
+
+	assert.InDelta(t, 2500, drops, 250)
+}
+
+// Test that each redelivery of a message is decided again, rather than sharing the first delivery's fate
+func TestChaosPolicy_DropRedelivery(t *testing.T) {
+	c := NewChaosPolicy(1, 0.5, 0)
+
+	// With a 50% drop rate, some message will be dropped on the first attempt but not the second
+	redecided := false
+	for seq := uint64(1); seq <= 100; seq++ {
+		if c.Drop("ascii", seq, 1) && !c.Drop("ascii", seq, 2) {
+			redecided = true
+			break
+		}
+	}
+
+	assert.True(t, redecided)
+}
+
+// Test that delivery attempts are counted per subject and sequence, and forgotten once done
+func TestChaosPolicy_Deliver(t *testing.T) {
+	c := NewChaosPolicy(1, 0, 0)
+
+	assert.Equal(t, 1, c.Deliver("ascii", 5))
+	assert.Equal(t, 2, c.Deliver("ascii", 5))
+	assert.Equal(t, 1, c.Deliver("ascii.1", 5))
+	assert.Equal(t, 2, c.Attempts("ascii", 5))
+
+	c.Done("ascii", 5)
+	assert.Equal(t, 0, c.Attempts("ascii", 5))
+}
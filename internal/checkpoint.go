@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Records how far a Producer got through publishing a series, so that it can be resumed
+type Checkpoint struct {
+	MessageSeriesId string `json:"message_series_id"`
+	// The last MessageId for which it and every message before it has been acknowledged, -1 when nothing has been
+	LastAckedId int `json:"last_acked_id"`
+	// The total messages in the series, along with its digest, to make sure the same image is resumed
+	Total    int       `json:"total"`
+	Digest   string    `json:"digest"`
+	Complete bool      `json:"complete"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Loads a Checkpoint from the given file
+func LoadCheckpoint(path string) (Checkpoint, error) {
+	var c Checkpoint
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(data, &c)
+
+	return c, err
+}
+
+// Saves the Checkpoint to the given file, replacing it atomically so an interrupted save can't corrupt it
+func (c Checkpoint) Save(path string) error {
+	c.Updated = time.Now()
+
+	return saveJSON(path, c)
+}
+
+// Writes the value as indented JSON to a temporary file, which then replaces the given file
+func saveJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Tracks acknowledged MessageIds, which may arrive in any order, to find the point up to which everything is acked
+type ackTracker struct {
+	m     sync.Mutex
+	next  int
+	acked map[int]struct{}
+}
+
+// Creates an ackTracker where `start` is the first MessageId expected to be acknowledged
+func newAckTracker(start int) *ackTracker {
+	return &ackTracker{next: start, acked: map[int]struct{}{}}
+}
+
+// Records that the MessageId was acknowledged
+func (t *ackTracker) Ack(id int) {
+	defer t.m.Unlock()
+
+	t.m.Lock()
+	if id < t.next {
+		return
+	}
+
+	t.acked[id] = struct{}{}
+
+	for {
+		if _, ok := t.acked[t.next]; !ok {
+			break
+		}
+
+		delete(t.acked, t.next)
+		t.next++
+	}
+}
+
+// Returns the last MessageId for which it, and everything before it, has been acknowledged
+func (t *ackTracker) LastAcked() int {
+	defer t.m.Unlock()
+
+	t.m.Lock()
+	return t.next - 1
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that the tracker only advances once every MessageId before it has been acked
+func TestAckTracker_LastAcked(t *testing.T) {
+	tracker := newAckTracker(0)
+	assert.Equal(t, -1, tracker.LastAcked())
+
+	tracker.Ack(1)
+	tracker.Ack(2)
+	assert.Equal(t, -1, tracker.LastAcked(), "0 has not been acked yet")
+
+	tracker.Ack(0)
+	assert.Equal(t, 2, tracker.LastAcked())
+
+	tracker.Ack(4)
+	assert.Equal(t, 2, tracker.LastAcked())
+}
+
+// Test that resuming a tracker part way through a series starts from the given MessageId
+func TestAckTracker_Resumed(t *testing.T) {
+	tracker := newAckTracker(10)
+	assert.Equal(t, 9, tracker.LastAcked())
+
+	tracker.Ack(3)
+	tracker.Ack(10)
+	assert.Equal(t, 10, tracker.LastAcked())
+}
+
+// Test that a checkpoint can be saved and loaded again
+func TestCheckpoint_SaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoint.json")
+	c := Checkpoint{MessageSeriesId: "abc", LastAckedId: 41, Total: 100, Digest: "xyz"}
+
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "abc", loaded.MessageSeriesId)
+	assert.Equal(t, 41, loaded.LastAckedId)
+	assert.Equal(t, 100, loaded.Total)
+	assert.False(t, loaded.Updated.IsZero())
+}
+
+// Test that the checkpoint is saved while messages are acknowledged, without waiting for the producer to close
+func TestProducer_SavesCheckpointPeriodically(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoint.json")
+
+	p := &Producer{}
+	p.SetOutput(discardOutput)
+	assert.NoError(t, p.configure(ProducerOptions{
+		Cluster:            server.ClusterId(),
+		ClientId:           "test-producer",
+		ConnectionString:   server.URL(),
+		Subject:            "checkpointed",
+		CheckpointFile:     path,
+		CheckpointInterval: 10 * time.Millisecond,
+	}))
+	assert.NoError(t, p.Connect())
+	assert.NoError(t, p.Publish(benchMessages(20, 1, 1)))
+
+	assert.Eventually(t, func() bool {
+		c, err := LoadCheckpoint(path)
+		return err == nil && c.LastAckedId == 19 && c.Complete
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, p.DrainAndClose())
+}
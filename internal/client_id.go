@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// STAN only allows letters, numbers, dashes and underscores in a client ID
+var invalidClientIdChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// Returned by connecting with a client ID which another connected client is already using
+type ClientIdInUseError struct {
+	ClientId string
+	Cluster  string
+}
+
+func (e *ClientIdInUseError) Error() string {
+	return fmt.Sprintf("client ID %q is already connected to cluster %q - pick another with -client, leave it out to "+
+		"generate one, or retry with a suffix using -client-retries", e.ClientId, e.Cluster)
+}
+
+// Generates a client ID for this process, from the prefix and hostname - along with the durable name for durable
+// subscriptions, so the same durable is resumed after restarting, or the PID otherwise so that every process differs
+func GenerateClientId(prefix string, durable string) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+
+	// Only the short hostname, rather than the whole domain
+	host = strings.SplitN(host, ".", 2)[0]
+
+	suffix := fmt.Sprintf("%d", os.Getpid())
+	if durable != "" {
+		suffix = durable
+	}
+
+	return SanitizeClientId(fmt.Sprintf("%s-%s-%s", prefix, host, suffix))
+}
+
+// Replaces anything STAN doesn't allow in a client ID with an underscore
+func SanitizeClientId(id string) string {
+	return invalidClientIdChars.ReplaceAllString(id, "_")
+}
+
+// Whether connecting failed because the client ID is already in use
+func isClientIdInUse(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "clientID already registered")
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Test that generated IDs are unique to the process, unless based on a durable name so they can be resumed
+func TestGenerateClientId(t *testing.T) {
+	id := GenerateClientId("ascii-consumer", "")
+
+	assert.True(t, strings.HasPrefix(id, "ascii-consumer-"))
+	assert.True(t, strings.HasSuffix(id, "-"+strconv.Itoa(os.Getpid())))
+	assert.Equal(t, id, SanitizeClientId(id))
+
+	// Durables keep the same ID across restarts, so they can be resumed
+	durable := GenerateClientId("ascii-consumer", "resume")
+	assert.True(t, strings.HasSuffix(durable, "-resume"))
+	assert.Equal(t, durable, GenerateClientId("ascii-consumer", "resume"))
+}
+
+// Test that characters a client ID can't contain are replaced
+func TestSanitizeClientId(t *testing.T) {
+	assert.Equal(t, "ascii-consumer-my_host_local-1", SanitizeClientId("ascii-consumer-my host.local-1"))
+	assert.Equal(t, "a_b_c", SanitizeClientId("a:/b@c"))
+}
+
+// Test that connecting with a client ID already in use fails clearly, or retries with a numbered suffix if allowed
+func TestNatsClient_ConnectClientIdInUse(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	connect := func(retries int) (*Consumer, error) {
+		c := newTestConsumer(t, server, ConsumerOptions{ClientId: "twin", ClientIdRetries: retries})
+
+		return c, c.Connect()
+	}
+
+	first, err := connect(0)
+	assert.NoError(t, err)
+	defer first.Close()
+
+	_, err = connect(0)
+	assert.IsType(t, &ClientIdInUseError{}, err)
+	assert.Contains(t, err.Error(), `"twin"`)
+
+	second, err := connect(2)
+	assert.NoError(t, err)
+	defer second.Close()
+
+	assert.Equal(t, "twin-2", second.conn.ClientId)
+}
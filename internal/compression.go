@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+)
+
+const (
+	CompressionNone   string = ""
+	CompressionGzip   string = "gzip"
+	CompressionZstd   string = "zstd"
+	CompressionSnappy string = "snappy"
+)
+
+// Validates that the given compression algorithm is supported
+func ValidateCompression(algorithm string) error {
+	switch algorithm {
+	case CompressionNone, CompressionGzip, CompressionZstd, CompressionSnappy:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported compression %q - allows 'gzip', 'zstd' or 'snappy'", algorithm)
+}
+
+// Compresses the Message Body into the Payload when the Body is at least `threshold` bytes long.
+//
+// The algorithm used is recorded on the Message so that consumers know how to decompress it. Messages below the
+// threshold are left untouched, since compressing a single character only adds overhead - as are messages whose
+// Payload, once base64 encoded in the JSON, would be no smaller than the Body.
+func (m *Message) Compress(algorithm string, threshold int) error {
+	if algorithm == CompressionNone || len(m.Body) < threshold {
+		return nil
+	}
+
+	payload, err := compress(algorithm, []byte(m.Body))
+	if err != nil {
+		return fmt.Errorf("failed to compress message %d: %v", m.MessageId, err)
+	}
+
+	if base64.StdEncoding.EncodedLen(len(payload)) >= len(m.Body) {
+		return nil
+	}
+
+	m.Payload = payload
+	m.Compression = algorithm
+	m.Body = ""
+
+	return nil
+}
+
+// Decompresses the Payload back into the Message Body, if the Message was compressed
+func (m *Message) Decompress() error {
+	if m.Compression == CompressionNone {
+		return nil
+	}
+
+	body, err := decompress(m.Compression, m.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to decompress message %d: %v", m.MessageId, err)
+	}
+
+	m.Body = string(body)
+	m.Payload = nil
+	m.Compression = CompressionNone
+
+	return nil
+}
+
+func compress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+
+		return w.EncodeAll(data, nil), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	}
+
+	return nil, ValidateCompression(algorithm)
+}
+
+func decompress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		return ioutil.ReadAll(r)
+	case CompressionZstd:
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		return r.DecodeAll(data, nil)
+	case CompressionSnappy:
+		return snappy.Decode(nil, data)
+	}
+
+	return nil, ValidateCompression(algorithm)
+}
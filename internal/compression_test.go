@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// Test that each supported algorithm can round trip a message body
+func TestMessage_CompressRoundTrip(t *testing.T) {
+	body := strings.Repeat("@@##%%**", 32)
+
+	for _, algorithm := range []string{CompressionGzip, CompressionZstd, CompressionSnappy} {
+		msg := Message{MessageId: 1, Body: body}
+
+		if err := msg.Compress(algorithm, 8); err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+
+		assert.Equal(t, algorithm, msg.Compression)
+		assert.Empty(t, msg.Body, "body should be moved into the payload")
+		assert.True(t, len(msg.Payload) < len(body), "%s payload should be smaller", algorithm)
+
+		if err := msg.Decompress(); err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+
+		assert.Equal(t, body, msg.Body)
+		assert.Empty(t, msg.Compression)
+	}
+}
+
+// Test that bodies smaller than the threshold are not compressed
+func TestMessage_CompressBelowThreshold(t *testing.T) {
+	msg := Message{MessageId: 1, Body: "@"}
+
+	if err := msg.Compress(CompressionGzip, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "@", msg.Body)
+	assert.Empty(t, msg.Compression)
+	assert.Nil(t, msg.Payload)
+}
+
+// Test that bodies which wouldn't be any smaller once compressed and base64 encoded are not compressed
+func TestMessage_CompressLarger(t *testing.T) {
+	msg := Message{MessageId: 1, Body: "@#%*.:-=+ "}
+
+	if err := msg.Compress(CompressionGzip, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "@#%*.:-=+ ", msg.Body)
+	assert.Empty(t, msg.Compression)
+	assert.Nil(t, msg.Payload)
+}
+
+// Test that a payload which can't be decompressed is reported, rather than replacing the body
+func TestMessage_DecompressError(t *testing.T) {
+	msg := Message{MessageId: 1, Compression: CompressionSnappy, Payload: []byte("not snappy")}
+
+	assert.Error(t, msg.Decompress())
+	assert.Equal(t, CompressionSnappy, msg.Compression)
+}
+
+// Test that unknown algorithms are rejected
+func TestValidateCompression(t *testing.T) {
+	assert.NoError(t, ValidateCompression(""))
+	assert.NoError(t, ValidateCompression("zstd"))
+	assert.Error(t, ValidateCompression("lz4"))
+}
@@ -6,7 +6,8 @@ import (
 	"fmt"
 	"github.com/imdario/mergo"
 	"github.com/nats-io/stan.go"
-	"math/rand"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,6 +16,13 @@ type ConsumerOptions struct {
 	Cluster          string
 	ClientId         string
 	ConnectionString string
+	NoRandomize      bool
+	ConnectionAuth
+
+	// Without a ClientId, one is generated from the prefix - and connecting retries this many times with a numbered
+	// suffix while the ClientId is already in use
+	ClientIdPrefix  string
+	ClientIdRetries int
 
 	Subject             string
 	MaxInFlight         int
@@ -24,33 +32,129 @@ type ConsumerOptions struct {
 	StartingOffset      string
 	AckFailPercent      float64
 	MsgDropPercent      float64
-	StartingSequence    uint64
-	AckWait             int
+	// Seeds the dropped messages and failed acks, so that runs can be reproduced - random if not set, since 0 is a seed
+	// like any other
+	Seed             *int64
+	StartingSequence uint64
+	AckWait          int
+
+	// An index of the subject, built by the index command, to look up where a series starts instead of scanning for it
+	IndexFile string
 
 	UnsubscribeOnClose bool
 	BufferMessages     bool
+
+	// Subscribes to this many partitions of the subject, merging them back into order
+	Partitions int
+
+	// With a QueueGroup, how often to send heartbeats with this member's counts to the group's control subject
+	Heartbeat time.Duration
+
+	// A file to export the stats to on shutdown
+	StatsFile string
+
+	// How long after a series' End message to wait for any missing messages before verifying it anyway, since they can
+	// still be redelivered after it - defaults to just over the AckWait
+	VerifyGrace time.Duration
+
+	// Output format, and where the ASCII art goes when it isn't text
+	Output  string
+	ArtFile string
+
+	// Connection loss detection, and reconnecting once lost
+	PingInterval  int
+	PingMaxOut    int
+	ReconnectWait time.Duration
+	MaxReconnects int
+
+	// Faults - how long processing each message takes, how long after processing it is acknowledged, crashing after
+	// this many messages and periodically pausing processing
+	ProcessingLatency string
+	AckDelay          time.Duration
+	CrashAfter        int
+	PauseEvery        time.Duration
+	PauseFor          time.Duration
+
+	// Forward to the RepublishSubject in order, only acknowledging once the forwarded message is acknowledged
+	Forward bool
 }
 
 // Basic stats on messages on the Subscriber
 type ConsumerStats struct {
 	// How messages are received, regardless of Acks
-	Received int
+	Received int `json:"received"`
 	// Total Acks sent back
-	AcksSent int
+	AcksSent int `json:"acks_sent"`
 	// Total Acks failed (intentionally based on AckFailPercent)
-	FailedAcks int
+	FailedAcks int `json:"failed_acks"`
 	// Total Dropped Messages (intentionally based on MsgDropPercent)
-	DroppedMessages int
+	DroppedMessages int `json:"dropped_messages"`
+	// Total messages skipped over when merging partitions, because they never arrived
+	SkippedMessages int `json:"skipped_messages"`
+	// Total messages republished to the RepublishSubject
+	Forwarded int `json:"forwarded"`
+	// Total messages which failed to republish
+	ForwardFailures int `json:"forward_failures"`
+	// Total redelivered messages which had already been forwarded, so weren't republished
+	Deduplicated int `json:"deduplicated"`
+	// Total messages given up on while holding messages to forward in order
+	ForwardSkipped int `json:"forward_skipped"`
+	// Total messages whose payload failed to decompress, which are still passed on - and so fail verification
+	DecompressErrors int `json:"decompress_errors"`
+
+	// Redelivery and ordering of the messages received
+	SequenceStats
 }
 
 // Opinionated Consumer for the ASCII Messaging Demo
 type Consumer struct {
 	NatsClient
 	options ConsumerOptions
-	sub     stan.Subscription
+	subs    []stan.Subscription
 	ch      chan Message
 	buffer  MessageSequenceBuffer
-	stats   ConsumerStats
+	merger  *PartitionMerger
+	tracker SequenceTracker
+	chaos   *ChaosPolicy
+	offset  StartingOffset
+	start   stan.SubscriptionOption
+	latency *LatencyDistribution
+	pauses  *PauseSchedule
+
+	// Closed when the Consumer simulates a crash
+	crashed   chan struct{}
+	crashOnce sync.Once
+
+	// What was delivered since the last queue group heartbeat, and closed to stop sending them
+	deliveries     *groupDeliveries
+	heartbeatsDone chan struct{}
+
+	// State for forwarding in order, accessed from the subscription handlers and when flushing a held gap
+	fm          sync.Mutex
+	forwarded   *dedupWindow
+	held        map[uint64]*stan.Msg
+	heldSince   time.Time
+	nextForward uint64
+	forwardGap  time.Duration
+	forwardDone chan struct{}
+
+	// Stats are updated from the handlers of every subscription
+	m         sync.Mutex
+	stats     ConsumerStats
+	lastPause int
+
+	// The sequences processed on each subject, for resubscribing from the first that wasn't
+	processed map[string]*processedSequence
+
+	// Resubscribing is registered once, however many times the subscription is created
+	reconnectOnce sync.Once
+}
+
+// The sequences processed on a subject, which STAN numbers independently
+type processedSequence struct {
+	// Every sequence up to and including the floor has been processed
+	floor uint64
+	done  map[uint64]struct{}
 }
 
 // Set the options for the Consumer
@@ -58,7 +162,7 @@ func (c *Consumer) SetOptions(opts ConsumerOptions) error {
 
 	// Set Default Values
 	d := ConsumerOptions{
-		ClientId:           DefaultConsumerClientId,
+		ClientIdPrefix:     DefaultConsumerClientId,
 		Subject:            DefaultSubject,
 		StartingOffset:     "now",
 		AckFailPercent:     0.00,
@@ -74,13 +178,72 @@ func (c *Consumer) SetOptions(opts ConsumerOptions) error {
 		return err
 	}
 
+	if d.Forward && d.RepublishSubject == "" {
+		return errors.New("forwarding requires a subject to republish to, with `-republish`")
+	}
+
+	if d.Forward && d.Partitions > 0 {
+		return errors.New("forwarding is not supported with partitions")
+	}
+
+	if d.VerifyGrace == 0 {
+		d.VerifyGrace = time.Duration(d.AckWait)*time.Second + time.Second
+	}
+
+	offset, err := ParseStartingOffset(d.StartingOffset)
+	if err != nil {
+		return err
+	}
+
+	if offset.Kind == StartSeries && d.Partitions > 0 {
+		return errors.New("starting from a series is not supported with partitions")
+	}
+
+	// STAN names a durable queue group "<durable>:<queue group>", so doesn't allow the colon in its durable name
+	if d.QueueGroup != "" && strings.Contains(d.DurableSubscription, ":") {
+		return errors.New("the durable name of a durable queue group can't contain ':'")
+	}
+
+	// Every member of a durable queue group shares the durable name, which is kept by the group rather than by any one
+	// client - so members are told apart by their process ID, like any other queue group
+	if d.ClientId == "" {
+		durable := d.DurableSubscription
+		if d.QueueGroup != "" {
+			durable = ""
+		}
+
+		d.ClientId = GenerateClientId(d.ClientIdPrefix, durable)
+	}
+
 	c.SetConnection(ConnectionInfo{
 		Cluster:          d.Cluster,
 		ClientId:         d.ClientId,
 		ConnectionString: d.ConnectionString,
+		NoRandomize:      d.NoRandomize,
+		ClientIdRetries:  d.ClientIdRetries,
 		Subject:          d.Subject,
+		PingInterval:     d.PingInterval,
+		PingMaxOut:       d.PingMaxOut,
+		ReconnectWait:    d.ReconnectWait,
+		MaxReconnects:    d.MaxReconnects,
+		ConnectionAuth:   d.ConnectionAuth,
 	})
 
+	if d.Seed == nil {
+		seed := time.Now().UnixNano()
+		d.Seed = &seed
+	}
+
+	c.chaos = NewChaosPolicy(*d.Seed, d.MsgDropPercent, d.AckFailPercent)
+
+	latency, err := ParseLatencyDistribution(d.ProcessingLatency)
+	if err != nil {
+		return err
+	}
+
+	c.latency = latency
+	c.offset = offset
+
 	c.options = d
 
 	return nil
@@ -93,7 +256,9 @@ func (c *Consumer) GetOptions() ConsumerOptions {
 
 // Create a Subscription based on the given options.
 //
-// Creates a Queue Subscription if QueueGroup is set or a Standard Subscription otherwise.
+// Creates a Queue Subscription if QueueGroup is set or a Standard Subscription otherwise. With a DurableSubscription
+// as well, the queue group itself is durable - a member joining a group which already exists starts from the group's
+// position, ignoring the starting offset and sequence.
 func (c *Consumer) CreateSubscription() error {
 	if c.Conn == nil {
 		return errors.New("subscription failed, no stan connection")
@@ -103,33 +268,160 @@ func (c *Consumer) CreateSubscription() error {
 		c.ch = make(chan Message)
 	}
 
+	if c.crashed == nil {
+		c.crashed = make(chan struct{})
+	}
+
+	c.pauses = NewPauseSchedule(c.options.PauseEvery, c.options.PauseFor)
+
+	if c.options.Forward {
+		c.startForwarding()
+	}
+
+	// The start position is kept for resubscribing, so that "now" still means when the Consumer started
+	start, err := c.startPosition()
+	if err != nil {
+		return err
+	}
+
+	c.start = start
+
+	if c.options.Partitions > 0 {
+		c.merger = NewPartitionMerger(c.options.Partitions)
+	}
+
+	if c.options.QueueGroup != "" && c.options.Heartbeat > 0 {
+		c.deliveries = newGroupDeliveries()
+	}
+
+	if err := c.subscribeAll(); err != nil {
+		return err
+	}
+
+	c.reconnectOnce.Do(func() { c.OnReconnect(c.resubscribe) })
+
+	if c.deliveries != nil {
+		c.heartbeatsDone = make(chan struct{})
+		go c.sendHeartbeats()
+	}
+
+	return nil
+}
+
+// Resolves where the subscription starts - at the starting sequence if one is given, or the starting offset otherwise
+func (c *Consumer) startPosition() (stan.SubscriptionOption, error) {
+	if c.options.StartingSequence != 0 {
+		return stan.StartAtSequence(c.options.StartingSequence), nil
+	}
+
+	if c.offset.Kind != StartSeries {
+		return c.offset.Option(time.Now()), nil
+	}
+
+	seq, from, err := locateSeries(c.Conn, c.conn.Cluster, c.options.Subject, c.offset.SeriesId,
+		c.options.IndexFile, DefaultSeriesScanTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Output().Event("series_found", map[string]interface{}{
+		"message_series_id": c.offset.SeriesId,
+		"sequence":          seq,
+		"from":              from,
+	}, fmt.Sprintf("\nStarting from series %s at sequence %d, %s. \n", c.offset.SeriesId, seq, foundBy(from)))
+
+	return stan.StartAtSequence(seq), nil
+}
+
+// Subscribes to the subject, or to each of its partitions
+func (c *Consumer) subscribeAll() error {
+	if c.options.Partitions > 0 {
+		for i := 0; i < c.options.Partitions; i++ {
+			partition := i
+			handler := func(m *stan.Msg) { c.handle(m, partition) }
+
+			if err := c.subscribe(PartitionSubject(c.options.Subject, partition), handler); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return c.subscribe(c.options.Subject, c.msgHandler)
+}
+
+// Rebuilds the subscriptions once reconnected - durable subscriptions resume from where they were, while others
+// restart from the first message that wasn't processed
+func (c *Consumer) resubscribe() error {
+	c.m.Lock()
+	stale := c.subs
+	c.subs = nil
+	c.m.Unlock()
+
+	// The subscriptions belonged to the lost connection, so closing them only cleans up after them
+	for _, sub := range stale {
+		_ = sub.Close()
+	}
+
+	if err := c.subscribeAll(); err != nil {
+		return err
+	}
+
+	c.Output().Event("resubscribed", map[string]string{"subject": c.options.Subject}, "Resubscribed. \n")
+
+	return nil
+}
+
+// Subscribes to the subject, as part of the QueueGroup if one is set
+func (c *Consumer) subscribe(subject string, handler stan.MsgHandler) error {
 	options := []stan.SubscriptionOption{
 		stan.MaxInflight(c.options.MaxInFlight),
 		stan.AckWait(time.Duration(c.options.AckWait) * time.Second),
 		stan.SetManualAckMode(),
 	}
 
-	if c.options.DurableSubscription != "" {
-		options = append(options, stan.DurableName(c.options.DurableSubscription))
-	}
+	c.m.Lock()
+	processed, resume := c.processed[subject]
+	c.m.Unlock()
 
-	if c.options.StartingSequence != 0 {
-		options = append(options, stan.StartAtSequence(c.options.StartingSequence))
-	} else if c.options.StartingOffset == "now" {
-		options = append(options, stan.StartAtTime(time.Now()))
-	} else if c.options.StartingOffset == "all" {
-		options = append(options, stan.DeliverAllAvailable())
+	if c.options.DurableSubscription != "" {
+		options = append(options, stan.DurableName(c.options.DurableSubscription), c.start)
+	} else if resume {
+		options = append(options, stan.StartAtSequence(processed.floor+1))
+	} else {
+		options = append(options, c.start)
 	}
 
+	var sub stan.Subscription
 	var err error
+
 	if c.options.QueueGroup != "" {
-		c.sub, err = c.QueueSubscribe(c.options.Subject, c.options.QueueGroup, c.msgHandler, options...)
+		sub, err = c.QueueSubscribe(subject, c.options.QueueGroup, handler, options...)
 	} else {
-		c.sub, err = c.Subscribe(c.options.Subject, c.msgHandler, options...)
+		sub, err = c.Subscribe(subject, handler, options...)
 	}
 
 	if err != nil {
-		return fmt.Errorf("failed to create subscription: %v", err)
+		return fmt.Errorf("failed to create subscription to %s: %v", subject, err)
+	}
+
+	c.m.Lock()
+	c.subs = append(c.subs, sub)
+	c.m.Unlock()
+
+	return nil
+}
+
+// Sends a processing Receipt for a verified series to the reply subject given in its End message
+func (c *Consumer) SendReceipt(reply string, result VerificationResult) error {
+	data, err := json.Marshal(NewReceipt(c.conn.ClientId, result))
+	if err != nil {
+		return err
+	}
+
+	if err := c.NatsConn().Publish(reply, data); err != nil {
+		return fmt.Errorf("failed to send receipt: %v", err)
 	}
 
 	return nil
@@ -137,11 +429,33 @@ func (c *Consumer) CreateSubscription() error {
 
 // Return the ProducerStats for the subscription
 func (c *Consumer) GetSubscriptionStats() ConsumerStats {
-	return c.stats
+	c.m.Lock()
+	stats := c.stats
+	c.m.Unlock()
+
+	stats.SequenceStats = c.tracker.GetSequenceStats()
+
+	if c.merger != nil {
+		stats.SkippedMessages = c.merger.Skipped()
+	}
+
+	return stats
+}
+
+// Safely updates the stats, which may be modified concurrently by the handlers of each subscription
+func (c *Consumer) update(fn func(stats *ConsumerStats)) {
+	defer c.m.Unlock()
+
+	c.m.Lock()
+	fn(&c.stats)
 }
 
 // Returns a channel that event messages (ascii characters) will be written to
 func (c *Consumer) Consume() chan Message {
+	if c.merger != nil {
+		return c.merger.Consume(3 * time.Second)
+	}
+
 	if c.options.BufferMessages {
 		return c.buffer.Consume(3*time.Second, 1*time.Millisecond)
 	}
@@ -149,25 +463,159 @@ func (c *Consumer) Consume() chan Message {
 	return c.ch
 }
 
+// Returns a channel which is closed if the Consumer simulates a crash, after CrashAfter messages
+func (c *Consumer) Crashed() <-chan struct{} {
+	return c.crashed
+}
+
+// Simulates the consumer process dying - the connection is closed out from under the subscriptions without closing or
+// unsubscribing them, so STAN only notices once the client stops answering its heartbeats
+func (c *Consumer) crash() {
+	c.crashOnce.Do(func() {
+		c.Output().Event("crashed", map[string]int{"after": c.options.CrashAfter},
+			fmt.Sprintf("\nCrashing after %d messages. \n", c.options.CrashAfter))
+
+		close(c.crashed)
+		go c.NatsConn().Close()
+	})
+}
+
+// Sends a heartbeat to the queue group's control subject on every interval, until the Consumer ends - or crashes, when
+// the group notices it has gone quiet
+func (c *Consumer) sendHeartbeats() {
+	ticker := time.NewTicker(c.options.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.heartbeat(false)
+		case <-c.heartbeatsDone:
+			return
+		case <-c.crashed:
+			return
+		}
+	}
+}
+
+// Sends this member's counts, and what was delivered to it since the last heartbeat
+func (c *Consumer) heartbeat(leaving bool) {
+	nc := c.NatsConn()
+	if nc == nil {
+		return
+	}
+
+	stats := c.GetSubscriptionStats()
+	data, err := json.Marshal(GroupHeartbeat{
+		ClientId:    c.conn.ClientId,
+		Subject:     c.options.Subject,
+		QueueGroup:  c.options.QueueGroup,
+		Interval:    c.options.Heartbeat,
+		Time:        time.Now(),
+		Received:    stats.Received,
+		AcksSent:    stats.AcksSent,
+		Redelivered: stats.Redelivered,
+		Delivered:   c.deliveries.take(),
+		Leaving:     leaving,
+	})
+
+	if err != nil {
+		return
+	}
+
+	_ = nc.Publish(GroupControlSubject(c.options.Subject, c.options.QueueGroup), data)
+
+	// Make sure the last heartbeat is sent before the connection is closed
+	if leaving {
+		_ = nc.Flush()
+	}
+}
+
+// Waits out the current pause, if processing is paused
+func (c *Consumer) pause() {
+	if c.pauses == nil {
+		return
+	}
+
+	remaining, n := c.pauses.Remaining(time.Now())
+	if remaining <= 0 {
+		return
+	}
+
+	c.m.Lock()
+	first := n != c.lastPause
+	c.lastPause = n
+	c.m.Unlock()
+
+	if first {
+		c.Output().Event("paused", map[string]interface{}{"duration_ms": remaining.Milliseconds()},
+			fmt.Sprintf("\nPaused for %s. \n", remaining.Round(time.Millisecond)))
+	}
+
+	time.Sleep(remaining)
+
+	if first {
+		c.Output().Event("resumed", nil, "\nResumed. \n")
+	}
+}
+
 // End the Subscription and Connection.
 //
 // If UnsubscribeOnClose is true, then unsubscribe, removing the subscription from NATS Streaming,
 // otherwise, the subscription is closed, but would remain if it was configured as durable.
 // Closing a non-durable subscription is the same as unsubscribing.
+//
+// A member leaving a durable queue group only removes itself while other members remain, and any messages it hadn't
+// acknowledged are redelivered to them. Once the last member leaves, closing keeps the group - along with its
+// unacknowledged messages - for members to resume from, while unsubscribing removes the group entirely.
 func (c *Consumer) End() error {
+	c.m.Lock()
+	subs := c.subs
+	c.m.Unlock()
+
+	// Nothing reads the merged messages any more, so stop any handler waiting to send one
+	if c.merger != nil {
+		c.merger.Close()
+	}
+
+	c.stopForwarding()
+
+	// Tell the queue group this member is leaving, unless it crashed
+	if c.heartbeatsDone != nil {
+		close(c.heartbeatsDone)
+
+		select {
+		case <-c.crashed:
+		default:
+			c.heartbeat(true)
+		}
+	}
+
+	if c.durableQueue() {
+		c.Output().Event("leaving_durable_queue_group", map[string]interface{}{
+			"queue_group": c.options.QueueGroup,
+			"durable":     c.options.DurableSubscription,
+			"unsubscribe": c.options.UnsubscribeOnClose,
+		}, c.leavingText())
+	}
+
 	if c.options.UnsubscribeOnClose {
-		fmt.Println("\nUnsubscribing. ")
+		c.Output().Event("unsubscribing", nil, "\nUnsubscribing. \n")
 
-		err := c.sub.Unsubscribe()
-		if err != nil && err != stan.ErrConnectionClosed {
-			return fmt.Errorf("error unsubscribing, %v", err)
+		for _, sub := range subs {
+			err := sub.Unsubscribe()
+			if err != nil && err != stan.ErrConnectionClosed {
+				return fmt.Errorf("error unsubscribing, %v", err)
+			}
 		}
 	} else {
-		fmt.Println("\nClosing subscription. ")
+		c.Output().Event("closing_subscription", nil, "\nClosing subscription. \n")
 
-		err := c.sub.Close()
-		if err != nil && err != stan.ErrConnectionClosed {
-			return fmt.Errorf("error closing subscription, %v", err)
+		for _, sub := range subs {
+			err := sub.Close()
+			if err != nil && err != stan.ErrConnectionClosed {
+				return fmt.Errorf("error closing subscription, %v", err)
+			}
 		}
 	}
 
@@ -179,47 +627,179 @@ func (c *Consumer) End() error {
 	return nil
 }
 
+// Whether the subscriptions belong to a durable queue group
+func (c *Consumer) durableQueue() bool {
+	return c.options.QueueGroup != "" && c.options.DurableSubscription != ""
+}
+
+// Explains what leaving the durable queue group does to it
+func (c *Consumer) leavingText() string {
+	if c.options.UnsubscribeOnClose {
+		return fmt.Sprintf("\nLeaving durable queue group %s - if this is the last member, the group and its position "+
+			"are removed. \n", c.options.QueueGroup)
+	}
+
+	return fmt.Sprintf("\nLeaving durable queue group %s - if this is the last member, the group keeps its position "+
+		"for members to resume from. \n", c.options.QueueGroup)
+}
+
 // Message Handler used for this Consumer
 func (c *Consumer) msgHandler(m *stan.Msg) {
-	rand.Seed(time.Now().UnixNano())
+	c.handle(m, 0)
+}
+
+// Handles a message received on the given partition - which is always 0 when not partitioned
+func (c *Consumer) handle(m *stan.Msg, partition int) {
+	select {
+	case <-c.crashed:
+		return
+	default:
+	}
+
+	c.deliveries.record(m.Subject, m.Sequence)
+	c.markDelivered(m)
+	attempt := c.chaos.Deliver(m.Subject, m.Sequence)
 
 	// Simulate a dropped message, forcing STAN to push it back to us after AckWait time
 	// The resent message would now arrive out of sequence
-	if rand.Float64() <= c.options.MsgDropPercent {
-		c.stats.DroppedMessages++
+	if c.chaos.Drop(m.Subject, m.Sequence, attempt) {
+		c.update(func(stats *ConsumerStats) { stats.DroppedMessages++ })
 		return
 	}
 
-	// Increment that we received the message
-	c.stats.Received++
+	c.pause()
+
+	// Increment that we received the message - unless we've already handled as many as we should before crashing
+	crashing := false
+	c.update(func(stats *ConsumerStats) {
+		if c.options.CrashAfter > 0 && stats.Received >= c.options.CrashAfter {
+			crashing = true
+			return
+		}
+
+		stats.Received++
+	})
+
+	if crashing {
+		c.crash()
+		return
+	}
+
+	c.tracker.Observe(m.Subject, m.Sequence, m.Redelivered)
+
+	// Simulate the time taken to process the message
+	if c.latency != nil {
+		time.Sleep(c.chaos.Latency(*c.latency, m.Subject, m.Sequence, attempt))
+	}
 
 	// Whether we want to republish this same message to another subject
-	if c.options.RepublishSubject != "" {
-		_, err := c.PublishAsync(c.options.RepublishSubject, m.Data, func(id string, err error) {})
+	if c.options.Forward {
+		// Forwarding acknowledges the message itself, once it has been republished
+		c.forward(m)
+		return
+	} else if c.options.RepublishSubject != "" {
+		_, err := c.PublishAsync(c.options.RepublishSubject, m.Data, func(id string, err error) {
+			if err != nil {
+				c.update(func(stats *ConsumerStats) { stats.ForwardFailures++ })
+			}
+		})
+
 		if err != nil {
-			panic(err)
+			// Leave the message unacknowledged so that it is redelivered
+			c.update(func(stats *ConsumerStats) { stats.ForwardFailures++ })
+			return
 		}
+
+		c.update(func(stats *ConsumerStats) { stats.Forwarded++ })
 	} else {
 		var msg Message
 		_ = json.Unmarshal(m.Data, &msg)
+		if err := msg.Decompress(); err != nil {
+			c.update(func(stats *ConsumerStats) { stats.DecompressErrors++ })
+		}
 
-		if c.options.BufferMessages {
+		if c.merger != nil {
+			_ = c.merger.Add(partition, msg)
+		} else if c.options.BufferMessages {
 			c.buffer.Add(m.Sequence, msg)
 		} else {
 			c.ch <- msg
 		}
 	}
 
+	c.ack(m)
+}
+
+// Starts tracking the processed sequences of the subject from the first message delivered on it, which STAN delivers
+// before any later sequence.
+//
+// Queue group members only receive some of the sequences, so aren't tracked - a member rejoining the group carries on
+// from the group's position, while the group has other members.
+func (c *Consumer) markDelivered(m *stan.Msg) {
+	if c.options.QueueGroup != "" {
+		return
+	}
+
+	defer c.m.Unlock()
+
+	c.m.Lock()
+	if c.processed == nil {
+		c.processed = map[string]*processedSequence{}
+	}
+
+	if _, ok := c.processed[m.Subject]; !ok {
+		c.processed[m.Subject] = &processedSequence{floor: m.Sequence - 1, done: map[uint64]struct{}{}}
+	}
+}
+
+// Records the message as processed, so a resubscription can restart from the first message that wasn't - rather than
+// after the highest, which would skip any dropped or still in flight
+func (c *Consumer) markProcessed(m *stan.Msg) {
+	defer c.m.Unlock()
+
+	c.m.Lock()
+	p, ok := c.processed[m.Subject]
+	if !ok || m.Sequence <= p.floor {
+		return
+	}
+
+	p.done[m.Sequence] = struct{}{}
+
+	for {
+		if _, ok := p.done[p.floor+1]; !ok {
+			break
+		}
+
+		delete(p.done, p.floor+1)
+		p.floor++
+	}
+}
+
+// Acknowledges the message
+func (c *Consumer) ack(m *stan.Msg) {
+	c.markProcessed(m)
+
 	// Artificially fail the acknowledgement after handling the message, forcing STAN to push it back to us after
 	// AckWait time.  The resent message would now be a duplicate and technically out of sequence
-	if rand.Float64() <= c.options.AckFailPercent {
-		c.stats.FailedAcks++
+	if c.chaos.FailAck(m.Subject, m.Sequence, c.chaos.Attempts(m.Subject, m.Sequence)) {
+		c.update(func(stats *ConsumerStats) { stats.FailedAcks++ })
+		return
+	}
+
+	if c.options.AckDelay > 0 {
+		time.AfterFunc(c.options.AckDelay, func() { c.sendAck(m) })
 		return
 	}
 
+	c.sendAck(m)
+}
+
+// Sends the acknowledgement to STAN
+func (c *Consumer) sendAck(m *stan.Msg) {
 	if err := m.Ack(); err != nil {
-		c.stats.FailedAcks++
+		c.update(func(stats *ConsumerStats) { stats.FailedAcks++ })
 	} else {
-		c.stats.AcksSent++
+		c.chaos.Done(m.Subject, m.Sequence)
+		c.update(func(stats *ConsumerStats) { stats.AcksSent++ })
 	}
 }
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that the consumer crashes once it has received CrashAfter messages, without receiving any more
+func TestConsumer_CrashAfter(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	publishTestMessages(t, server, "crash", 20)
+
+	c := newTestConsumer(t, server, ConsumerOptions{
+		ClientId:            "test-consumer",
+		Subject:             "crash",
+		DurableSubscription: "crash",
+		StartingOffset:      "all",
+		CrashAfter:          5,
+	})
+	assert.NoError(t, c.Connect())
+	assert.NoError(t, c.CreateSubscription())
+
+	ch := c.Consume()
+	timeout := time.After(10 * time.Second)
+	received := 0
+
+wait:
+	for {
+		select {
+		case <-ch:
+			received++
+		case <-c.Crashed():
+			break wait
+		case <-timeout:
+			t.Fatal("consumer never crashed")
+		}
+	}
+
+	assert.Equal(t, 5, received)
+	assert.Equal(t, 5, c.GetSubscriptionStats().Received)
+}
+
+// Test that the consumer reconnects and resubscribes once the server it's connected to restarts
+func TestConsumer_ResubscribesAfterRestart(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	c := newTestConsumer(t, server, ConsumerOptions{
+		ClientId:       "test-consumer",
+		Subject:        "restart",
+		StartingOffset: "all",
+		PingInterval:   1,
+		PingMaxOut:     2,
+		ReconnectWait:  100 * time.Millisecond,
+	})
+	assert.NoError(t, c.Connect())
+	assert.NoError(t, c.CreateSubscription())
+	defer c.End()
+
+	ch := c.Consume()
+
+	publishTestMessages(t, server, "restart", 3)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("messages never arrived")
+		}
+	}
+
+	assert.NoError(t, server.Restart())
+
+	// Keep publishing until the consumer has noticed the restart, reconnected and resubscribed
+	deadline := time.After(20 * time.Second)
+	for {
+		publishTestMessages(t, server, "restart", 1)
+
+		select {
+		case msg := <-ch:
+			assert.Equal(t, 0, msg.MessageId)
+			return
+		case <-time.After(500 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("consumer never resubscribed")
+		}
+	}
+}
+
+// Starts a member of the durable queue group "workers", with the durable name "dq"
+func startDurableQueueMember(t *testing.T, server *EmbeddedServer, unsubscribe bool) *Consumer {
+	c := newTestConsumer(t, server, ConsumerOptions{
+		ClientIdRetries:     5,
+		Subject:             "durable-queue",
+		QueueGroup:          "workers",
+		DurableSubscription: "dq",
+		StartingOffset:      "all",
+		UnsubscribeOnClose:  unsubscribe,
+	})
+	assert.NoError(t, c.Connect())
+	assert.NoError(t, c.CreateSubscription())
+
+	return c
+}
+
+// Counts the messages received by the members, until none have arrived for a while
+func receiveFromMembers(members ...*Consumer) int {
+	received := 0
+
+	for {
+		select {
+		case <-members[0].Consume():
+			received++
+		case <-members[1].Consume():
+			received++
+		case <-time.After(500 * time.Millisecond):
+			return received
+		}
+	}
+}
+
+// Test that a durable queue group keeps its position while it has no members, so new members resume from it
+func TestConsumer_DurableQueueGroupResumes(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	first := []*Consumer{startDurableQueueMember(t, server, false), startDurableQueueMember(t, server, false)}
+
+	publishTestMessages(t, server, "durable-queue", 10)
+	assert.Equal(t, 10, receiveFromMembers(first...))
+
+	for _, c := range first {
+		assert.NoError(t, c.End())
+	}
+
+	// Published while the group has no members
+	publishTestMessages(t, server, "durable-queue", 5)
+
+	// The new members resume the group's position, rather than starting from the beginning
+	second := []*Consumer{startDurableQueueMember(t, server, false), startDurableQueueMember(t, server, false)}
+	assert.Equal(t, 5, receiveFromMembers(second...))
+
+	for _, c := range second {
+		assert.NoError(t, c.End())
+	}
+}
+
+// Test that a durable queue group is removed once its last member unsubscribes, rather than just closing
+func TestConsumer_DurableQueueGroupRemoved(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	first := []*Consumer{startDurableQueueMember(t, server, true), startDurableQueueMember(t, server, true)}
+
+	publishTestMessages(t, server, "durable-queue", 10)
+	assert.Equal(t, 10, receiveFromMembers(first...))
+
+	for _, c := range first {
+		assert.NoError(t, c.End())
+	}
+
+	// The group is gone, so the new members start a new one from the beginning
+	second := []*Consumer{startDurableQueueMember(t, server, false), startDurableQueueMember(t, server, false)}
+	assert.Equal(t, 10, receiveFromMembers(second...))
+
+	for _, c := range second {
+		assert.NoError(t, c.End())
+	}
+}
+
+// Test that a durable queue group's name can't contain ':', and its members' client IDs aren't based on it
+func TestConsumer_SetOptionsDurableQueueGroup(t *testing.T) {
+	c := &Consumer{}
+	err := c.SetOptions(ConsumerOptions{QueueGroup: "workers", DurableSubscription: "a:b"})
+	assert.EqualError(t, err, "the durable name of a durable queue group can't contain ':'")
+
+	// Members share the durable name, so their generated client IDs can't be based on it
+	assert.NoError(t, c.SetOptions(ConsumerOptions{QueueGroup: "workers", DurableSubscription: "dq"}))
+	assert.Equal(t, GenerateClientId(DefaultConsumerClientId, ""), c.GetOptions().ClientId)
+
+	assert.NoError(t, c.SetOptions(ConsumerOptions{DurableSubscription: "dq"}))
+	assert.Equal(t, GenerateClientId(DefaultConsumerClientId, "dq"), c.GetOptions().ClientId)
+}
+
+// Test that an unknown starting offset is refused, as is starting from a series with partitions
+func TestConsumer_SetOptionsStartingOffset(t *testing.T) {
+	c := &Consumer{}
+	assert.EqualError(t, c.SetOptions(ConsumerOptions{StartingOffset: "later"}),
+		"unknown starting offset \"later\" - allows 'now', 'all', 'last', an RFC3339 time, a duration ago or 'series:<id>'")
+	assert.EqualError(t, c.SetOptions(ConsumerOptions{StartingOffset: "series:abc", Partitions: 2}),
+		"starting from a series is not supported with partitions")
+
+	assert.NoError(t, c.SetOptions(ConsumerOptions{StartingOffset: "15m"}))
+	assert.Equal(t, StartingOffset{Kind: StartAgo, Ago: 15 * time.Minute}, c.offset)
+}
+
+// Test that the chaos seed is random when not given, while a seed of 0 is kept
+func TestConsumer_SetOptionsSeed(t *testing.T) {
+	c := &Consumer{}
+	assert.NoError(t, c.SetOptions(ConsumerOptions{}))
+	assert.NotNil(t, c.GetOptions().Seed)
+	assert.Equal(t, *c.GetOptions().Seed, c.chaos.Seed)
+
+	seed := int64(0)
+	assert.NoError(t, c.SetOptions(ConsumerOptions{Seed: &seed}))
+	assert.Equal(t, int64(0), *c.GetOptions().Seed)
+	assert.Equal(t, int64(0), c.chaos.Seed)
+}
+
+// Test that resubscribing restarts from the first sequence which wasn't processed, rather than after the highest
+func TestConsumer_MarkProcessed(t *testing.T) {
+	c := &Consumer{}
+	msg := func(seq uint64) *stan.Msg {
+		return &stan.Msg{MsgProto: pb.MsgProto{Subject: "ascii", Sequence: seq}}
+	}
+
+	c.markDelivered(msg(3))
+	c.markProcessed(msg(3))
+	assert.Equal(t, uint64(3), c.processed["ascii"].floor)
+
+	// 4 was dropped, so stays the floor while later sequences are processed
+	c.markDelivered(msg(4))
+	c.markDelivered(msg(5))
+	c.markProcessed(msg(5))
+	c.markProcessed(msg(6))
+	assert.Equal(t, uint64(3), c.processed["ascii"].floor)
+
+	// Once redelivered and processed, the floor catches up
+	c.markDelivered(msg(4))
+	c.markProcessed(msg(4))
+	assert.Equal(t, uint64(6), c.processed["ascii"].floor)
+	assert.Empty(t, c.processed["ascii"].done)
+
+	// Queue group members don't receive every sequence, so aren't tracked
+	q := &Consumer{options: ConsumerOptions{QueueGroup: "workers"}}
+	q.markDelivered(msg(1))
+	q.markProcessed(msg(1))
+	assert.Empty(t, q.processed)
+}
+
+// Test that creating the subscription again doesn't resubscribe twice on reconnecting
+func TestConsumer_CreateSubscriptionRegistersReconnectOnce(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	c := newTestConsumer(t, server, ConsumerOptions{ClientId: "test-consumer", Subject: "twice"})
+	assert.NoError(t, c.Connect())
+	defer c.End()
+
+	assert.NoError(t, c.CreateSubscription())
+	assert.NoError(t, c.CreateSubscription())
+	assert.Len(t, c.reconnected, 1)
+
+	// The stale subscriptions are closed when resubscribing
+	stale := c.subs
+	assert.NoError(t, c.resubscribe())
+	assert.Len(t, c.subs, 1)
+
+	for _, sub := range stale {
+		assert.Equal(t, stan.ErrBadSubscription, sub.Close(), "already closed")
+	}
+}
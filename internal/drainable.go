@@ -1,11 +1,11 @@
 package internal
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"github.com/nats-io/stan.go"
+	"sort"
 	"sync"
-	"time"
 )
 
 type Drainable interface {
@@ -15,16 +15,26 @@ type Drainable interface {
 	// Wraps the given stan.AckHandler to automatically remove the acknowledged NUID from the Drainable Queue
 	AckHandler(fn stan.AckHandler) stan.AckHandler
 
-	// Blocks until any inflight messages (based on the queue) have been acknowledged - will timeout after
-	// `timeout` duration has been reached.
-	Drain(timeout time.Duration) error
+	// Blocks until any inflight messages (based on the queue) have been acknowledged - or until the context is done,
+	// returning the keys still in the queue.
+	Drain(ctx context.Context) ([]string, error)
 }
 
+// Wraps a stan.Conn with a queue of what is still waiting to be acknowledged, so that closing can wait for it.
+//
+// The queue is keyed by the NUID of each async publish - along with anything else that should hold up draining, such
+// as the `retry:<MessageId>:<attempt>` key of a retry waiting to be published again.
 type DrainableStan struct {
 	stan.Conn
 
 	m      sync.Mutex
 	bucket map[string]struct{}
+
+	// Closed once the queue empties, and replaced when the next NUID is added to the empty queue
+	empty chan struct{}
+
+	// NUIDs acknowledged before PublishAsync returned them, so they're never added to the queue - forgotten on draining
+	early map[string]struct{}
 }
 
 // Adds the NUID from STAN Streaming to the Drainable Queue
@@ -32,18 +42,77 @@ func (d *DrainableStan) add(id string) {
 	defer d.m.Unlock()
 
 	d.m.Lock()
+	if _, ok := d.early[id]; ok {
+		delete(d.early, id)
+		return
+	}
+
 	if d.bucket == nil {
 		d.bucket = map[string]struct{}{}
 	}
+
+	if len(d.bucket) == 0 {
+		d.empty = make(chan struct{})
+	}
+
 	d.bucket[id] = struct{}{}
 }
 
-// Removes the NUID from STAN Streaming from the Drainable Queue
+// Removes the NUID from STAN Streaming from the Drainable Queue, signalling any Drain once the queue is empty
 func (d *DrainableStan) remove(id string) {
 	defer d.m.Unlock()
 
 	d.m.Lock()
+	if _, ok := d.bucket[id]; !ok {
+		if d.early == nil {
+			d.early = map[string]struct{}{}
+		}
+
+		d.early[id] = struct{}{}
+		return
+	}
+
 	delete(d.bucket, id)
+
+	if len(d.bucket) == 0 {
+		close(d.empty)
+	}
+}
+
+// Forgets the acks which arrived without their NUID being added. Publishing has finished by the time the queue is
+// drained, so these are for NUIDs that never will be - ie acks delivered more than once.
+func (d *DrainableStan) forgetEarly() {
+	defer d.m.Unlock()
+
+	d.m.Lock()
+	d.early = nil
+}
+
+// Returns a channel which is closed once the Drainable Queue is empty - already closed if it's empty now
+func (d *DrainableStan) emptied() <-chan struct{} {
+	defer d.m.Unlock()
+
+	d.m.Lock()
+	if d.empty == nil {
+		d.empty = make(chan struct{})
+		close(d.empty)
+	}
+
+	return d.empty
+}
+
+// Returns the keys still in the queue, sorted
+func (d *DrainableStan) Pending() []string {
+	defer d.m.Unlock()
+
+	d.m.Lock()
+	pending := make([]string, 0, len(d.bucket))
+	for id := range d.bucket {
+		pending = append(pending, id)
+	}
+	sort.Strings(pending)
+
+	return pending
 }
 
 // Wraps stan.PublishAsync to automatically add the returned NUID into the Drainable Queue
@@ -58,28 +127,32 @@ func (d *DrainableStan) PublishAsync(subject string, data []byte, fn stan.AckHan
 }
 
 // Wraps the stan.AckHandler to automatically remove the acknowledged NUID from the Drainable Queue
-// Calling this will remove the given NUID from the queue before invoking the wrapped ack handler
+// Calling this will remove the given NUID from the queue after invoking the wrapped ack handler, so that anything
+// the handler adds to the queue (ie, a retry) is in place before the NUID is removed.
 func (d *DrainableStan) AckHandler(fn stan.AckHandler) stan.AckHandler {
 	return func(s string, e error) {
-		d.remove(s)
+		defer d.remove(s)
 		fn(s, e)
 	}
 }
 
-// Blocks until any inflight messages (based on the queue) have been acknowledged - will timeout after `timeout`
-// duration has been reached.
-func (d *DrainableStan) Drain(timeout time.Duration) error {
-	t := time.NewTicker(5 * time.Millisecond)
-	to := time.NewTimer(timeout)
-
-	for {
-		select {
-		case <-t.C:
-			if len(d.bucket) <= 0 {
-				return nil
-			}
-		case <-to.C:
-			return errors.New(fmt.Sprintf("timed out waiting for %d acks", len(d.bucket)))
-		}
+// Blocks until any inflight messages (based on the queue) have been acknowledged - or until the context is done, when
+// the keys still in the queue are returned along with the error. These are mostly NUIDs, but include the key of any
+// retry still waiting to be published.
+func (d *DrainableStan) Drain(ctx context.Context) ([]string, error) {
+	defer d.forgetEarly()
+
+	select {
+	case <-d.emptied():
+		return nil, nil
+	case <-ctx.Done():
+	}
+
+	// The last acks may have arrived along with the deadline
+	pending := d.Pending()
+	if len(pending) == 0 {
+		return nil, nil
 	}
+
+	return pending, fmt.Errorf("timed out waiting for %d acks: %v", len(pending), ctx.Err())
 }
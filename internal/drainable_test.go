@@ -1,9 +1,12 @@
 package internal
 
 import (
+    "context"
+    "fmt"
     "github.com/nats-io/stan.go"
     "github.com/stretchr/testify/assert"
     "github.com/stretchr/testify/mock"
+    "sync"
     "testing"
     "time"
 )
@@ -81,15 +84,20 @@ func TestDrainableStan_DrainTimesout(t *testing.T) {
     }
 
     // Timeout for DrainAndClose
-    timeout := time.Millisecond
+    timeout := 10 * time.Millisecond
 
     // We should push into this chain once the drain timeout is reached
     ch := make(chan bool)
     // Let's make sure this test can't block forever
-    to := time.After(5 * timeout)
+    to := time.After(50 * timeout)
 
     go func() {
-        if err := d.Drain(timeout); err != nil {
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        defer cancel()
+
+        pending, err := d.Drain(ctx)
+        if err != nil {
+            assert.Equal(t, []string{"abc"}, pending, "the unacknowledged NUID should be returned")
             ch <- true
         }
     }()
@@ -101,7 +109,7 @@ func TestDrainableStan_DrainTimesout(t *testing.T) {
             return
         // Let's make sure this test can't block forever
         case <-to:
-            t.Error("drain failed to timeout!")
+            t.Fatal("drain failed to timeout!")
         }
     }
 }
@@ -127,7 +135,10 @@ func TestDrainableStan_Drain(t *testing.T) {
     // We should push into this chain once the drain timeout is reached
     ch := make(chan bool)
     go func() {
-        if err := d.Drain(timeout); err != nil {
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        defer cancel()
+
+        if _, err := d.Drain(ctx); err != nil {
             t.Errorf("failed to drain: %v", err)
         }
 
@@ -144,4 +155,120 @@ func TestDrainableStan_Drain(t *testing.T) {
             return
         }
     }
-}
\ No newline at end of file
+}
+
+// Test that draining an empty queue returns straight away, even with a context that's already done
+func TestDrainableStan_DrainEmpty(t *testing.T) {
+    d := DrainableStan{}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    pending, err := d.Drain(ctx)
+    assert.NoError(t, err)
+    assert.Empty(t, pending)
+}
+
+// Test that an ack arriving before PublishAsync has returned its NUID doesn't leave the NUID in the queue
+func TestDrainableStan_AckBeforePublishReturns(t *testing.T) {
+    d := DrainableStan{}
+
+    m := MockStan{}
+    d.Conn = &m
+
+    ah := d.AckHandler(func(id string, err error) {})
+    m.On("PublishAsync", "foo", []byte("bar"), mock.Anything).Run(func(args mock.Arguments) {
+        ah("abc", nil)
+    }).Return("abc", nil)
+
+    if _, err := d.PublishAsync("foo", []byte("bar"), ah); err != nil {
+        t.Error(err)
+    }
+
+    assert.Empty(t, d.Pending(), "queue should be empty")
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+
+    _, err := d.Drain(ctx)
+    assert.NoError(t, err)
+}
+
+// Test draining a full window of inflight acks, acknowledged concurrently, while retries are added by the ack handler
+func TestDrainableStan_DrainManyInflight(t *testing.T) {
+    d := DrainableStan{}
+    inflight := DefaultMaxPubAcksInflight
+
+    var retries sync.Map
+    var ah stan.AckHandler
+    ah = d.AckHandler(func(id string, err error) {
+        // Every 100th message is retried once, which adds the retry before the original is removed
+        if _, retried := retries.Load(id); !retried && id[len(id)-2:] == "00" {
+            retry := id + "-retry"
+            retries.Store(retry, true)
+            d.add(retry)
+            go ah(retry, nil)
+        }
+    })
+
+    ids := make([]string, inflight)
+    for i := range ids {
+        ids[i] = fmt.Sprintf("nuid-%05d", i)
+        d.add(ids[i])
+    }
+
+    assert.Len(t, d.Pending(), inflight)
+
+    var wg sync.WaitGroup
+    for w := 0; w < 8; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+
+            for i := w; i < inflight; i += 8 {
+                ah(ids[i], nil)
+            }
+        }(w)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    pending, err := d.Drain(ctx)
+    assert.NoError(t, err)
+    assert.Empty(t, pending)
+
+    wg.Wait()
+    assert.Empty(t, d.Pending())
+}
+
+// Test that the NUIDs still pending when the context is done are returned
+func TestDrainableStan_DrainReturnsPending(t *testing.T) {
+    d := DrainableStan{}
+    ah := d.AckHandler(func(id string, err error) {})
+
+    for _, id := range []string{"c", "a", "b"} {
+        d.add(id)
+    }
+    ah("b", nil)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+
+    pending, err := d.Drain(ctx)
+    assert.EqualError(t, err, "timed out waiting for 2 acks: context deadline exceeded")
+    assert.Equal(t, []string{"a", "c"}, pending)
+}
+
+// Test that acks for NUIDs which were never added are forgotten once drained
+func TestDrainableStan_DrainForgetsEarlyAcks(t *testing.T) {
+    d := DrainableStan{}
+    ah := d.AckHandler(func(id string, err error) {})
+
+    ah("abc", nil)
+    assert.Len(t, d.early, 1)
+
+    _, err := d.Drain(context.Background())
+    assert.NoError(t, err)
+    assert.Empty(t, d.early)
+}
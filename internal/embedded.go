@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	natsd "github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/stan.go"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An in-memory NATS Streaming server, run in process so the demo can work without a server running.
+type EmbeddedServer struct {
+	cluster string
+	port    int
+	nats    *natsd.Server
+	stan    *stand.StanServer
+}
+
+// Starts a NATS server on a random local port, with an in-memory NATS Streaming server for the given cluster on top
+func StartEmbeddedServer(cluster string) (*EmbeddedServer, error) {
+	if cluster == "" {
+		cluster = DefaultClusterId
+	}
+
+	s := &EmbeddedServer{cluster: cluster, port: -1}
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Starts the servers, on the same port as before if they've already been started
+func (s *EmbeddedServer) start() error {
+	ns, err := natsd.NewServer(&natsd.Options{Host: "127.0.0.1", Port: s.port, NoLog: true, NoSigs: true})
+	if err != nil {
+		return fmt.Errorf("failed to create embedded nats server: %v", err)
+	}
+
+	go ns.Start()
+
+	if !ns.ReadyForConnections(10 * time.Second) {
+		ns.Shutdown()
+		return errors.New("embedded nats server failed to start")
+	}
+
+	opts := stand.GetDefaultOptions()
+	opts.ID = s.cluster
+	opts.NATSServerURL = ns.ClientURL()
+
+	ss, err := stand.RunServerWithOpts(opts, nil)
+	if err != nil {
+		ns.Shutdown()
+		return fmt.Errorf("failed to start embedded nats streaming server: %v", err)
+	}
+
+	s.nats = ns
+	s.stan = ss
+	s.port = ns.Addr().(*net.TCPAddr).Port
+
+	return nil
+}
+
+// Stops and starts the servers again on the same port - as the store is in memory, every channel starts out empty
+func (s *EmbeddedServer) Restart() error {
+	s.Shutdown()
+
+	return s.start()
+}
+
+// The connection string for the embedded server
+func (s *EmbeddedServer) URL() string {
+	return s.nats.ClientURL()
+}
+
+// The cluster ID of the embedded server
+func (s *EmbeddedServer) ClusterId() string {
+	return s.stan.ClusterID()
+}
+
+// Stops the NATS Streaming server, and then the NATS server under it
+func (s *EmbeddedServer) Shutdown() {
+	s.stan.Shutdown()
+	s.nats.Shutdown()
+}
+
+// A cluster of NATS Streaming servers, run in process to demonstrate failover. Each node has a NATS server of its own,
+// routed to the others, and channels are replicated between the nodes with Raft - so the cluster carries on serving
+// clients for as long as a majority of the nodes are running.
+type EmbeddedCluster struct {
+	cluster string
+	dir     string
+
+	m     sync.Mutex
+	nodes []*clusterNode
+}
+
+// A node of the cluster - the ports are kept so the node can be stopped and started again
+type clusterNode struct {
+	id        string
+	port      int
+	routePort int
+	nats      *natsd.Server
+	stan      *stand.StanServer
+}
+
+// Starts a cluster of `size` nodes, with their stores in a temporary directory, and waits for it to elect a leader
+func StartEmbeddedCluster(cluster string, size int) (*EmbeddedCluster, error) {
+	if cluster == "" {
+		cluster = DefaultClusterId
+	}
+
+	if size < 3 {
+		return nil, errors.New("a cluster needs at least 3 nodes to keep running while one is stopped")
+	}
+
+	dir, err := ioutil.TempDir("", "stan-demo-cluster")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &EmbeddedCluster{cluster: cluster, dir: dir}
+	for i := 0; i < size; i++ {
+		port, err := freePort()
+		if err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+
+		routePort, err := freePort()
+		if err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+
+		c.nodes = append(c.nodes, &clusterNode{id: fmt.Sprintf("node-%d", i+1), port: port, routePort: routePort})
+	}
+
+	// The NATS servers all need to be running before the streaming servers, so they can find each other
+	for i := range c.nodes {
+		if err := c.startNats(i); err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+	}
+
+	for i := range c.nodes {
+		if err := c.startStan(i); err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+	}
+
+	if err := c.AwaitLeader(30 * time.Second); err != nil {
+		c.Shutdown()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Starts the NATS server of a node, routed to the NATS servers of every other node
+func (c *EmbeddedCluster) startNats(i int) error {
+	node := c.nodes[i]
+
+	var routes []*url.URL
+	for _, peer := range c.nodes {
+		if peer != node {
+			routes = append(routes, &url.URL{Scheme: "nats", Host: fmt.Sprintf("127.0.0.1:%d", peer.routePort)})
+		}
+	}
+
+	ns, err := natsd.NewServer(&natsd.Options{
+		Host:    "127.0.0.1",
+		Port:    node.port,
+		NoLog:   true,
+		NoSigs:  true,
+		Cluster: natsd.ClusterOpts{Host: "127.0.0.1", Port: node.routePort},
+		Routes:  routes,
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to create embedded nats server for %s: %v", node.id, err)
+	}
+
+	go ns.Start()
+
+	if !ns.ReadyForConnections(10 * time.Second) {
+		ns.Shutdown()
+		return fmt.Errorf("embedded nats server for %s failed to start", node.id)
+	}
+
+	node.nats = ns
+
+	return nil
+}
+
+// Starts the streaming server of a node - on restarting, it recovers its store and catches up from the leader
+func (c *EmbeddedCluster) startStan(i int) error {
+	node := c.nodes[i]
+
+	var peers []string
+	for _, peer := range c.nodes {
+		peers = append(peers, peer.id)
+	}
+
+	opts := stand.GetDefaultOptions()
+	opts.ID = c.cluster
+	opts.NATSServerURL = node.nats.ClientURL()
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = filepath.Join(c.dir, node.id, "store")
+	opts.Clustering.Clustered = true
+	opts.Clustering.NodeID = node.id
+	opts.Clustering.Peers = peers
+	opts.Clustering.RaftLogPath = filepath.Join(c.dir, node.id, "raft")
+	opts.Clustering.LogCacheSize = stand.DefaultLogCacheSize
+	opts.Clustering.LogSnapshots = stand.DefaultLogSnapshots
+	opts.Clustering.TrailingLogs = stand.DefaultTrailingLogs
+
+	ss, err := stand.RunServerWithOpts(opts, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start embedded nats streaming server for %s: %v", node.id, err)
+	}
+
+	node.stan = ss
+
+	return nil
+}
+
+// Waits until the cluster has a leader, which is once a client is able to connect to it
+func (c *EmbeddedCluster) AwaitLeader(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		conn, err := stan.Connect(c.cluster, fmt.Sprintf("cluster-probe-%d", time.Now().UnixNano()),
+			stan.NatsURL(c.URL()), stan.ConnectWait(time.Second))
+
+		if err == nil {
+			return conn.Close()
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cluster %s has no leader after %s: %v", c.cluster, timeout, err)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// Stops both servers of a node, as if it had crashed
+func (c *EmbeddedCluster) Stop(i int) {
+	defer c.m.Unlock()
+
+	c.m.Lock()
+	node := c.nodes[i]
+	if node.stan != nil {
+		node.stan.Shutdown()
+		node.stan = nil
+	}
+
+	if node.nats != nil {
+		node.nats.Shutdown()
+		node.nats = nil
+	}
+}
+
+// Starts a stopped node again, on the same ports and with the same store
+func (c *EmbeddedCluster) Start(i int) error {
+	defer c.m.Unlock()
+
+	c.m.Lock()
+	if c.nodes[i].stan != nil {
+		return nil
+	}
+
+	if err := c.startNats(i); err != nil {
+		return err
+	}
+
+	if err := c.startStan(i); err != nil {
+		c.nodes[i].nats.Shutdown()
+		c.nodes[i].nats = nil
+		return err
+	}
+
+	return nil
+}
+
+// The IDs of the nodes, in order
+func (c *EmbeddedCluster) Nodes() []string {
+	ids := make([]string, len(c.nodes))
+	for i, node := range c.nodes {
+		ids[i] = node.id
+	}
+
+	return ids
+}
+
+// A connection string listing every node, so clients can fail over between them
+func (c *EmbeddedCluster) URL() string {
+	urls := make([]string, len(c.nodes))
+	for i, node := range c.nodes {
+		urls[i] = fmt.Sprintf("nats://127.0.0.1:%d", node.port)
+	}
+
+	return strings.Join(urls, ",")
+}
+
+// The cluster ID of the cluster
+func (c *EmbeddedCluster) ClusterId() string {
+	return c.cluster
+}
+
+// Stops every node, and removes their stores
+func (c *EmbeddedCluster) Shutdown() {
+	for i := range c.nodes {
+		c.Stop(i)
+	}
+
+	_ = os.RemoveAll(c.dir)
+}
+
+// Finds a local port that's free to listen on
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Starts an embedded server for a test, failing it straight away if the server can't be started
+func startTestServer(t *testing.T) *EmbeddedServer {
+	server, err := StartEmbeddedServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+// Connects to the embedded server with the given client ID
+func connectTestServer(t *testing.T, server *EmbeddedServer, clientId string) stan.Conn {
+	sc, err := stan.Connect(server.ClusterId(), clientId, stan.NatsURL(server.URL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sc
+}
+
+// Publishes the messages to the subject as they are, without going through a producer
+func publishMessages(t *testing.T, sc stan.Conn, subject string, msgs ...Message) {
+	for _, msg := range msgs {
+		data, _ := json.Marshal(msg)
+		assert.NoError(t, sc.Publish(subject, data))
+	}
+}
+
+// Publishes `count` single character messages to the subject on the embedded server
+func publishTestMessages(t *testing.T, server *EmbeddedServer, subject string, count int) {
+	p := &Producer{}
+	p.SetOutput(discardOutput)
+
+	assert.NoError(t, p.configure(ProducerOptions{
+		Cluster:          server.ClusterId(),
+		ClientId:         "test-producer",
+		ConnectionString: server.URL(),
+		Subject:          subject,
+	}))
+	assert.NoError(t, p.Connect())
+	assert.NoError(t, p.Publish(benchMessages(count, 1, 1)))
+	assert.NoError(t, p.DrainAndClose())
+}
+
+// Reads every message on the subject, in the order the channel stored them
+func readChannel(t *testing.T, server *EmbeddedServer, subject string, count int) []Message {
+	sc := connectTestServer(t, server, "test-reader")
+	defer sc.Close()
+
+	ch := make(chan Message, count)
+	_, err := sc.Subscribe(subject, func(m *stan.Msg) {
+		var msg Message
+		_ = json.Unmarshal(m.Data, &msg)
+		ch <- msg
+	}, stan.DeliverAllAvailable())
+	assert.NoError(t, err)
+
+	timeout := time.After(5 * time.Second)
+
+	var msgs []Message
+	for len(msgs) < count {
+		select {
+		case msg := <-ch:
+			msgs = append(msgs, msg)
+		case <-timeout:
+			t.Fatalf("timeout reached - only read %d of %d messages!", len(msgs), count)
+		}
+	}
+
+	return msgs
+}
+
+// Creates a consumer of the embedded server with the given options, ready to connect
+func newTestConsumer(t *testing.T, server *EmbeddedServer, opts ConsumerOptions) *Consumer {
+	opts.Cluster = server.ClusterId()
+	opts.ConnectionString = server.URL()
+
+	c := &Consumer{}
+	c.SetOutput(discardOutput)
+	assert.NoError(t, c.SetOptions(opts))
+
+	return c
+}
@@ -0,0 +1,363 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/imdario/mergo"
+	"github.com/nu7hatch/gouuid"
+	"sort"
+	"time"
+)
+
+type FailoverOptions struct {
+	Cluster     string
+	ClientId    string
+	Subject     string
+	NoRandomize bool
+
+	// How many nodes the embedded cluster has, which are stopped one at a time
+	Nodes int
+
+	// How many messages are published, spread evenly over the whole run
+	Messages int
+
+	// How long each node is stopped for, and how long every node runs for before the next one is stopped
+	Downtime time.Duration
+	Uptime   time.Duration
+
+	// Messages taking longer than this from being published to being received are reported as delayed
+	DelayThreshold time.Duration
+
+	// How long to wait for the remaining messages, once publishing has finished
+	Timeout time.Duration
+}
+
+// A node being stopped, and how long the cluster took to accept clients again without it
+type FailoverStop struct {
+	Node     string        `json:"node"`
+	Stopped  time.Time     `json:"stopped"`
+	Recovery time.Duration `json:"recovery_ns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// What happened to the messages while the nodes were being stopped
+type FailoverReport struct {
+	Stops []FailoverStop `json:"stops"`
+
+	// Published, acknowledged by the cluster, and retried by the producer
+	Messages int `json:"messages"`
+	Acked    int `json:"acked"`
+	Retries  int `json:"retries"`
+
+	// Unique messages received by the consumer
+	Received int `json:"received"`
+
+	// MessageIds which the producer gave up publishing, and those which were published but never received
+	Unpublished []int `json:"unpublished"`
+	Lost        []int `json:"lost"`
+
+	// MessageIds received more than once, and how many extra times they were received in total
+	Duplicated []int `json:"duplicated"`
+	Duplicates int   `json:"duplicates"`
+
+	// MessageIds which took longer than the DelayThreshold to be received
+	Delayed []int              `json:"delayed"`
+	Latency LatencyPercentiles `json:"latency"`
+
+	// Why the run didn't complete, if it didn't
+	Error string `json:"error,omitempty"`
+}
+
+// Runs a producer and consumer against an embedded cluster, while stopping its nodes one at a time
+type Failover struct {
+	options FailoverOptions
+	cluster *EmbeddedCluster
+	output  *Output
+	run     string
+}
+
+// Set the options for the Failover
+func (f *Failover) SetOptions(opts FailoverOptions) error {
+
+	// Set Default Values
+	d := FailoverOptions{
+		ClientId:       DefaultFailoverClientId,
+		Subject:        DefaultSubject + ".failover",
+		Nodes:          3,
+		Messages:       2000,
+		Downtime:       5 * time.Second,
+		Uptime:         5 * time.Second,
+		DelayThreshold: time.Second,
+		Timeout:        60 * time.Second,
+	}
+
+	if err := mergo.Merge(&d, opts, mergo.WithOverride); err != nil {
+		return err
+	}
+
+	if d.Messages < 1 {
+		return errors.New("at least one message must be published")
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Errorf("failed to generate id: %v", err)
+	}
+
+	f.options = d
+	f.run = id.String()
+
+	return nil
+}
+
+// Returns the currently set options
+func (f *Failover) GetOptions() FailoverOptions {
+	return f.options
+}
+
+// Sets where events are written to
+func (f *Failover) SetOutput(o *Output) {
+	f.output = o
+}
+
+// Returns where events are written to
+func (f *Failover) Output() *Output {
+	if f.output == nil {
+		return defaultOutput
+	}
+
+	return f.output
+}
+
+// Starts the embedded cluster
+func (f *Failover) Start() error {
+	cluster, err := StartEmbeddedCluster(f.options.Cluster, f.options.Nodes)
+	if err != nil {
+		return err
+	}
+
+	f.cluster = cluster
+	f.Output().Event("cluster_started", map[string]interface{}{
+		"cluster":  cluster.ClusterId(),
+		"nodes":    cluster.Nodes(),
+		"nats_url": cluster.URL(),
+	}, fmt.Sprintf("\nStarted cluster %s with nodes %v at %s\n", cluster.ClusterId(), cluster.Nodes(), cluster.URL()))
+
+	return nil
+}
+
+// Stops the embedded cluster
+func (f *Failover) End() {
+	if f.cluster != nil {
+		f.cluster.Shutdown()
+	}
+}
+
+// How long stopping every node takes, from the first Uptime to the last node being started again
+func (f *Failover) duration() time.Duration {
+	return f.options.Uptime + time.Duration(f.options.Nodes)*(f.options.Downtime+f.options.Uptime)
+}
+
+// Publishes the messages, spread over the time it takes to stop every node, while receiving them - and reports what
+// was lost, duplicated or delayed once every message has been received or the Timeout is reached
+func (f *Failover) Run() FailoverReport {
+	subject := fmt.Sprintf("%s.%s", f.options.Subject, f.run)
+	messages := benchMessages(f.options.Messages, 1, 1)
+	report := FailoverReport{Messages: len(messages)}
+
+	c := &Consumer{}
+	c.SetOutput(f.Output())
+
+	// A short AckWait, so anything lost in flight is redelivered quickly
+	err := c.SetOptions(ConsumerOptions{
+		Cluster:          f.cluster.ClusterId(),
+		ClientId:         f.options.ClientId + "-consumer",
+		ConnectionString: f.cluster.URL(),
+		NoRandomize:      f.options.NoRandomize,
+		Subject:          subject,
+		AckWait:          2,
+		StartingOffset:   "all",
+	})
+
+	if err == nil {
+		err = c.Connect()
+	}
+
+	if err == nil {
+		err = c.CreateSubscription()
+	}
+
+	if err != nil {
+		report.Error = err.Error()
+		_ = c.End()
+		return report
+	}
+
+	p := &Producer{}
+	p.SetOutput(f.Output())
+
+	err = p.configure(ProducerOptions{
+		Cluster:          f.cluster.ClusterId(),
+		ClientId:         f.options.ClientId + "-producer",
+		ConnectionString: f.cluster.URL(),
+		NoRandomize:      f.options.NoRandomize,
+		Subject:          subject,
+		PublishDelay:     f.duration() / time.Duration(len(messages)),
+		AckTimeout:       2 * time.Second,
+		MaxAttempts:      10,
+	})
+
+	if err == nil {
+		err = p.Connect()
+	}
+
+	if err != nil {
+		report.Error = err.Error()
+		_ = c.End()
+		return report
+	}
+
+	ch := c.Consume()
+
+	stops := make(chan []FailoverStop, 1)
+	go func() {
+		stops <- f.stopNodes()
+	}()
+
+	published := make(chan error, 1)
+	go func() {
+		if err := p.Publish(messages); err != nil {
+			published <- err
+			_ = p.Close()
+			return
+		}
+
+		published <- p.DrainAndClose()
+	}()
+
+	received := make(map[int]int, len(messages))
+	latencies := make([]time.Duration, 0, len(messages))
+	expected := len(messages)
+	var timeout <-chan time.Time
+
+receive:
+	for len(received) < expected || published != nil || stops != nil {
+		select {
+		case msg := <-ch:
+			received[msg.MessageId]++
+			if received[msg.MessageId] > 1 {
+				continue
+			}
+
+			latency := time.Since(time.Unix(0, msg.Timestamp))
+			latencies = append(latencies, latency)
+
+			if latency > f.options.DelayThreshold {
+				report.Delayed = append(report.Delayed, msg.MessageId)
+			}
+		case err := <-published:
+			if err != nil {
+				report.Error = err.Error()
+			}
+
+			// Publishing finished - messages the producer gave up on aren't waited for, and the rest are only waited so
+			// long for
+			expected -= len(p.GetPublishStats().FailedMessageIds)
+			published = nil
+			timeout = time.After(f.options.Timeout)
+		case report.Stops = <-stops:
+			stops = nil
+		case <-timeout:
+			break receive
+		}
+	}
+
+	// Keep the subscription from blocking on messages that are no longer being received
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if stops != nil {
+		report.Stops = <-stops
+	}
+
+	if err := c.End(); err != nil && report.Error == "" {
+		report.Error = err.Error()
+	}
+
+	pstats := p.GetPublishStats()
+
+	report.Acked = pstats.AcksReceived
+	report.Retries = pstats.Retries
+	report.Unpublished = pstats.FailedMessageIds
+	report.Received = len(received)
+	report.Latency = latencyPercentiles(latencies)
+
+	failed := make(map[int]bool, len(pstats.FailedMessageIds))
+	for _, id := range pstats.FailedMessageIds {
+		failed[id] = true
+	}
+
+	for id := range messages {
+		count := received[id]
+
+		if count == 0 && !failed[id] {
+			report.Lost = append(report.Lost, id)
+		}
+
+		if count > 1 {
+			report.Duplicated = append(report.Duplicated, id)
+			report.Duplicates += count - 1
+		}
+	}
+
+	sort.Ints(report.Delayed)
+
+	return report
+}
+
+// Stops each node in turn, waiting for the rest of the cluster to recover before starting it again
+func (f *Failover) stopNodes() []FailoverStop {
+	var stops []FailoverStop
+
+	time.Sleep(f.options.Uptime)
+
+	for i, node := range f.cluster.Nodes() {
+		stop := FailoverStop{Node: node, Stopped: time.Now()}
+
+		f.cluster.Stop(i)
+		f.Output().Event("node_stopped", map[string]string{"node": node},
+			fmt.Sprintf("\nStopped %s \n", node))
+
+		if err := f.cluster.AwaitLeader(f.options.Downtime + f.options.Timeout); err != nil {
+			stop.Error = err.Error()
+		}
+
+		stop.Recovery = time.Since(stop.Stopped)
+		f.Output().Event("cluster_recovered", map[string]interface{}{"node": node, "recovery_ms": stop.Recovery.Milliseconds()},
+			fmt.Sprintf("Cluster accepting clients again %s after stopping %s \n", stop.Recovery.Round(time.Millisecond), node))
+
+		time.Sleep(f.options.Downtime - stop.Recovery)
+
+		if err := f.cluster.Start(i); err != nil {
+			stop.Error = err.Error()
+		}
+
+		f.Output().Event("node_started", map[string]string{"node": node},
+			fmt.Sprintf("Started %s again \n", node))
+
+		stops = append(stops, stop)
+		time.Sleep(f.options.Uptime)
+	}
+
+	return stops
+}
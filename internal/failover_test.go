@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that every message is accounted for while each node of the cluster is stopped in turn
+func TestFailover_Run(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stops every node of a cluster in turn")
+	}
+
+	f := &Failover{}
+	f.SetOutput(discardOutput)
+
+	err := f.SetOptions(FailoverOptions{
+		Messages: 100,
+		Downtime: 500 * time.Millisecond,
+		Uptime:   500 * time.Millisecond,
+		Timeout:  30 * time.Second,
+	})
+	assert.Nil(t, err)
+
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.End()
+
+	report := f.Run()
+
+	assert.Equal(t, "", report.Error)
+	assert.Len(t, report.Stops, 3)
+	for _, stop := range report.Stops {
+		assert.Equal(t, "", stop.Error, stop.Node)
+	}
+
+	assert.Equal(t, 100, report.Messages)
+	assert.Empty(t, report.Lost)
+	assert.Equal(t, 100-len(report.Unpublished), report.Received)
+}
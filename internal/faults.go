@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	LatencyFixed       string = "fixed"
+	LatencyUniform     string = "uniform"
+	LatencyNormal      string = "normal"
+	LatencyExponential string = "exp"
+)
+
+// A distribution of how long processing each message takes
+type LatencyDistribution struct {
+	Kind string
+	// Fixed: the latency. Uniform: the minimum. Normal: the mean. Exponential: the mean.
+	A time.Duration
+	// Uniform: the maximum. Normal: the standard deviation.
+	B time.Duration
+}
+
+// Parses a latency distribution - ie '50ms', 'fixed:50ms', 'uniform:10ms-100ms', 'normal:50ms,10ms' or 'exp:20ms'
+func ParseLatencyDistribution(spec string) (*LatencyDistribution, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	kind, params := LatencyFixed, spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, params = spec[:i], spec[i+1:]
+	}
+
+	invalid := fmt.Errorf("invalid latency %q - allows '<duration>', 'fixed:<duration>', 'uniform:<min>-<max>', "+
+		"'normal:<mean>,<stddev>' or 'exp:<mean>'", spec)
+
+	var values []string
+	switch kind {
+	case LatencyFixed, LatencyExponential:
+		values = []string{params}
+	case LatencyUniform:
+		values = strings.Split(params, "-")
+	case LatencyNormal:
+		values = strings.Split(params, ",")
+	default:
+		return nil, invalid
+	}
+
+	if (kind == LatencyUniform || kind == LatencyNormal) && len(values) != 2 {
+		return nil, invalid
+	}
+
+	durations := make([]time.Duration, 2)
+	for i, v := range values {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || d < 0 {
+			return nil, invalid
+		}
+
+		durations[i] = d
+	}
+
+	if kind == LatencyUniform && durations[1] < durations[0] {
+		return nil, invalid
+	}
+
+	return &LatencyDistribution{Kind: kind, A: durations[0], B: durations[1]}, nil
+}
+
+// Returns a latency from the distribution, given two independent numbers in [0, 1)
+func (l LatencyDistribution) Sample(u1 float64, u2 float64) time.Duration {
+	var d float64
+
+	switch l.Kind {
+	case LatencyUniform:
+		d = float64(l.A) + u1*float64(l.B-l.A)
+	case LatencyNormal:
+		// Box-Muller transform, where 1-u1 keeps clear of log(0)
+		z := math.Sqrt(-2*math.Log(1-u1)) * math.Cos(2*math.Pi*u2)
+		d = float64(l.A) + z*float64(l.B)
+	case LatencyExponential:
+		d = -math.Log(1-u1) * float64(l.A)
+	default:
+		d = float64(l.A)
+	}
+
+	if d < 0 {
+		return 0
+	}
+
+	return time.Duration(d)
+}
+
+// Pauses processing for `For` after every `Every` of processing
+type PauseSchedule struct {
+	Every time.Duration
+	For   time.Duration
+	start time.Time
+}
+
+// Starts the schedule from now
+func NewPauseSchedule(every time.Duration, pause time.Duration) *PauseSchedule {
+	if every <= 0 || pause <= 0 {
+		return nil
+	}
+
+	return &PauseSchedule{Every: every, For: pause, start: time.Now()}
+}
+
+// How long is left of the current pause at the given time, if paused - along with which pause it is
+func (p *PauseSchedule) Remaining(now time.Time) (time.Duration, int) {
+	cycle := p.Every + p.For
+	elapsed := now.Sub(p.start)
+	into := elapsed % cycle
+
+	if into < p.Every {
+		return 0, 0
+	}
+
+	return cycle - into, int(elapsed/cycle) + 1
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that each kind of distribution is parsed, a bare duration being fixed, and invalid ones are refused
+func TestParseLatencyDistribution(t *testing.T) {
+	cases := map[string]LatencyDistribution{
+		"50ms":               {Kind: LatencyFixed, A: 50 * time.Millisecond},
+		"fixed:1s":           {Kind: LatencyFixed, A: time.Second},
+		"uniform:10ms-100ms": {Kind: LatencyUniform, A: 10 * time.Millisecond, B: 100 * time.Millisecond},
+		"normal:50ms, 10ms":  {Kind: LatencyNormal, A: 50 * time.Millisecond, B: 10 * time.Millisecond},
+		"exp:20ms":           {Kind: LatencyExponential, A: 20 * time.Millisecond},
+	}
+
+	for spec, expected := range cases {
+		l, err := ParseLatencyDistribution(spec)
+		assert.NoError(t, err, spec)
+		assert.Equal(t, expected, *l, spec)
+	}
+
+	l, err := ParseLatencyDistribution("")
+	assert.NoError(t, err)
+	assert.Nil(t, l)
+
+	for _, spec := range []string{"soon", "uniform:10ms", "uniform:100ms-10ms", "normal:50ms", "pareto:1s", "-5ms"} {
+		_, err := ParseLatencyDistribution(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+// Test that samples are taken from the distribution, and are never negative
+func TestLatencyDistribution_Sample(t *testing.T) {
+	fixed := LatencyDistribution{Kind: LatencyFixed, A: 50 * time.Millisecond}
+	assert.Equal(t, 50*time.Millisecond, fixed.Sample(0.9, 0.1))
+
+	uniform := LatencyDistribution{Kind: LatencyUniform, A: 10 * time.Millisecond, B: 110 * time.Millisecond}
+	assert.Equal(t, 10*time.Millisecond, uniform.Sample(0, 0))
+	assert.Equal(t, 60*time.Millisecond, uniform.Sample(0.5, 0))
+
+	normal := LatencyDistribution{Kind: LatencyNormal, A: 50 * time.Millisecond, B: 100 * time.Millisecond}
+	assert.True(t, normal.Sample(0.99, 0.5) >= 0, "latency is never negative")
+
+	exp := LatencyDistribution{Kind: LatencyExponential, A: 20 * time.Millisecond}
+	assert.Equal(t, time.Duration(0), exp.Sample(0, 0))
+	assert.True(t, exp.Sample(0.9, 0) > exp.Sample(0.5, 0))
+}
+
+// Test that the latency for a delivery is the same for the same seed, and differs between attempts
+func TestChaosPolicy_Latency(t *testing.T) {
+	l := LatencyDistribution{Kind: LatencyUniform, A: 0, B: time.Second}
+	a := NewChaosPolicy(9, 0, 0)
+	b := NewChaosPolicy(9, 0, 0)
+
+	for seq := uint64(1); seq <= 50; seq++ {
+		assert.Equal(t, a.Latency(l, "ascii", seq, 1), b.Latency(l, "ascii", seq, 1))
+	}
+
+	assert.NotEqual(t, a.Latency(l, "ascii", 1, 1), a.Latency(l, "ascii", 1, 2))
+}
+
+// Test that a pause follows every interval, counting which pause it is, and there's no schedule without an interval
+func TestPauseSchedule_Remaining(t *testing.T) {
+	assert.Nil(t, NewPauseSchedule(0, time.Second))
+
+	p := NewPauseSchedule(10*time.Second, 5*time.Second)
+	start := p.start
+
+	remaining, n := p.Remaining(start.Add(9 * time.Second))
+	assert.Equal(t, time.Duration(0), remaining)
+	assert.Equal(t, 0, n)
+
+	remaining, n = p.Remaining(start.Add(12 * time.Second))
+	assert.Equal(t, 3*time.Second, remaining)
+	assert.Equal(t, 1, n)
+
+	remaining, n = p.Remaining(start.Add(29 * time.Second))
+	assert.Equal(t, time.Second, remaining)
+	assert.Equal(t, 2, n)
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/stan.go"
+	"time"
+)
+
+// Remembers the most recent `size` keys, to detect messages that have already been handled
+type dedupWindow struct {
+	size  int
+	keys  map[string]struct{}
+	order []string
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{size: size, keys: map[string]struct{}{}}
+}
+
+// Whether the key is in the window
+func (w *dedupWindow) Seen(key string) bool {
+	_, ok := w.keys[key]
+	return ok
+}
+
+// Adds the key to the window, forgetting the oldest key once the window is full
+func (w *dedupWindow) Add(key string) {
+	if w.Seen(key) {
+		return
+	}
+
+	if len(w.order) >= w.size {
+		delete(w.keys, w.order[0])
+		w.order = w.order[1:]
+	}
+
+	w.keys[key] = struct{}{}
+	w.order = append(w.order, key)
+}
+
+// A stable ID for a message, which stays the same across redeliveries and republishing
+func forwardKey(m *stan.Msg) string {
+	var msg Message
+	if err := json.Unmarshal(m.Data, &msg); err == nil && msg.MessageSeriesId != "" {
+		return fmt.Sprintf("%s:%d", msg.MessageSeriesId, msg.MessageId)
+	}
+
+	return fmt.Sprintf("%s:%d", m.Subject, m.Sequence)
+}
+
+// Resets the forwarding state, and - unless part of a QueueGroup - starts checking for a held gap to skip, so the
+// messages after it are still forwarded once no more arrive
+func (c *Consumer) startForwarding() {
+	c.stopForwarding()
+
+	c.fm.Lock()
+	c.forwarded = newDedupWindow(DefaultForwardDedupWindow)
+	c.held = map[uint64]*stan.Msg{}
+	c.nextForward = 0
+	c.forwardGap = 2 * time.Duration(c.options.AckWait) * time.Second
+	c.fm.Unlock()
+
+	if c.options.QueueGroup != "" {
+		return
+	}
+
+	done := make(chan struct{})
+	c.forwardDone = done
+
+	go func() {
+		ticker := time.NewTicker(c.forwardGap / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.flushForwardGap()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Stops checking for a held gap to skip
+func (c *Consumer) stopForwarding() {
+	if c.forwardDone != nil {
+		close(c.forwardDone)
+		c.forwardDone = nil
+	}
+}
+
+// Forwards a message to the RepublishSubject, only acknowledging it once the republished message has been
+// acknowledged by STAN.
+//
+// Unless part of a QueueGroup (where the sequence this subscription sees has gaps by design), messages are forwarded
+// in sequence order - any message arriving ahead of a gap is held until the gap is filled by a redelivery, or skipped
+// if the gap isn't filled within twice the AckWait.
+func (c *Consumer) forward(m *stan.Msg) {
+	defer c.fm.Unlock()
+
+	c.fm.Lock()
+	if c.options.QueueGroup != "" {
+		c.forwardOne(m)
+		return
+	}
+
+	if c.nextForward == 0 {
+		c.nextForward = m.Sequence
+	}
+
+	// Anything before the next sequence has already been forwarded (or skipped), so can go straight through
+	if m.Sequence < c.nextForward {
+		c.forwardOne(m)
+		return
+	}
+
+	if len(c.held) == 0 {
+		c.heldSince = time.Now()
+	}
+	c.held[m.Sequence] = m
+
+	c.forwardHeld()
+}
+
+// Forwards the held messages from the next sequence on, skipping the gap before them once it's been held too long
+func (c *Consumer) forwardHeld() {
+	for {
+		next, ok := c.held[c.nextForward]
+		if !ok {
+			break
+		}
+
+		if !c.forwardOne(next) {
+			// Left unacknowledged, so it will be redelivered and we'll try again from here
+			return
+		}
+
+		delete(c.held, c.nextForward)
+		c.nextForward++
+		c.heldSince = time.Now()
+	}
+
+	if len(c.held) > 0 && time.Since(c.heldSince) > c.forwardGap {
+		c.skipForwardGap()
+	}
+}
+
+// Skips a gap which has been held too long, without waiting for another message to arrive
+func (c *Consumer) flushForwardGap() {
+	defer c.fm.Unlock()
+
+	c.fm.Lock()
+	if len(c.held) > 0 && time.Since(c.heldSince) > c.forwardGap {
+		c.skipForwardGap()
+	}
+}
+
+// Skips the next sequence forward to the lowest held message, giving up on the messages in between
+func (c *Consumer) skipForwardGap() {
+	var lowest uint64
+	for seq := range c.held {
+		if lowest == 0 || seq < lowest {
+			lowest = seq
+		}
+	}
+
+	skipped := int(lowest - c.nextForward)
+	c.update(func(stats *ConsumerStats) { stats.ForwardSkipped += skipped })
+
+	c.nextForward = lowest
+	c.forwardHeld()
+}
+
+// Publishes the message and waits for STAN to acknowledge it before acknowledging the inbound message. Messages
+// which have already been forwarded are acknowledged without publishing them again.
+func (c *Consumer) forwardOne(m *stan.Msg) bool {
+	key := forwardKey(m)
+
+	if c.forwarded.Seen(key) {
+		c.update(func(stats *ConsumerStats) { stats.Deduplicated++ })
+		c.ack(m)
+		return true
+	}
+
+	if err := c.Conn.Publish(c.options.RepublishSubject, m.Data); err != nil {
+		c.update(func(stats *ConsumerStats) { stats.ForwardFailures++ })
+		return false
+	}
+
+	c.forwarded.Add(key)
+	c.update(func(stats *ConsumerStats) { stats.Forwarded++ })
+	c.ack(m)
+
+	return true
+}
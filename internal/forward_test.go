@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that the window remembers keys, forgetting the oldest once full
+func TestDedupWindow(t *testing.T) {
+	w := newDedupWindow(2)
+
+	w.Add("a")
+	w.Add("b")
+	assert.True(t, w.Seen("a"))
+
+	w.Add("c")
+	assert.False(t, w.Seen("a"), "a should have been forgotten")
+	assert.True(t, w.Seen("b"))
+	assert.True(t, w.Seen("c"))
+}
+
+// Test that the forward key is based on the message itself, falling back to the STAN sequence
+func TestForwardKey(t *testing.T) {
+	m := &stan.Msg{MsgProto: pb.MsgProto{
+		Subject:  "ascii",
+		Sequence: 42,
+		Data:     []byte(`{"message_series_id":"abc","id":7}`),
+	}}
+	assert.Equal(t, "abc:7", forwardKey(m))
+
+	m.Data = []byte("not json")
+	assert.Equal(t, "ascii:42", forwardKey(m))
+}
+
+// Connects a forwarding consumer to the embedded server, returning a function to deliver it a message with the given
+// sequence, and the MessageIds republished to `output` as they arrive
+func startForwardingConsumer(t *testing.T, server *EmbeddedServer, output string, ackWait int) (*Consumer,
+	func(seq uint64) *stan.Msg, chan int) {
+	c := newTestConsumer(t, server, ConsumerOptions{
+		ClientId:         "test-forwarder",
+		Subject:          "unforwarded",
+		RepublishSubject: output,
+		Forward:          true,
+		AckWait:          ackWait,
+	})
+	assert.NoError(t, c.Connect())
+
+	forwarded := make(chan int, 10)
+	_, err := c.Conn.Subscribe("forwarded", func(m *stan.Msg) {
+		var msg Message
+		_ = json.Unmarshal(m.Data, &msg)
+		forwarded <- msg.MessageId
+	})
+	assert.NoError(t, err)
+
+	// Acknowledging a message needs a subscription, though this one never receives anything
+	sub, err := c.Conn.Subscribe("unforwarded", func(*stan.Msg) {}, stan.SetManualAckMode())
+	assert.NoError(t, err)
+
+	c.startForwarding()
+
+	deliver := func(seq uint64) *stan.Msg {
+		m := &stan.Msg{
+			MsgProto: pb.MsgProto{
+				Subject:  "unforwarded",
+				Sequence: seq,
+				Data:     []byte(fmt.Sprintf(`{"message_series_id":"abc","id":%d}`, seq)),
+			},
+			Sub: sub,
+		}
+		c.forward(m)
+
+		return m
+	}
+
+	return c, deliver, forwarded
+}
+
+// Reads `count` forwarded MessageIds, failing if they don't arrive in time
+func receiveForwarded(t *testing.T, forwarded chan int, count int) []int {
+	timeout := time.After(5 * time.Second)
+
+	var ids []int
+	for len(ids) < count {
+		select {
+		case id := <-forwarded:
+			ids = append(ids, id)
+		case <-timeout:
+			t.Fatalf("timeout reached - only %d of %d messages were forwarded!", len(ids), count)
+		}
+	}
+
+	return ids
+}
+
+// Test that messages arriving out of order are forwarded in sequence order, and a redelivery is only forwarded once
+func TestConsumer_Forward(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	c, deliver, forwarded := startForwardingConsumer(t, server, "forwarded", 10)
+	defer c.End()
+
+	deliver(1)
+	deliver(3)
+	deliver(2)
+	deliver(2)
+
+	assert.Equal(t, []int{1, 2, 3}, receiveForwarded(t, forwarded, 3))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, forwarded, "the redelivery shouldn't be forwarded again")
+
+	stats := c.GetSubscriptionStats()
+	assert.Equal(t, 3, stats.Forwarded)
+	assert.Equal(t, 1, stats.Deduplicated)
+	assert.Equal(t, 0, stats.ForwardSkipped)
+}
+
+// Test that skipping a gap gives up on the missing messages, forwarding everything held after it
+func TestConsumer_SkipForwardGap(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	c, deliver, forwarded := startForwardingConsumer(t, server, "forwarded", 10)
+	defer c.End()
+
+	deliver(1)
+	deliver(5)
+	deliver(4)
+
+	assert.Equal(t, []int{1}, receiveForwarded(t, forwarded, 1))
+
+	c.fm.Lock()
+	c.skipForwardGap()
+	c.fm.Unlock()
+
+	assert.Equal(t, []int{4, 5}, receiveForwarded(t, forwarded, 2))
+	assert.Equal(t, 2, c.GetSubscriptionStats().ForwardSkipped)
+	assert.Equal(t, uint64(6), c.nextForward)
+}
+
+// Test that a held gap is skipped once it's been held too long, even though no more messages arrive
+func TestConsumer_ForwardFlushesHeldGap(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	c, deliver, forwarded := startForwardingConsumer(t, server, "forwarded", 1)
+	defer c.End()
+
+	deliver(1)
+	deliver(3)
+
+	assert.Equal(t, []int{1, 3}, receiveForwarded(t, forwarded, 2))
+	assert.Equal(t, 1, c.GetSubscriptionStats().ForwardSkipped)
+}
+
+// Test that a message which fails to publish is left to be redelivered, and isn't treated as forwarded
+func TestConsumer_ForwardOne(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	// STAN refuses to publish to a wildcard subject
+	c, deliver, _ := startForwardingConsumer(t, server, "forwarded.*", 10)
+	defer c.End()
+
+	m := deliver(1)
+
+	c.fm.Lock()
+	assert.False(t, c.forwardOne(m))
+	assert.False(t, c.forwarded.Seen(forwardKey(m)))
+	c.fm.Unlock()
+
+	stats := c.GetSubscriptionStats()
+	assert.Equal(t, 0, stats.Forwarded)
+	assert.Equal(t, 2, stats.ForwardFailures)
+	assert.Equal(t, 0, stats.AcksSent)
+}
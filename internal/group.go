@@ -0,0 +1,426 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/imdario/mergo"
+	"github.com/nats-io/nats.go"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Members which haven't sent a heartbeat for this many intervals are considered lost
+const groupMissedHeartbeats = 3
+
+// The NATS subject members of a queue group send their heartbeats to
+func GroupControlSubject(subject string, queueGroup string) string {
+	return fmt.Sprintf("_STAN_DEMO.group.%s.%s", subject, queueGroup)
+}
+
+// Sent periodically by each member of a queue group, with its counts so far and what was delivered to it since the
+// previous heartbeat
+type GroupHeartbeat struct {
+	ClientId   string        `json:"client_id"`
+	Subject    string        `json:"subject"`
+	QueueGroup string        `json:"queue_group"`
+	Interval   time.Duration `json:"interval_ns"`
+	Time       time.Time     `json:"time"`
+
+	Received    int `json:"received"`
+	AcksSent    int `json:"acks_sent"`
+	Redelivered int `json:"redelivered"`
+
+	// Sequences delivered since the previous heartbeat, by subject - including redeliveries
+	Delivered map[string][]uint64 `json:"delivered,omitempty"`
+
+	// Sent by a member closing its subscription, rather than on an interval
+	Leaving bool `json:"leaving,omitempty"`
+}
+
+// Collects what's delivered to a member between heartbeats
+type groupDeliveries struct {
+	m         sync.Mutex
+	delivered map[string][]uint64
+}
+
+func newGroupDeliveries() *groupDeliveries {
+	return &groupDeliveries{delivered: map[string][]uint64{}}
+}
+
+// Records a delivery, which is safe to call on a nil groupDeliveries when heartbeats are disabled
+func (g *groupDeliveries) record(subject string, sequence uint64) {
+	if g == nil {
+		return
+	}
+
+	defer g.m.Unlock()
+
+	g.m.Lock()
+	g.delivered[subject] = append(g.delivered[subject], sequence)
+}
+
+// Returns the deliveries since the last take
+func (g *groupDeliveries) take() map[string][]uint64 {
+	defer g.m.Unlock()
+
+	g.m.Lock()
+	delivered := g.delivered
+	g.delivered = map[string][]uint64{}
+
+	return delivered
+}
+
+// A member of the queue group, as reported by its heartbeats
+type GroupMember struct {
+	ClientId    string    `json:"client_id"`
+	Received    int       `json:"received"`
+	AcksSent    int       `json:"acks_sent"`
+	Redelivered int       `json:"redelivered"`
+	Joined      time.Time `json:"joined"`
+	LastSeen    time.Time `json:"last_seen"`
+
+	// Redeliveries of messages which had been delivered to another member first
+	MovedIn int `json:"moved_in"`
+
+	// Whether the member closed its subscription, or stopped sending heartbeats without doing so
+	Left bool `json:"left,omitempty"`
+	Lost bool `json:"lost,omitempty"`
+
+	// This member's share of every message received by the group
+	Share float64 `json:"share"`
+
+	interval time.Duration
+}
+
+// Whether the member is still part of the group
+func (m GroupMember) Active() bool {
+	return !m.Left && !m.Lost
+}
+
+// A change in the membership of the group
+type GroupEvent struct {
+	Event    string `json:"event"`
+	ClientId string `json:"client_id"`
+}
+
+const (
+	GroupMemberJoined string = "member_joined"
+	GroupMemberLeft   string = "member_left"
+	GroupMemberLost   string = "member_lost"
+)
+
+// Aggregates the heartbeats of a queue group into the share of each member, and how often redeliveries moved between
+// members
+type GroupStatus struct {
+	m       sync.Mutex
+	members map[string]*GroupMember
+
+	// Which members each of the most recent `window` messages was delivered to, to notice redeliveries going to another
+	// member - a redelivery follows within the AckWait, so older messages are forgotten
+	deliveredTo map[string][]string
+	delivered   []string
+	window      int
+	moved       int
+}
+
+func NewGroupStatus() *GroupStatus {
+	return &GroupStatus{
+		members:     map[string]*GroupMember{},
+		deliveredTo: map[string][]string{},
+		window:      DefaultDeliveryWindow,
+	}
+}
+
+// Records a heartbeat, returning the member joining or leaving if it did
+func (g *GroupStatus) Observe(hb GroupHeartbeat, now time.Time) []GroupEvent {
+	defer g.m.Unlock()
+
+	g.m.Lock()
+	var events []GroupEvent
+
+	member, ok := g.members[hb.ClientId]
+	if !ok || !member.Active() {
+		if !ok {
+			member = &GroupMember{ClientId: hb.ClientId, Joined: now}
+			g.members[hb.ClientId] = member
+		}
+
+		member.Left, member.Lost = false, false
+		events = append(events, GroupEvent{Event: GroupMemberJoined, ClientId: hb.ClientId})
+	}
+
+	member.Received = hb.Received
+	member.AcksSent = hb.AcksSent
+	member.Redelivered = hb.Redelivered
+	member.LastSeen = now
+	member.interval = hb.Interval
+
+	// Heartbeats from different members can arrive in any order, so a message is counted as moved once it has been
+	// delivered to a second member - whichever heartbeat reported it first
+	for subject, sequences := range hb.Delivered {
+		for _, seq := range sequences {
+			key := fmt.Sprintf("%s:%d", subject, seq)
+			if containsString(g.deliveredTo[key], hb.ClientId) {
+				continue
+			}
+
+			if len(g.deliveredTo[key]) > 0 {
+				g.moved++
+				member.MovedIn++
+			} else {
+				g.remember(key)
+			}
+
+			g.deliveredTo[key] = append(g.deliveredTo[key], hb.ClientId)
+		}
+	}
+
+	if hb.Leaving {
+		member.Left = true
+		events = append(events, GroupEvent{Event: GroupMemberLeft, ClientId: hb.ClientId})
+	}
+
+	return events
+}
+
+// Adds a newly delivered message to the window, forgetting the oldest once the window is full
+func (g *GroupStatus) remember(key string) {
+	if len(g.delivered) >= g.window {
+		delete(g.deliveredTo, g.delivered[0])
+		g.delivered = g.delivered[1:]
+	}
+
+	g.delivered = append(g.delivered, key)
+}
+
+// Marks members which have missed too many heartbeats as lost, returning them
+func (g *GroupStatus) Expire(now time.Time) []GroupEvent {
+	defer g.m.Unlock()
+
+	g.m.Lock()
+	var events []GroupEvent
+
+	for _, member := range g.members {
+		if member.Active() && now.Sub(member.LastSeen) > groupMissedHeartbeats*member.interval {
+			member.Lost = true
+			events = append(events, GroupEvent{Event: GroupMemberLost, ClientId: member.ClientId})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ClientId < events[j].ClientId })
+
+	return events
+}
+
+// Every member seen so far, in the order they joined, with their share of the messages received
+func (g *GroupStatus) Members() []GroupMember {
+	defer g.m.Unlock()
+
+	g.m.Lock()
+	total := 0
+	for _, member := range g.members {
+		total += member.Received
+	}
+
+	members := make([]GroupMember, 0, len(g.members))
+	for _, member := range g.members {
+		m := *member
+		if total > 0 {
+			m.Share = float64(m.Received) / float64(total)
+		}
+
+		members = append(members, m)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Joined.Equal(members[j].Joined) {
+			return members[i].ClientId < members[j].ClientId
+		}
+
+		return members[i].Joined.Before(members[j].Joined)
+	})
+
+	return members
+}
+
+// How many redeliveries went to a different member than the message was first delivered to
+func (g *GroupStatus) Moved() int {
+	defer g.m.Unlock()
+
+	g.m.Lock()
+	return g.moved
+}
+
+// Jain's fairness index of how evenly the messages were shared between the members - 1 when every member received the
+// same number, down to 1/n when a single member received all of them
+func GroupFairness(members []GroupMember) float64 {
+	sum, squares := 0.0, 0.0
+	for _, m := range members {
+		sum += float64(m.Received)
+		squares += float64(m.Received) * float64(m.Received)
+	}
+
+	if squares == 0 {
+		return 0
+	}
+
+	return sum * sum / (float64(len(members)) * squares)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+type GroupMonitorOptions struct {
+	// Connection Info
+	Cluster          string
+	ClientId         string
+	ConnectionString string
+	NoRandomize      bool
+	ConnectionAuth
+
+	// The subject and queue group to monitor
+	Subject    string
+	QueueGroup string
+}
+
+// Listens to the heartbeats of a queue group, aggregating them into a GroupStatus
+type GroupMonitor struct {
+	NatsClient
+	options GroupMonitorOptions
+	status  *GroupStatus
+	sub     *nats.Subscription
+	done    chan struct{}
+}
+
+// Set the options for the GroupMonitor
+func (g *GroupMonitor) SetOptions(opts GroupMonitorOptions) error {
+
+	// Set Default Values
+	d := GroupMonitorOptions{
+		Subject: DefaultSubject,
+	}
+
+	if err := mergo.Merge(&d, opts, mergo.WithOverride); err != nil {
+		return err
+	}
+
+	if d.QueueGroup == "" {
+		return errors.New("a queue group to monitor is required, with `-queue-group`")
+	}
+
+	if d.ClientId == "" {
+		d.ClientId = GenerateClientId(DefaultGroupClientId, "")
+	}
+
+	g.SetConnection(ConnectionInfo{
+		Cluster:          d.Cluster,
+		ClientId:         d.ClientId,
+		ConnectionString: d.ConnectionString,
+		NoRandomize:      d.NoRandomize,
+		Subject:          GroupControlSubject(d.Subject, d.QueueGroup),
+		ConnectionAuth:   d.ConnectionAuth,
+	})
+
+	g.options = d
+	g.status = NewGroupStatus()
+
+	return nil
+}
+
+// Returns the currently set options
+func (g *GroupMonitor) GetOptions() GroupMonitorOptions {
+	return g.options
+}
+
+// Returns the status of the group so far
+func (g *GroupMonitor) Status() *GroupStatus {
+	return g.status
+}
+
+// Subscribes to the heartbeats of the group, and starts checking for members which have stopped sending them
+func (g *GroupMonitor) Start() error {
+	if err := g.subscribe(); err != nil {
+		return err
+	}
+
+	// The subscription is lost along with the connection, so is made again on the new one
+	g.OnReconnect(g.subscribe)
+	g.done = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				g.emit(g.status.Expire(now))
+			case <-g.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Subscribes to the heartbeats on the current connection
+func (g *GroupMonitor) subscribe() error {
+	nc := g.NatsConn()
+	if nc == nil {
+		return errors.New("no nats connection to receive heartbeats on")
+	}
+
+	sub, err := nc.Subscribe(GroupControlSubject(g.options.Subject, g.options.QueueGroup), g.handle)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe for heartbeats: %v", err)
+	}
+
+	g.sub = sub
+
+	return nil
+}
+
+func (g *GroupMonitor) handle(m *nats.Msg) {
+	var hb GroupHeartbeat
+	if err := json.Unmarshal(m.Data, &hb); err != nil {
+		return
+	}
+
+	g.emit(g.status.Observe(hb, time.Now()))
+}
+
+// Writes the membership changes as events
+func (g *GroupMonitor) emit(events []GroupEvent) {
+	text := map[string]string{
+		GroupMemberJoined: "%s joined the group \n",
+		GroupMemberLeft:   "%s left the group \n",
+		GroupMemberLost:   "%s stopped sending heartbeats \n",
+	}
+
+	for _, e := range events {
+		g.Output().Event(e.Event, map[string]string{"client_id": e.ClientId}, fmt.Sprintf(text[e.Event], e.ClientId))
+	}
+}
+
+// Stops listening to heartbeats and closes the connection
+func (g *GroupMonitor) End() error {
+	if g.done != nil {
+		close(g.done)
+	}
+
+	if g.sub != nil {
+		_ = g.sub.Unsubscribe()
+	}
+
+	return g.Close()
+}
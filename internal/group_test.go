@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that members join, leave and are lost as their heartbeats arrive or stop, and rejoin once heard from again
+func TestGroupStatus_Membership(t *testing.T) {
+	g := NewGroupStatus()
+	start := time.Now()
+
+	events := g.Observe(GroupHeartbeat{ClientId: "foo", Interval: time.Second, Received: 1}, start)
+	assert.Equal(t, []GroupEvent{{Event: GroupMemberJoined, ClientId: "foo"}}, events)
+
+	events = g.Observe(GroupHeartbeat{ClientId: "bar", Interval: time.Second, Received: 1}, start)
+	assert.Equal(t, []GroupEvent{{Event: GroupMemberJoined, ClientId: "bar"}}, events)
+
+	// Later heartbeats from a member already in the group change nothing
+	assert.Empty(t, g.Observe(GroupHeartbeat{ClientId: "foo", Interval: time.Second, Received: 2}, start.Add(2*time.Second)))
+
+	events = g.Observe(GroupHeartbeat{ClientId: "foo", Interval: time.Second, Leaving: true}, start.Add(3*time.Second))
+	assert.Equal(t, []GroupEvent{{Event: GroupMemberLeft, ClientId: "foo"}}, events)
+
+	// bar went quiet after its first heartbeat
+	assert.Empty(t, g.Expire(start.Add(2*time.Second)))
+	assert.Equal(t, []GroupEvent{{Event: GroupMemberLost, ClientId: "bar"}}, g.Expire(start.Add(4*time.Second)))
+	assert.Empty(t, g.Expire(start.Add(5*time.Second)))
+
+	// And rejoins once it's heard from again
+	events = g.Observe(GroupHeartbeat{ClientId: "bar", Interval: time.Second}, start.Add(6*time.Second))
+	assert.Equal(t, []GroupEvent{{Event: GroupMemberJoined, ClientId: "bar"}}, events)
+
+	// Both joined at the same time, so are ordered by ClientId
+	members := g.Members()
+	assert.Len(t, members, 2)
+	assert.Equal(t, "bar", members[0].ClientId)
+	assert.True(t, members[0].Active())
+	assert.True(t, members[1].Left)
+}
+
+// Test that a redelivery to a different member is counted as moved, and each member's share of the messages
+func TestGroupStatus_Moved(t *testing.T) {
+	g := NewGroupStatus()
+	now := time.Now()
+
+	g.Observe(GroupHeartbeat{ClientId: "foo", Received: 3, Delivered: map[string][]uint64{"ascii": {1, 2, 3}}}, now)
+	g.Observe(GroupHeartbeat{ClientId: "bar", Received: 2, Delivered: map[string][]uint64{"ascii": {4, 5}}}, now)
+	assert.Equal(t, 0, g.Moved())
+
+	// 2 was redelivered to bar, and foo's redelivery of 3 stayed with foo
+	g.Observe(GroupHeartbeat{ClientId: "bar", Received: 3, Redelivered: 1, Delivered: map[string][]uint64{"ascii": {2}}}, now)
+	g.Observe(GroupHeartbeat{ClientId: "foo", Received: 4, Redelivered: 1, Delivered: map[string][]uint64{"ascii": {3}}}, now)
+	assert.Equal(t, 1, g.Moved())
+
+	members := g.Members()
+	assert.Equal(t, "bar", members[0].ClientId)
+	assert.Equal(t, 1, members[0].MovedIn)
+	assert.InDelta(t, 3.0/7.0, members[0].Share, 0.0001)
+	assert.InDelta(t, 4.0/7.0, members[1].Share, 0.0001)
+}
+
+// Test that only the most recent deliveries are remembered, so a redelivery long after is no longer counted as moved
+func TestGroupStatus_ObserveForgetsOldDeliveries(t *testing.T) {
+	g := NewGroupStatus()
+	g.window = 2
+	now := time.Now()
+
+	g.Observe(GroupHeartbeat{ClientId: "foo", Delivered: map[string][]uint64{"ascii": {1, 2, 3}}}, now)
+	assert.Len(t, g.deliveredTo, 2)
+
+	g.Observe(GroupHeartbeat{ClientId: "bar", Delivered: map[string][]uint64{"ascii": {1, 3}}}, now)
+	assert.Equal(t, 1, g.Moved(), "1 was already forgotten")
+	assert.Len(t, g.deliveredTo, 2)
+	assert.Equal(t, []string{"foo", "bar"}, g.deliveredTo["ascii:3"])
+}
+
+// Test that the fairness is 1 when every member receives the same, and 0 without any members
+func TestGroupFairness(t *testing.T) {
+	assert.Equal(t, 1.0, GroupFairness([]GroupMember{{Received: 5}, {Received: 5}}))
+	assert.Equal(t, 0.5, GroupFairness([]GroupMember{{Received: 10}, {Received: 0}}))
+	assert.Equal(t, 0.0, GroupFairness(nil))
+}
+
+// Test that the monitor follows the members' heartbeats, until every message is accounted for once they've left
+func TestGroupMonitor_Start(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	monitor := &GroupMonitor{}
+	monitor.SetOutput(discardOutput)
+	assert.NoError(t, monitor.SetOptions(GroupMonitorOptions{
+		Cluster:          server.ClusterId(),
+		ConnectionString: server.URL(),
+		Subject:          "group",
+		QueueGroup:       "goonies",
+	}))
+	assert.NoError(t, monitor.Connect())
+	assert.NoError(t, monitor.Start())
+	defer monitor.End()
+
+	var members []*Consumer
+	for _, id := range []string{"foo", "bar"} {
+		c := newTestConsumer(t, server, ConsumerOptions{
+			ClientId:   id,
+			Subject:    "group",
+			QueueGroup: "goonies",
+			Heartbeat:  100 * time.Millisecond,
+		})
+		assert.NoError(t, c.Connect())
+		assert.NoError(t, c.CreateSubscription())
+
+		// Nothing reads the messages in this test
+		go func(ch chan Message) {
+			for range ch {
+			}
+		}(c.Consume())
+
+		members = append(members, c)
+	}
+
+	publishTestMessages(t, server, "group", 50)
+
+	// Leaving sends a final heartbeat, so the status has every message
+	for _, c := range members {
+		assert.NoError(t, c.End())
+	}
+
+	assert.Eventually(t, func() bool {
+		received := 0
+		for _, m := range monitor.Status().Members() {
+			if m.Active() {
+				return false
+			}
+
+			received += m.Received
+		}
+
+		return received == 50
+	}, 5*time.Second, 50*time.Millisecond)
+
+	status := monitor.Status().Members()
+	assert.Len(t, status, 2)
+	assert.InDelta(t, 1.0, status[0].Share+status[1].Share, 0.0001)
+}
@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/imdario/mergo"
+	"github.com/nats-io/stan.go"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Where the start of a series was found
+const (
+	SeriesFromIndex string = "index"
+	SeriesFromScan  string = "scan"
+)
+
+// A series stored in a channel, as recorded by a ChannelIndex
+type IndexedSeries struct {
+	MessageSeriesId string `json:"message_series_id"`
+	FirstSequence   uint64 `json:"first_sequence"`
+	LastSequence    uint64 `json:"last_sequence"`
+
+	// Every message of the series stored in the channel, including duplicates, and the unique MessageIds among them
+	Messages int `json:"messages"`
+	Unique   int `json:"unique"`
+
+	// How many messages the series was published with, based on its End message - 0 when there isn't one
+	Expected int `json:"expected"`
+
+	// When STAN stored the first and last messages of the series
+	FirstTimestamp time.Time `json:"first_timestamp"`
+	LastTimestamp  time.Time `json:"last_timestamp"`
+
+	// Whether the End message and every message before it are stored
+	Complete bool `json:"complete"`
+}
+
+// A catalog of the series stored in a channel, in the order they start
+type ChannelIndex struct {
+	Cluster      string    `json:"cluster"`
+	Subject      string    `json:"subject"`
+	LastSequence uint64    `json:"last_sequence"`
+	Messages     int       `json:"messages"`
+	Built        time.Time `json:"built"`
+
+	// Messages which aren't part of a series, ie aren't from the producer
+	Unindexed int `json:"unindexed"`
+
+	Series []IndexedSeries `json:"series"`
+}
+
+// Loads a ChannelIndex from the given file
+func LoadChannelIndex(path string) (ChannelIndex, error) {
+	var i ChannelIndex
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return i, err
+	}
+
+	err = json.Unmarshal(data, &i)
+
+	return i, err
+}
+
+// Saves the ChannelIndex to the given file, replacing it atomically
+func (i ChannelIndex) Save(path string) error {
+	return saveJSON(path, i)
+}
+
+// Returns the series with the given MessageSeriesId, if the index has it
+func (i ChannelIndex) Find(seriesId string) (IndexedSeries, bool) {
+	for _, s := range i.Series {
+		if s.MessageSeriesId == seriesId {
+			return s, true
+		}
+	}
+
+	return IndexedSeries{}, false
+}
+
+// Builds a ChannelIndex from the messages of a channel, added in sequence order
+type channelIndexer struct {
+	index    ChannelIndex
+	position map[string]int
+	ids      map[string]map[int]struct{}
+}
+
+func newChannelIndexer(cluster string, subject string) *channelIndexer {
+	return &channelIndexer{
+		index:    ChannelIndex{Cluster: cluster, Subject: subject, Series: []IndexedSeries{}},
+		position: map[string]int{},
+		ids:      map[string]map[int]struct{}{},
+	}
+}
+
+// Adds a message stored in the channel at the given sequence and time
+func (ci *channelIndexer) add(sequence uint64, timestamp time.Time, data []byte) {
+	ci.index.Messages++
+	ci.index.LastSequence = sequence
+
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil || msg.MessageSeriesId == "" {
+		ci.index.Unindexed++
+		return
+	}
+
+	pos, ok := ci.position[msg.MessageSeriesId]
+	if !ok {
+		pos = len(ci.index.Series)
+		ci.position[msg.MessageSeriesId] = pos
+		ci.ids[msg.MessageSeriesId] = map[int]struct{}{}
+		ci.index.Series = append(ci.index.Series, IndexedSeries{
+			MessageSeriesId: msg.MessageSeriesId,
+			FirstSequence:   sequence,
+			FirstTimestamp:  timestamp,
+		})
+	}
+
+	s := &ci.index.Series[pos]
+	s.LastSequence = sequence
+	s.LastTimestamp = timestamp
+	s.Messages++
+
+	ids := ci.ids[msg.MessageSeriesId]
+	ids[msg.MessageId] = struct{}{}
+	s.Unique = len(ids)
+
+	if msg.End {
+		s.Expected = msg.MessageId + 1
+	}
+}
+
+// Returns the index built so far, working out which series are complete
+func (ci *channelIndexer) build() ChannelIndex {
+	index := ci.index
+	index.Built = time.Now()
+	index.Series = make([]IndexedSeries, len(ci.index.Series))
+
+	for pos, s := range ci.index.Series {
+		complete := s.Expected > 0
+		for id := 0; complete && id < s.Expected; id++ {
+			_, complete = ci.ids[s.MessageSeriesId][id]
+		}
+
+		s.Complete = complete
+		index.Series[pos] = s
+	}
+
+	return index
+}
+
+type IndexOptions struct {
+	// Connection Info
+	Cluster          string
+	ClientId         string
+	ConnectionString string
+	NoRandomize      bool
+	ConnectionAuth
+
+	// The subject to index
+	Subject string
+
+	// Gives up once no message has arrived for this long
+	Timeout time.Duration
+}
+
+// Reads a channel from the beginning to build a ChannelIndex of the series stored in it
+type Indexer struct {
+	NatsClient
+	options IndexOptions
+}
+
+// Set the options for the Indexer
+func (i *Indexer) SetOptions(opts IndexOptions) error {
+
+	// Set Default Values
+	d := IndexOptions{
+		Subject: DefaultSubject,
+		Timeout: DefaultSeriesScanTimeout,
+	}
+
+	if err := mergo.Merge(&d, opts, mergo.WithOverride); err != nil {
+		return err
+	}
+
+	if d.ClientId == "" {
+		d.ClientId = GenerateClientId(DefaultIndexClientId, "")
+	}
+
+	i.SetConnection(ConnectionInfo{
+		Cluster:          d.Cluster,
+		ClientId:         d.ClientId,
+		ConnectionString: d.ConnectionString,
+		NoRandomize:      d.NoRandomize,
+		Subject:          d.Subject,
+		ConnectionAuth:   d.ConnectionAuth,
+	})
+
+	i.options = d
+
+	return nil
+}
+
+// Returns the currently set options
+func (i *Indexer) GetOptions() IndexOptions {
+	return i.options
+}
+
+// Reads every message up to the last one on the subject when started, and returns the index of them
+func (i *Indexer) Run() (ChannelIndex, error) {
+	if i.Conn == nil {
+		return ChannelIndex{}, errors.New("indexing failed, no stan connection")
+	}
+
+	last, err := lastSequence(i.Conn, i.options.Subject, i.options.Timeout)
+	if err != nil {
+		return ChannelIndex{}, err
+	}
+
+	indexer := newChannelIndexer(i.conn.Cluster, i.options.Subject)
+
+	var m sync.Mutex
+	done := make(chan struct{})
+	progress := make(chan struct{}, 1)
+
+	sub, err := i.Subscribe(i.options.Subject, func(sm *stan.Msg) {
+		defer m.Unlock()
+
+		m.Lock()
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		indexer.add(sm.Sequence, time.Unix(0, sm.Timestamp), sm.Data)
+
+		select {
+		case progress <- struct{}{}:
+		default:
+		}
+
+		if sm.Sequence >= last {
+			close(done)
+		}
+	}, stan.DeliverAllAvailable(), stan.MaxInflight(DefaultMaxAcksInFlight))
+
+	if err != nil {
+		return ChannelIndex{}, fmt.Errorf("failed to read %s: %v", i.options.Subject, err)
+	}
+
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case <-done:
+			defer m.Unlock()
+
+			m.Lock()
+			return indexer.build(), nil
+		case <-progress:
+		case <-time.After(i.options.Timeout):
+			m.Lock()
+			at := indexer.index.LastSequence
+			m.Unlock()
+
+			return ChannelIndex{}, fmt.Errorf("timed out reading %s, at sequence %d of %d", i.options.Subject, at, last)
+		}
+	}
+}
+
+// Closes the connection
+func (i *Indexer) End() error {
+	return i.Close()
+}
+
+// Finds the first sequence of the series, returning whether it was found in the index or by scanning. The series is
+// looked up in the index file if one is given - scanning only the messages after the index when it isn't there - or
+// the whole subject is scanned otherwise. The subject is scanned as well when the channel's limits have removed the
+// messages the index has the series starting from.
+func locateSeries(sc stan.Conn, cluster string, subject string, seriesId string, indexFile string,
+	timeout time.Duration) (uint64, string, error) {
+	if indexFile == "" {
+		seq, err := FindSeriesStart(sc, subject, seriesId, timeout)
+		return seq, SeriesFromScan, err
+	}
+
+	index, err := LoadChannelIndex(indexFile)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to load index: %v", err)
+	}
+
+	if index.Cluster != "" && index.Cluster != cluster {
+		return 0, "", fmt.Errorf("index %s is of cluster %s, not %s", indexFile, index.Cluster, cluster)
+	}
+
+	if index.Subject != subject {
+		return 0, "", fmt.Errorf("index %s is of subject %s, not %s", indexFile, index.Subject, subject)
+	}
+
+	if s, ok := index.Find(seriesId); ok {
+		first, err := firstSequence(sc, subject, timeout)
+		if err != nil {
+			return 0, "", err
+		}
+
+		if s.FirstSequence >= first {
+			return s.FirstSequence, SeriesFromIndex, nil
+		}
+
+		seq, err := findSeriesFrom(sc, subject, seriesId, first, timeout)
+
+		return seq, SeriesFromScan, err
+	}
+
+	seq, err := findSeriesFrom(sc, subject, seriesId, index.LastSequence+1, timeout)
+
+	return seq, SeriesFromScan, err
+}
+
+// Describes where the start of a series was found
+func foundBy(from string) string {
+	if from == SeriesFromIndex {
+		return "found in the index"
+	}
+
+	return "found by scanning"
+}
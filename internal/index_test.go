@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that the series are indexed in the order they start, with duplicates and messages from outside a series counted
+func TestChannelIndexer_Build(t *testing.T) {
+	ci := newChannelIndexer("test-cluster", "ascii")
+	start := time.Now()
+
+	add := func(seq uint64, msg Message) {
+		data, _ := json.Marshal(msg)
+		ci.add(seq, start.Add(time.Duration(seq)*time.Second), data)
+	}
+
+	add(1, Message{MessageSeriesId: "a", MessageId: 0})
+	add(2, Message{MessageSeriesId: "b", MessageId: 0})
+	add(3, Message{MessageSeriesId: "a", MessageId: 1, End: true})
+	add(4, Message{MessageSeriesId: "b", MessageId: 2, End: true})
+	add(5, Message{MessageSeriesId: "a", MessageId: 1, End: true})
+	ci.add(6, start, []byte("not a message"))
+	add(7, Message{MessageSeriesId: "c", MessageId: 0})
+
+	index := ci.build()
+	assert.Equal(t, "test-cluster", index.Cluster)
+	assert.Equal(t, "ascii", index.Subject)
+	assert.Equal(t, uint64(7), index.LastSequence)
+	assert.Equal(t, 7, index.Messages)
+	assert.Equal(t, 1, index.Unindexed)
+	assert.Len(t, index.Series, 3)
+
+	// Complete, with a duplicate of its End message
+	a := index.Series[0]
+	assert.Equal(t, "a", a.MessageSeriesId)
+	assert.Equal(t, uint64(1), a.FirstSequence)
+	assert.Equal(t, uint64(5), a.LastSequence)
+	assert.Equal(t, 3, a.Messages)
+	assert.Equal(t, 2, a.Unique)
+	assert.Equal(t, 2, a.Expected)
+	assert.Equal(t, start.Add(time.Second), a.FirstTimestamp)
+	assert.Equal(t, start.Add(5*time.Second), a.LastTimestamp)
+	assert.True(t, a.Complete)
+
+	// Missing MessageId 1
+	b := index.Series[1]
+	assert.Equal(t, 3, b.Expected)
+	assert.Equal(t, 2, b.Unique)
+	assert.False(t, b.Complete)
+
+	// Without an End message
+	c := index.Series[2]
+	assert.Equal(t, 0, c.Expected)
+	assert.False(t, c.Complete)
+
+	found, ok := index.Find("b")
+	assert.True(t, ok)
+	assert.Equal(t, b, found)
+
+	_, ok = index.Find("d")
+	assert.False(t, ok)
+}
+
+// Test that a channel is indexed, and series are located from the index - or by scanning when they aren't in it
+func TestIndexer_Run(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	sc := connectTestServer(t, server, "test-publisher")
+	defer sc.Close()
+
+	publishMessages(t, sc, "indexed",
+		Message{MessageSeriesId: "first", MessageId: 0},
+		Message{MessageSeriesId: "first", MessageId: 1, End: true},
+		Message{MessageSeriesId: "second", MessageId: 0},
+	)
+
+	i := &Indexer{}
+	i.SetOutput(discardOutput)
+	assert.NoError(t, i.SetOptions(IndexOptions{
+		Cluster:          server.ClusterId(),
+		ConnectionString: server.URL(),
+		Subject:          "indexed",
+		Timeout:          5 * time.Second,
+	}))
+	assert.NoError(t, i.Connect())
+	defer i.End()
+
+	index, err := i.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, server.ClusterId(), index.Cluster)
+	assert.Equal(t, uint64(3), index.LastSequence)
+	assert.Len(t, index.Series, 2)
+	assert.True(t, index.Series[0].Complete)
+	assert.Equal(t, uint64(3), index.Series[1].FirstSequence)
+
+	dir, err := ioutil.TempDir("", "index")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "index.json")
+	assert.NoError(t, index.Save(file))
+
+	loaded, err := LoadChannelIndex(file)
+	assert.NoError(t, err)
+	assert.Equal(t, index.Series[1].FirstSequence, loaded.Series[1].FirstSequence)
+
+	// Published after the index was built
+	publishMessages(t, sc, "indexed", Message{MessageSeriesId: "third", MessageId: 0})
+
+	seq, from, err := locateSeries(sc, server.ClusterId(), "indexed", "second", file, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), seq)
+	assert.Equal(t, SeriesFromIndex, from)
+
+	// Series which aren't in the index are scanned for after it
+	seq, from, err = locateSeries(sc, server.ClusterId(), "indexed", "third", file, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), seq)
+	assert.Equal(t, SeriesFromScan, from)
+
+	_, _, err = locateSeries(sc, server.ClusterId(), "indexed", "fourth", file, 5*time.Second)
+	assert.EqualError(t, err, "series fourth was not found on indexed")
+
+	_, _, err = locateSeries(sc, server.ClusterId(), "other", "second", file, 5*time.Second)
+	assert.EqualError(t, err, "index "+file+" is of subject indexed, not other")
+
+	_, _, err = locateSeries(sc, "other-cluster", "indexed", "second", file, 5*time.Second)
+	assert.EqualError(t, err, "index "+file+" is of cluster "+server.ClusterId()+", not other-cluster")
+}
+
+// Test that a series is scanned for once the channel's limits have removed the messages the index has it starting from
+func TestLocateSeries_Truncated(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	assert.NoError(t, err)
+
+	go ns.Start()
+	assert.True(t, ns.ReadyForConnections(10*time.Second))
+	defer ns.Shutdown()
+
+	opts := stand.GetDefaultOptions()
+	opts.NATSServerURL = ns.ClientURL()
+	opts.MaxMsgs = 3
+
+	ss, err := stand.RunServerWithOpts(opts, nil)
+	assert.NoError(t, err)
+	defer ss.Shutdown()
+
+	sc, err := stan.Connect(ss.ClusterID(), "test-publisher", stan.NatsURL(ns.ClientURL()))
+	assert.NoError(t, err)
+	defer sc.Close()
+
+	for id := 0; id < 4; id++ {
+		publishMessages(t, sc, "truncated", Message{MessageSeriesId: "abc", MessageId: id})
+	}
+
+	dir, err := ioutil.TempDir("", "index")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Indexed before the first message was removed
+	file := filepath.Join(dir, "index.json")
+	index := ChannelIndex{
+		Cluster:      ss.ClusterID(),
+		Subject:      "truncated",
+		LastSequence: 3,
+		Series:       []IndexedSeries{{MessageSeriesId: "abc", FirstSequence: 1, LastSequence: 3}},
+	}
+	assert.NoError(t, index.Save(file))
+
+	seq, from, err := locateSeries(sc, ss.ClusterID(), "truncated", "abc", file, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+	assert.Equal(t, SeriesFromScan, from)
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// Every publisher shares a single series, taking turns publishing its messages
+	PublisherModeSplit string = "split"
+	// Every publisher publishes the whole image as its own series
+	PublisherModeSeries string = "series"
+)
+
+// Publishes from several Producers in parallel, each with its own client ID and connection, onto the same channel
+type MultiProducer struct {
+	options   ProducerOptions
+	producers []*Producer
+}
+
+// Set the options for the MultiProducer, creating a Producer for each of the Publishers
+func (mp *MultiProducer) SetOptions(opts ProducerOptions) error {
+	if opts.Publishers < 2 {
+		return errors.New("at least 2 publishers are required")
+	}
+
+	if opts.PublisherMode == "" {
+		opts.PublisherMode = PublisherModeSplit
+	}
+
+	if opts.PublisherMode != PublisherModeSplit && opts.PublisherMode != PublisherModeSeries {
+		return fmt.Errorf("unsupported publisher mode %q - allows 'split' or 'series'", opts.PublisherMode)
+	}
+
+	if opts.Resume {
+		return errors.New("resuming is not supported with multiple publishers")
+	}
+
+	// Each Producer would otherwise overwrite the others' checkpoints
+	opts.CheckpointFile = ""
+
+	clientId := opts.ClientId
+	if clientId == "" {
+		prefix := opts.ClientIdPrefix
+		if prefix == "" {
+			prefix = DefaultProducerClientId
+		}
+
+		clientId = GenerateClientId(prefix, "")
+	}
+
+	mp.producers = make([]*Producer, 0, opts.Publishers)
+	for i := 1; i <= opts.Publishers; i++ {
+		o := opts
+		o.ClientId = fmt.Sprintf("%s-%d", clientId, i)
+
+		p := &Producer{}
+		if err := p.SetOptions(o); err != nil {
+			return err
+		}
+
+		mp.producers = append(mp.producers, p)
+	}
+
+	// The rate limits are for the publishers together, rather than each of them
+	for _, p := range mp.producers[1:] {
+		p.limiter = mp.producers[0].limiter
+	}
+
+	mp.options = opts
+
+	return nil
+}
+
+// Returns the currently set options
+func (mp *MultiProducer) GetOptions() ProducerOptions {
+	return mp.options
+}
+
+// Sets where events are written to for each of the Producers
+func (mp *MultiProducer) SetOutput(o *Output) {
+	for _, p := range mp.producers {
+		p.SetOutput(o)
+	}
+}
+
+// Connects each of the Producers to NATS Streaming
+func (mp *MultiProducer) Connect() error {
+	for _, p := range mp.producers {
+		if err := p.Connect(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Converts the image once, for all of the Producers
+func (mp *MultiProducer) GetAscii() ([]string, error) {
+	return mp.producers[0].GetAscii()
+}
+
+// Publishes the messages from every Producer at once.
+//
+// In 'split' mode the Producers share one series, with each publishing every Nth message. The End message is held back
+// until every other message has been acknowledged, so that a consumer receiving it can verify the whole series. In
+// 'series' mode each of the Producers publishes all of the messages as their own series.
+func (mp *MultiProducer) Publish(messages []string) error {
+	var shared series
+	if mp.options.PublisherMode == PublisherModeSplit {
+		var err error
+		if shared, err = newSeries(messages); err != nil {
+			return err
+		}
+	}
+
+	last := len(messages) - 1
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(mp.producers))
+
+	for i, p := range mp.producers {
+		wg.Add(1)
+
+		go func(i int, p *Producer) {
+			defer wg.Done()
+
+			if mp.options.PublisherMode == PublisherModeSplit {
+				errs[i] = p.publishSeries(shared, i, len(mp.producers), last)
+			} else {
+				errs[i] = p.Publish(messages)
+			}
+		}(i, p)
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("publisher %d: %v", i+1, err)
+		}
+	}
+
+	if mp.options.PublisherMode == PublisherModeSplit && last >= 0 && !mp.Interrupted() {
+		return mp.publishEnd(shared)
+	}
+
+	return nil
+}
+
+// Waits for every Producer's messages to be acknowledged, then publishes the End message of the shared series from
+// the Producer whose turn it is
+func (mp *MultiProducer) publishEnd(s series) error {
+	// Every Producer has the same, defaulted, options
+	ctx, cancel := context.WithTimeout(context.Background(), mp.producers[0].GetOptions().DrainTimeout)
+	defer cancel()
+
+	for i, p := range mp.producers {
+		if _, err := p.Drain(ctx); err != nil {
+			return fmt.Errorf("publisher %d still had messages waiting to be acknowledged, so the End message wasn't "+
+				"published: %v", i+1, err)
+		}
+	}
+
+	last := len(s.messages) - 1
+	p := mp.producers[last%len(mp.producers)]
+
+	if err := p.publishMessage(s, last); err != nil {
+		return fmt.Errorf("publisher %d: %v", last%len(mp.producers)+1, err)
+	}
+
+	return nil
+}
+
+// Whether any of the Producers was stopped early by an interrupt
+func (mp *MultiProducer) Interrupted() bool {
+	for _, p := range mp.producers {
+		if p.Interrupted() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Drains and closes each of the Producers
+func (mp *MultiProducer) DrainAndClose() error {
+	var errs []error
+	for _, p := range mp.producers {
+		if err := p.DrainAndClose(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d publishers failed to close: %v", len(errs), errs)
+	}
+
+	return nil
+}
+
+// Returns the processing receipts received by every Producer, by MessageSeriesId
+func (mp *MultiProducer) GetReceipts() map[string][]Receipt {
+	receipts := map[string][]Receipt{}
+	for _, p := range mp.producers {
+		for id, r := range p.GetReceipts() {
+			receipts[id] = append(receipts[id], r...)
+		}
+	}
+
+	return receipts
+}
+
+// Return the ProducerStats of each Producer
+func (mp *MultiProducer) GetPublisherStats() []ProducerStats {
+	stats := make([]ProducerStats, 0, len(mp.producers))
+	for _, p := range mp.producers {
+		stats = append(stats, p.GetPublishStats())
+	}
+
+	return stats
+}
+
+// Return the combined ProducerStats of all of the Producers
+func (mp *MultiProducer) GetPublishStats() ProducerStats {
+	total := ProducerStats{}
+	for _, stats := range mp.GetPublisherStats() {
+		total.Merge(stats)
+	}
+
+	return total
+}
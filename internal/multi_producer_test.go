@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Publishes the messages from a MultiProducer to the subject on the embedded server, in the given mode
+func publishFromMultiProducer(t *testing.T, server *EmbeddedServer, subject string, mode string,
+	messages []string) *MultiProducer {
+	mp := &MultiProducer{}
+	assert.NoError(t, mp.SetOptions(ProducerOptions{
+		Cluster:          server.ClusterId(),
+		ClientId:         "test-publisher",
+		ConnectionString: server.URL(),
+		Subject:          subject,
+		LocalFile:        "unused.png",
+		Publishers:       3,
+		PublisherMode:    mode,
+	}))
+	mp.SetOutput(discardOutput)
+
+	assert.NoError(t, mp.Connect())
+	assert.NoError(t, mp.Publish(messages))
+	assert.NoError(t, mp.DrainAndClose())
+
+	return mp
+}
+
+// Test that in split mode the publishers share one series, with its End message only published after every other
+func TestMultiProducer_PublishSplit(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	messages := benchMessages(20, 1, 1)
+	mp := publishFromMultiProducer(t, server, "split", PublisherModeSplit, messages)
+
+	msgs := readChannel(t, server, "split", len(messages))
+	assert.True(t, msgs[len(msgs)-1].End, "the End message should be the last in the channel")
+
+	verifier := SeriesVerifier{}
+	for _, msg := range msgs {
+		assert.Equal(t, msgs[0].MessageSeriesId, msg.MessageSeriesId)
+		verifier.Add(msg)
+	}
+
+	result := verifier.Verify(msgs[0].MessageSeriesId)
+	assert.Equal(t, len(messages), result.Received)
+	assert.True(t, result.Match())
+
+	sent := []int{}
+	for _, stats := range mp.GetPublisherStats() {
+		sent = append(sent, stats.MessagesSent)
+	}
+	assert.Equal(t, []int{7, 7, 6}, sent, "the End message belongs to the second publisher")
+	assert.Equal(t, len(messages), mp.GetPublishStats().AcksReceived)
+}
+
+// Test that in series mode every publisher publishes the whole series as its own
+func TestMultiProducer_PublishSeries(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	messages := benchMessages(10, 1, 1)
+	publishFromMultiProducer(t, server, "series", PublisherModeSeries, messages)
+
+	verifier := SeriesVerifier{}
+	series := map[string]bool{}
+	for _, msg := range readChannel(t, server, "series", 3*len(messages)) {
+		verifier.Add(msg)
+		series[msg.MessageSeriesId] = true
+	}
+
+	assert.Len(t, series, 3)
+
+	for id := range series {
+		result := verifier.Verify(id)
+		assert.Equal(t, len(messages), result.Received)
+		assert.True(t, result.Match())
+	}
+}
+
+// Test that the options need several publishers, a known mode and can't resume
+func TestMultiProducer_SetOptions(t *testing.T) {
+	mp := &MultiProducer{}
+	opts := ProducerOptions{LocalFile: "unused.png", Publishers: 2}
+
+	assert.NoError(t, mp.SetOptions(opts))
+	assert.Equal(t, PublisherModeSplit, mp.GetOptions().PublisherMode)
+	assert.Len(t, mp.GetPublisherStats(), 2)
+
+	assert.Error(t, mp.SetOptions(ProducerOptions{LocalFile: "unused.png", Publishers: 1}))
+	assert.Error(t, mp.SetOptions(ProducerOptions{LocalFile: "unused.png", Publishers: 2, PublisherMode: "random"}))
+	assert.Error(t, mp.SetOptions(ProducerOptions{LocalFile: "unused.png", Publishers: 2, Resume: true}))
+}
+
+// Test that the publishers share one rate limit, rather than each publishing at the full rate
+func TestMultiProducer_SetOptionsRateLimit(t *testing.T) {
+	mp := &MultiProducer{}
+	assert.NoError(t, mp.SetOptions(ProducerOptions{LocalFile: "unused.png", Publishers: 3, RateLimit: 100}))
+
+	for _, p := range mp.producers {
+		assert.NotNil(t, p.limiter)
+		assert.Same(t, mp.producers[0].limiter, p.limiter)
+	}
+
+	assert.Equal(t, 100.0, mp.GetPublishStats().TargetRate)
+}
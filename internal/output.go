@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Free form text, with the ASCII art mixed in
+	OutputText string = "text"
+	// Newline delimited JSON events, with the ASCII art written separately
+	OutputJSON string = "json"
+)
+
+// The default Output, used when none has been set
+var defaultOutput = &Output{format: OutputText, events: os.Stdout, art: os.Stdout}
+
+// An Output which writes nothing, for clients run in the background
+var discardOutput = &Output{format: OutputText, events: ioutil.Discard, art: ioutil.Discard}
+
+// Writes events and the ASCII art, either as free form text or structured JSON events.
+type Output struct {
+	m       sync.Mutex
+	format  string
+	events  io.Writer
+	art     io.Writer
+	artFile *os.File
+}
+
+// A single structured event, written as one line of JSON
+type Event struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Creates an Output in the given format. In JSON format, events are written to stdout and the ASCII art is written to
+// `artFile` if given, or stderr otherwise. In text format, everything is written to stdout.
+func NewOutput(format string, artFile string) (*Output, error) {
+	switch format {
+	case "", OutputText:
+		return &Output{format: OutputText, events: os.Stdout, art: os.Stdout}, nil
+	case OutputJSON:
+		o := &Output{format: OutputJSON, events: os.Stdout, art: os.Stderr}
+
+		if artFile != "" {
+			f, err := os.Create(artFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create art file: %v", err)
+			}
+
+			o.art = f
+			o.artFile = f
+		}
+
+		return o, nil
+	}
+
+	return nil, fmt.Errorf("unsupported output %q - allows 'text' or 'json'", format)
+}
+
+// Whether events are written as JSON
+func (o *Output) JSON() bool {
+	return o.format == OutputJSON
+}
+
+// Writes an event - as the given text in text format (if there is any) or as a JSON event with the given data
+func (o *Output) Event(name string, data interface{}, text string) {
+	defer o.m.Unlock()
+
+	o.m.Lock()
+	if !o.JSON() {
+		if text != "" {
+			fmt.Fprint(o.events, text)
+		}
+
+		return
+	}
+
+	line, err := json.Marshal(Event{Event: name, Time: time.Now(), Data: data})
+	if err != nil {
+		line, _ = json.Marshal(Event{Event: "error", Time: time.Now(), Data: map[string]string{"error": err.Error()}})
+	}
+
+	o.events.Write(append(line, '\n'))
+}
+
+// Writes an error event
+func (o *Output) Error(err error) {
+	o.Event("error", map[string]string{"error": err.Error()}, err.Error()+"\n")
+}
+
+// Writes part of the ASCII art
+func (o *Output) Art(s string) {
+	defer o.m.Unlock()
+
+	o.m.Lock()
+	fmt.Fprint(o.art, s)
+}
+
+// Closes the art file, if there is one
+func (o *Output) Close() error {
+	if o.artFile != nil {
+		return o.artFile.Close()
+	}
+
+	return nil
+}
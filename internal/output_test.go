@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Test that only the known output formats are accepted
+func TestNewOutput(t *testing.T) {
+	_, err := NewOutput("xml", "")
+	assert.Error(t, err)
+}
+
+// Test that text output only writes the text of each event, skipping events without any
+func TestOutput_EventText(t *testing.T) {
+	var events, art bytes.Buffer
+	o := &Output{format: OutputText, events: &events, art: &art}
+
+	o.Event("series_start", map[string]string{"message_series_id": "abc"}, "")
+	o.Event("stats", map[string]int{"received": 3}, "Total Messages: 3\n")
+	o.Art("@")
+
+	assert.Equal(t, "Total Messages: 3\n", events.String())
+	assert.Equal(t, "@", art.String())
+}
+
+// Test that JSON output writes every event and error as a line of JSON, keeping the art separate
+func TestOutput_EventJSON(t *testing.T) {
+	var events, art bytes.Buffer
+	o := &Output{format: OutputJSON, events: &events, art: &art}
+
+	o.Event("stats", map[string]int{"received": 3}, "Total Messages: 3\n")
+	o.Error(errors.New("boom"))
+	o.Art("@")
+
+	lines := bytes.Split(bytes.TrimSpace(events.Bytes()), []byte("\n"))
+	assert.Len(t, lines, 2)
+
+	var e struct {
+		Event string
+		Data  map[string]interface{}
+	}
+
+	assert.NoError(t, json.Unmarshal(lines[0], &e))
+	assert.Equal(t, "stats", e.Event)
+	assert.Equal(t, float64(3), e.Data["received"])
+
+	assert.NoError(t, json.Unmarshal(lines[1], &e))
+	assert.Equal(t, "error", e.Event)
+	assert.Equal(t, "boom", e.Data["error"])
+
+	assert.Equal(t, "@", art.String())
+}
+
+// Test that the stats and verification results are written with snake_case keys, including those of embedded structs
+func TestOutput_EventJSONKeys(t *testing.T) {
+	var events bytes.Buffer
+	o := &Output{format: OutputJSON, events: &events, art: &bytes.Buffer{}}
+
+	o.Event("stats", ConsumerStats{AcksSent: 2, SequenceStats: SequenceStats{OutOfOrder: 1}}, "")
+	o.Event("verification", VerificationResult{MessageSeriesId: "abc", EndReceived: true}, "")
+
+	lines := bytes.Split(bytes.TrimSpace(events.Bytes()), []byte("\n"))
+	assert.Len(t, lines, 2)
+
+	var e struct {
+		Data map[string]interface{}
+	}
+
+	assert.NoError(t, json.Unmarshal(lines[0], &e))
+	assert.Equal(t, float64(2), e.Data["acks_sent"])
+	assert.Equal(t, float64(1), e.Data["out_of_order"])
+	assert.Contains(t, e.Data, "lateness")
+
+	assert.NoError(t, json.Unmarshal(lines[1], &e))
+	assert.Equal(t, "abc", e.Data["message_series_id"])
+	assert.Equal(t, true, e.Data["end_received"])
+}
@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	// Partition by the row of the image the message belongs to
+	PartitionKeyRow string = "row"
+	// Partition by MessageId mod the number of partitions
+	PartitionKeyId string = "id"
+	// Partition by the MessageSeriesId, keeping each image on a single partition
+	PartitionKeySeries string = "series"
+)
+
+// Returns the subject for the given partition of a subject
+func PartitionSubject(subject string, partition int) string {
+	return fmt.Sprintf("%s.%d", subject, partition)
+}
+
+// Decides which partition each message of a series is published to
+type Partitioner struct {
+	count int
+	key   string
+}
+
+// Creates a Partitioner for `count` partitions using the given key
+func NewPartitioner(count int, key string) (*Partitioner, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("invalid number of partitions: %d", count)
+	}
+
+	switch key {
+	case PartitionKeyRow, PartitionKeyId, PartitionKeySeries:
+		return &Partitioner{count: count, key: key}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported partition key %q - allows 'row', 'id' or 'series'", key)
+}
+
+// Returns the partition for the message at `pos` in the series
+func (pt *Partitioner) Partition(s series, pos int) int {
+	switch pt.key {
+	case PartitionKeyRow:
+		return s.rows[pos] % pt.count
+	case PartitionKeySeries:
+		h := fnv.New32a()
+		h.Write([]byte(s.id))
+		return int(h.Sum32() % uint32(pt.count))
+	}
+
+	return pos % pt.count
+}
+
+// Returns the row of the image each message starts on, based on the newlines in the messages before it
+func seriesRows(messages []string) []int {
+	rows := make([]int, len(messages))
+
+	var row int
+	for i, body := range messages {
+		rows[i] = row
+
+		for _, c := range body {
+			if c == '\n' {
+				row++
+			}
+		}
+	}
+
+	return rows
+}
+
+// Merges messages received from several partitions back into MessageId order.
+//
+// Each partition has its own buffer, and a message is only released once every message of its series before it has
+// been released - regardless of which partition it arrived on.
+type PartitionMerger struct {
+	m       sync.Mutex
+	buffers []map[string]map[int]Message
+	next    map[string]int
+	updated time.Time
+	skipped int
+
+	// Series whose End message has been released, which are no longer buffered - remembered so that any of their
+	// messages redelivered later are ignored
+	finished *dedupWindow
+
+	// Held while sending released messages, so they're sent in order without holding `m` - which would block reading
+	// the stats while nothing is reading the merged messages
+	send sync.Mutex
+	out  chan Message
+
+	// Closed to stop skipping stalled messages, and to give up sending any that are released
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Creates a PartitionMerger for `count` partitions
+func NewPartitionMerger(count int) *PartitionMerger {
+	pm := &PartitionMerger{
+		out:      make(chan Message),
+		done:     make(chan struct{}),
+		buffers:  make([]map[string]map[int]Message, count),
+		next:     map[string]int{},
+		updated:  time.Now(),
+		finished: newDedupWindow(DefaultMergedSeriesWindow),
+	}
+
+	for i := range pm.buffers {
+		pm.buffers[i] = map[string]map[int]Message{}
+	}
+
+	return pm
+}
+
+// Adds a message received on the given partition, releasing any messages that are now in order
+func (pm *PartitionMerger) Add(partition int, msg Message) error {
+	defer pm.send.Unlock()
+
+	pm.send.Lock()
+	released, err := pm.add(partition, msg)
+	if err != nil {
+		return err
+	}
+
+	pm.emit(released)
+
+	return nil
+}
+
+// Buffers the message, returning the messages which are now in order
+func (pm *PartitionMerger) add(partition int, msg Message) ([]Message, error) {
+	defer pm.m.Unlock()
+
+	pm.m.Lock()
+	if partition < 0 || partition >= len(pm.buffers) {
+		return nil, fmt.Errorf("unknown partition %d", partition)
+	}
+
+	// Anything before the next expected MessageId, or of a series which has ended, has already been released
+	if msg.MessageId < pm.next[msg.MessageSeriesId] || pm.finished.Seen(msg.MessageSeriesId) {
+		return nil, nil
+	}
+
+	buffer, ok := pm.buffers[partition][msg.MessageSeriesId]
+	if !ok {
+		buffer = map[int]Message{}
+		pm.buffers[partition][msg.MessageSeriesId] = buffer
+	}
+	buffer[msg.MessageId] = msg
+
+	return pm.release(msg.MessageSeriesId, nil), nil
+}
+
+// Removes messages of the series from the partition buffers, in order, for as long as the next one is found in any of
+// them - appending them to `released`
+func (pm *PartitionMerger) release(seriesId string, released []Message) []Message {
+	for {
+		next := pm.next[seriesId]
+		found := false
+
+		for _, series := range pm.buffers {
+			if msg, ok := series[seriesId][next]; ok {
+				delete(series[seriesId], next)
+				released = append(released, msg)
+				pm.next[seriesId] = next + 1
+				pm.updated = time.Now()
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return released
+		}
+
+		if released[len(released)-1].End {
+			pm.forget(seriesId)
+			return released
+		}
+	}
+}
+
+// Stops buffering a series once its End message has been released, only remembering that it has finished
+func (pm *PartitionMerger) forget(seriesId string) {
+	delete(pm.next, seriesId)
+	for _, series := range pm.buffers {
+		delete(series, seriesId)
+	}
+
+	pm.finished.Add(seriesId)
+}
+
+// Sends the released messages to the merged channel, unless the merger is closed first
+func (pm *PartitionMerger) emit(released []Message) {
+	for _, msg := range released {
+		select {
+		case pm.out <- msg:
+		case <-pm.done:
+			return
+		}
+	}
+}
+
+// Skips ahead to the lowest buffered MessageId of each series when nothing has been released for `gap` - either a
+// message was lost, or we joined part way through a series.
+func (pm *PartitionMerger) skipStalled(gap time.Duration) {
+	defer pm.send.Unlock()
+
+	pm.send.Lock()
+	pm.emit(pm.skip(gap))
+}
+
+// Moves past the missing messages of each stalled series, returning the messages which are now in order
+func (pm *PartitionMerger) skip(gap time.Duration) []Message {
+	defer pm.m.Unlock()
+
+	pm.m.Lock()
+	if time.Since(pm.updated) < gap {
+		return nil
+	}
+
+	lowest := map[string]int{}
+	for _, series := range pm.buffers {
+		for seriesId, buffer := range series {
+			for id := range buffer {
+				if l, ok := lowest[seriesId]; !ok || id < l {
+					lowest[seriesId] = id
+				}
+			}
+		}
+	}
+
+	var released []Message
+	for seriesId, id := range lowest {
+		pm.skipped += id - pm.next[seriesId]
+		pm.next[seriesId] = id
+		released = pm.release(seriesId, released)
+	}
+
+	return released
+}
+
+// Returns how many messages have been skipped over since they never arrived
+func (pm *PartitionMerger) Skipped() int {
+	defer pm.m.Unlock()
+
+	pm.m.Lock()
+	return pm.skipped
+}
+
+// Returns the channel that merged messages are written to, skipping past any message that hasn't arrived within `gap`
+// until the merger is closed
+func (pm *PartitionMerger) Consume(gap time.Duration) chan Message {
+	go func() {
+		ticker := time.NewTicker(gap / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pm.skipStalled(gap)
+			case <-pm.done:
+				return
+			}
+		}
+	}()
+
+	return pm.out
+}
+
+// Stops skipping stalled messages, and drops any released messages still waiting to be read from the merged channel
+func (pm *PartitionMerger) Close() {
+	pm.closeOnce.Do(func() { close(pm.done) })
+}
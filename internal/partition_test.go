@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that each partition key assigns messages as expected
+func TestPartitioner_Partition(t *testing.T) {
+	s := makeSeries("abc", []string{"a", "b", "\n", "c", "d", "\n", "e"})
+
+	byId, _ := NewPartitioner(2, PartitionKeyId)
+	assert.Equal(t, 0, byId.Partition(s, 0))
+	assert.Equal(t, 1, byId.Partition(s, 3))
+
+	byRow, _ := NewPartitioner(2, PartitionKeyRow)
+	assert.Equal(t, 0, byRow.Partition(s, 2), "the newline belongs to the row it ends")
+	assert.Equal(t, 1, byRow.Partition(s, 3))
+	assert.Equal(t, 0, byRow.Partition(s, 6))
+
+	bySeries, _ := NewPartitioner(4, PartitionKeySeries)
+	assert.Equal(t, bySeries.Partition(s, 0), bySeries.Partition(s, 6))
+
+	_, err := NewPartitioner(2, "random")
+	assert.Error(t, err)
+}
+
+// Test that messages arriving across partitions in any order are merged back into MessageId order
+func TestPartitionMerger_Merges(t *testing.T) {
+	pm := NewPartitionMerger(2)
+	ch := pm.Consume(time.Second)
+
+	go func() {
+		_ = pm.Add(1, Message{MessageSeriesId: "abc", MessageId: 1})
+		_ = pm.Add(1, Message{MessageSeriesId: "abc", MessageId: 3})
+		_ = pm.Add(0, Message{MessageSeriesId: "abc", MessageId: 0})
+		_ = pm.Add(0, Message{MessageSeriesId: "abc", MessageId: 2})
+	}()
+
+	timeout := time.After(100 * time.Millisecond)
+
+	var results []int
+	for len(results) < 4 {
+		select {
+		case msg := <-ch:
+			results = append(results, msg.MessageId)
+		case <-timeout:
+			t.Fatal("timeout reached - failed to merge messages!")
+		}
+	}
+
+	assert.Equal(t, []int{0, 1, 2, 3}, results)
+}
+
+// Test that a series is forgotten once its End message is released, ignoring any of its messages redelivered after
+func TestPartitionMerger_ForgetsEndedSeries(t *testing.T) {
+	pm := NewPartitionMerger(2)
+	ch := pm.Consume(time.Second)
+
+	go func() {
+		_ = pm.Add(1, Message{MessageSeriesId: "abc", MessageId: 1, End: true})
+		_ = pm.Add(0, Message{MessageSeriesId: "abc", MessageId: 0})
+		_ = pm.Add(0, Message{MessageSeriesId: "abc", MessageId: 0})
+	}()
+
+	for id := 0; id < 2; id++ {
+		select {
+		case msg := <-ch:
+			assert.Equal(t, id, msg.MessageId)
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("timeout reached - failed to merge messages!")
+		}
+	}
+
+	select {
+	case msg := <-ch:
+		t.Fatalf("the redelivered message %d was released again", msg.MessageId)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	defer pm.m.Unlock()
+
+	pm.m.Lock()
+	assert.Empty(t, pm.next)
+	for _, series := range pm.buffers {
+		assert.Empty(t, series)
+	}
+}
+
+// Test that the merger skips past a message which never arrives
+func TestPartitionMerger_SkipsStalled(t *testing.T) {
+	pm := NewPartitionMerger(2)
+	ch := pm.Consume(5 * time.Millisecond)
+
+	go func() { _ = pm.Add(1, Message{MessageSeriesId: "abc", MessageId: 1}) }()
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, 1, msg.MessageId)
+		assert.Equal(t, 1, pm.Skipped())
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout reached - merger never skipped the missing message!")
+	}
+}
+
+// Test that the stats can be read while released messages are waiting for a reader
+func TestPartitionMerger_SkippedWhileBlocked(t *testing.T) {
+	pm := NewPartitionMerger(2)
+	pm.Consume(time.Second)
+	defer pm.Close()
+
+	go func() { _ = pm.Add(0, Message{MessageSeriesId: "abc", MessageId: 0}) }()
+
+	skipped := make(chan int)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		skipped <- pm.Skipped()
+	}()
+
+	select {
+	case n := <-skipped:
+		assert.Equal(t, 0, n)
+	case <-time.After(time.Second):
+		t.Fatal("timeout reached - reading the stats blocked on sending a message!")
+	}
+}
+
+// Test that closing the merger stops any Add waiting to send a released message
+func TestPartitionMerger_Close(t *testing.T) {
+	pm := NewPartitionMerger(1)
+	pm.Consume(time.Second)
+
+	added := make(chan error)
+	go func() { added <- pm.Add(0, Message{MessageSeriesId: "abc", MessageId: 0}) }()
+
+	time.Sleep(10 * time.Millisecond)
+	pm.Close()
+	pm.Close()
+
+	select {
+	case err := <-added:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("timeout reached - closing never stopped the blocked Add!")
+	}
+}
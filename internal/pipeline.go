@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/imdario/mergo"
+	"github.com/nats-io/stan.go"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PipelineOptions struct {
+	// Connection Info
+	Cluster          string
+	ClientId         string
+	ConnectionString string
+	NoRandomize      bool
+	ConnectionAuth
+
+	// The subject the first stage subscribes to, and the subject the last stage publishes to
+	Subject       string
+	OutputSubject string
+	// The transform spec of each stage, in order
+	Stages      []string
+	AckWait     int
+	MaxInFlight int
+}
+
+// Basic stats on the messages passing through a Stage
+type StageStats struct {
+	// How many messages were received from the previous stage
+	Received int
+	// How many messages were published to the next stage
+	Published int
+	// How many messages failed to publish, and so were left for redelivery
+	Errors int
+
+	// End-to-end latency, from when the producer published a message to when it reached this stage
+	latencyTotal time.Duration
+	latencyCount int
+	LatencyMax   time.Duration
+}
+
+// Return the average end-to-end latency of messages reaching the stage
+func (s *StageStats) GetAverageLatency() time.Duration {
+	if s.latencyCount == 0 {
+		return 0
+	}
+
+	return (s.latencyTotal / time.Duration(s.latencyCount)).Round(time.Microsecond)
+}
+
+// A single stage of a Pipeline - subscribes to one subject, transforms the messages and publishes them to the next
+type Stage struct {
+	NatsClient
+	Name   string
+	Input  string
+	Output string
+
+	transform   Transform
+	sub         stan.Subscription
+	ackWait     time.Duration
+	maxInFlight int
+
+	m      sync.Mutex
+	stats  StageStats
+	bodies map[string]map[int]string
+
+	// Inbound messages are only acknowledged once their results are published, so state for holding them is only
+	// accessed from the subscription handler:
+	//  - `holding` are held by the transform until it has more messages
+	//  - `publishing` are waiting for their results in `pending` to be published, after a publish failed
+	//  - `last` is the sequence of the last message given to the transform, so redeliveries aren't given to it again
+	holding    []*stan.Msg
+	publishing []*stan.Msg
+	pending    []Message
+	last       uint64
+}
+
+// Creates a Stage from a transform spec
+func NewStage(spec string, input string, output string) (*Stage, error) {
+	transform, err := NewTransform(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stage{
+		Name:      spec,
+		Input:     input,
+		Output:    output,
+		transform: transform,
+		bodies:    map[string]map[int]string{},
+	}, nil
+}
+
+// Subscribes to the input subject.
+//
+// Transforms such as mirror rely on seeing messages in order, which STAN delivers them in aside from redeliveries - and
+// messages are only redelivered once they've been given to the transform. So the stage can have as many messages in
+// flight as a transform holds at once, until it holds MaxInFlight of them.
+func (s *Stage) Subscribe() error {
+	if s.Conn == nil {
+		return errors.New("subscription failed, no stan connection")
+	}
+
+	sub, err := s.Conn.Subscribe(s.Input, s.handle,
+		stan.MaxInflight(s.maxInFlight),
+		stan.AckWait(s.ackWait),
+		stan.SetManualAckMode(),
+		stan.StartAtTime(time.Now()),
+	)
+
+	if err != nil {
+		return fmt.Errorf("stage %s failed to subscribe to %s: %v", s.Name, s.Input, err)
+	}
+
+	s.sub = sub
+
+	return nil
+}
+
+// Transforms the message and publishes the results, only acknowledging it once they've been published - including
+// while the transform holds it to publish along with later messages
+func (s *Stage) handle(m *stan.Msg) {
+	// The transform has already seen the message, so it's either held, waiting on a failed publish or already done
+	if m.Sequence <= s.last {
+		if containsMsg(s.publishing, m.Sequence) {
+			s.flush()
+		} else if !containsMsg(s.holding, m.Sequence) {
+			_ = m.Ack()
+		}
+
+		return
+	}
+
+	s.last = m.Sequence
+
+	var msg Message
+	if err := json.Unmarshal(m.Data, &msg); err != nil {
+		_ = m.Ack()
+		return
+	}
+
+	if err := msg.Decompress(); err != nil {
+		_ = m.Ack()
+		return
+	}
+
+	s.update(func(stats *StageStats) {
+		stats.Received++
+
+		if msg.Timestamp > 0 {
+			latency := time.Since(time.Unix(0, msg.Timestamp))
+			stats.latencyTotal += latency
+			stats.latencyCount++
+
+			if latency > stats.LatencyMax {
+				stats.LatencyMax = latency
+			}
+		}
+	})
+
+	s.holding = append(s.holding, m)
+
+	results := s.transform(msg)
+	if len(results) == 0 {
+		// STAN stops delivering once MaxInFlight messages are unacknowledged, so holding that many would wait forever.
+		// The transform has its own copy of them, so they're acknowledged instead - at the cost of losing them if the
+		// stage stops before their results are published.
+		if len(s.holding) >= s.maxInFlight {
+			for _, h := range s.holding {
+				_ = h.Ack()
+			}
+
+			s.holding = nil
+		}
+
+		return
+	}
+
+	// The results cover every message the transform was holding
+	for i := range results {
+		s.seal(&results[i])
+	}
+
+	s.publishing = append(s.publishing, s.holding...)
+	s.holding = nil
+	s.pending = append(s.pending, results...)
+
+	s.flush()
+}
+
+// Publishes the pending results in order, then acknowledges the messages they came from. If a publish fails, the rest
+// are left pending - and the messages unacknowledged - to try again once one of them is redelivered.
+func (s *Stage) flush() {
+	for len(s.pending) > 0 {
+		data, err := json.Marshal(s.pending[0])
+		if err == nil {
+			err = s.Conn.Publish(s.Output, data)
+		}
+
+		if err != nil {
+			s.update(func(stats *StageStats) { stats.Errors++ })
+			return
+		}
+
+		s.pending = s.pending[1:]
+		s.update(func(stats *StageStats) { stats.Published++ })
+	}
+
+	for _, m := range s.publishing {
+		_ = m.Ack()
+	}
+
+	s.publishing = nil
+}
+
+// Whether the messages include the given sequence
+func containsMsg(msgs []*stan.Msg, sequence uint64) bool {
+	for _, m := range msgs {
+		if m.Sequence == sequence {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Recalculates the checksum of a transformed message, and the series digest once its End message is reached
+func (s *Stage) seal(msg *Message) {
+	msg.Checksum = Checksum(msg.Body)
+
+	bodies, ok := s.bodies[msg.MessageSeriesId]
+	if !ok {
+		bodies = map[int]string{}
+		s.bodies[msg.MessageSeriesId] = bodies
+	}
+	bodies[msg.MessageId] = msg.Body
+
+	if !msg.End {
+		return
+	}
+
+	delete(s.bodies, msg.MessageSeriesId)
+
+	// The digest can only be recalculated if this stage saw the whole series - otherwise, it no longer applies
+	msg.Digest = ""
+
+	ordered := make([]string, 0, msg.MessageId+1)
+	for id := 0; id <= msg.MessageId; id++ {
+		body, ok := bodies[id]
+		if !ok {
+			return
+		}
+
+		ordered = append(ordered, body)
+	}
+
+	msg.Digest = SeriesDigest(ordered)
+}
+
+// Safely updates the stats
+func (s *Stage) update(fn func(stats *StageStats)) {
+	defer s.m.Unlock()
+
+	s.m.Lock()
+	fn(&s.stats)
+}
+
+// Return the StageStats for the stage
+func (s *Stage) GetStageStats() StageStats {
+	defer s.m.Unlock()
+
+	s.m.Lock()
+	return s.stats
+}
+
+// Closes the subscription and connection of the stage
+func (s *Stage) End() error {
+	if s.sub != nil {
+		if err := s.sub.Close(); err != nil && err != stan.ErrConnectionClosed {
+			return fmt.Errorf("error closing subscription for stage %s: %v", s.Name, err)
+		}
+	}
+
+	if err := s.Close(); err != nil && err != stan.ErrConnectionClosed {
+		return fmt.Errorf("error closing connection for stage %s: %v", s.Name, err)
+	}
+
+	return nil
+}
+
+// Returns the subject the given stage of a pipeline publishes to, for the next stage - named apart from the partitions
+// of the subject
+func StageSubject(subject string, stage int) string {
+	return fmt.Sprintf("%s.stage%d", subject, stage)
+}
+
+// A chain of Stages, each subscribing to the output of the one before it
+type Pipeline struct {
+	options PipelineOptions
+	stages  []*Stage
+}
+
+// Set the options for the Pipeline, creating each of its Stages
+func (p *Pipeline) SetOptions(opts PipelineOptions) error {
+
+	// Set Default Values
+	d := PipelineOptions{
+		Subject:     DefaultSubject,
+		AckWait:     10,
+		MaxInFlight: DefaultMaxAcksInFlight,
+	}
+
+	if err := mergo.Merge(&d, opts, mergo.WithOverride); err != nil {
+		return err
+	}
+
+	if d.OutputSubject == "" {
+		d.OutputSubject = d.Subject + ".out"
+	}
+
+	// Each stage has its own client ID based on this, so every pipeline's needs to differ
+	if d.ClientId == "" {
+		d.ClientId = GenerateClientId(DefaultPipelineClientId, "")
+	}
+
+	if len(d.Stages) == 0 {
+		return errors.New("at least one stage must be specified with `-stages`")
+	}
+
+	p.stages = nil
+
+	input := d.Subject
+	for i, spec := range d.Stages {
+		spec = strings.TrimSpace(spec)
+
+		output := d.OutputSubject
+		if i < len(d.Stages)-1 {
+			output = StageSubject(d.Subject, i+1)
+		}
+
+		stage, err := NewStage(spec, input, output)
+		if err != nil {
+			return err
+		}
+
+		stage.ackWait = time.Duration(d.AckWait) * time.Second
+		stage.maxInFlight = d.MaxInFlight
+		stage.SetConnection(ConnectionInfo{
+			Cluster:          d.Cluster,
+			ClientId:         fmt.Sprintf("%s-%d", d.ClientId, i+1),
+			ConnectionString: d.ConnectionString,
+			NoRandomize:      d.NoRandomize,
+			Subject:          input,
+			ConnectionAuth:   d.ConnectionAuth,
+		})
+
+		p.stages = append(p.stages, stage)
+		input = output
+	}
+
+	p.options = d
+
+	return nil
+}
+
+// Returns the currently set options
+func (p *Pipeline) GetOptions() PipelineOptions {
+	return p.options
+}
+
+// Returns the stages of the pipeline, in order
+func (p *Pipeline) GetStages() []*Stage {
+	return p.stages
+}
+
+// Connects and subscribes every stage, starting from the last so that no stage publishes before the next is listening
+func (p *Pipeline) Start() error {
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		if err := p.stages[i].Connect(); err != nil {
+			return err
+		}
+
+		if err := p.stages[i].Subscribe(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Ends every stage, starting from the first
+func (p *Pipeline) End() error {
+	var errs []error
+	for _, stage := range p.stages {
+		if err := stage.End(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Connects a stage for the transform to the embedded server, counting the redeliveries it receives
+func startTestStage(t *testing.T, server *EmbeddedServer, spec string, input string, output string,
+	maxInFlight int) (*Stage, func() int) {
+	s, err := NewStage(spec, input, output)
+	assert.NoError(t, err)
+
+	s.SetOutput(discardOutput)
+	s.ackWait = time.Second
+	s.maxInFlight = maxInFlight
+	s.SetConnection(ConnectionInfo{
+		Cluster:          server.ClusterId(),
+		ClientId:         "test-stage",
+		ConnectionString: server.URL(),
+		Subject:          input,
+	})
+	assert.NoError(t, s.Connect())
+
+	var m sync.Mutex
+	redelivered := 0
+
+	sub, err := s.Conn.Subscribe(input, func(msg *stan.Msg) {
+		if msg.Redelivered {
+			m.Lock()
+			redelivered++
+			m.Unlock()
+		}
+
+		s.handle(msg)
+	}, stan.MaxInflight(s.maxInFlight), stan.AckWait(s.ackWait), stan.SetManualAckMode())
+	assert.NoError(t, err)
+	s.sub = sub
+
+	return s, func() int {
+		defer m.Unlock()
+
+		m.Lock()
+		return redelivered
+	}
+}
+
+// Test that mirror's held messages are only acknowledged once the row they belong to is published
+func TestStage_AcksHeldMessagesOncePublished(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	sc := connectTestServer(t, server, "test-publisher")
+	defer sc.Close()
+
+	received := make(chan Message, 10)
+	_, err := sc.Subscribe("mirrored", func(m *stan.Msg) {
+		var msg Message
+		_ = json.Unmarshal(m.Data, &msg)
+		received <- msg
+	})
+	assert.NoError(t, err)
+
+	s, redelivered := startTestStage(t, server, "mirror", "unmirrored", "mirrored", DefaultMaxAcksInFlight)
+	defer s.End()
+
+	publishMessages(t, sc, "unmirrored", Message{MessageSeriesId: "abc", MessageId: 0, Body: "ab"})
+
+	// Held past its AckWait, so it's redelivered - without being given to the transform again
+	assert.Eventually(t, func() bool { return redelivered() > 0 }, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 1, s.GetStageStats().Received)
+	assert.Empty(t, received)
+
+	publishMessages(t, sc, "unmirrored", Message{MessageSeriesId: "abc", MessageId: 1, Body: "c\n", End: true})
+
+	var bodies []string
+	for len(bodies) < 2 {
+		select {
+		case msg := <-received:
+			assert.Equal(t, Checksum(msg.Body), msg.Checksum)
+			bodies = append(bodies, msg.Body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout reached - the mirrored row was never published!")
+		}
+	}
+
+	assert.Equal(t, []string{"cb", "a\n"}, bodies)
+
+	// Both messages are acknowledged, so neither is redelivered again
+	before := redelivered()
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, before, redelivered())
+	assert.Empty(t, received, "the row should only be published once")
+
+	stats := s.GetStageStats()
+	assert.Equal(t, 2, stats.Received)
+	assert.Equal(t, 2, stats.Published)
+}
+
+// Test that a row longer than the stage's MaxInFlight is acknowledged as it's held, rather than waiting forever for the
+// rest of the row
+func TestStage_AcksHeldMessagesPastMaxInFlight(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	sc := connectTestServer(t, server, "test-publisher")
+	defer sc.Close()
+
+	mirrored := make(chan string, 10)
+	_, err := sc.Subscribe("mirrored", func(m *stan.Msg) {
+		var msg Message
+		_ = json.Unmarshal(m.Data, &msg)
+		mirrored <- msg.Body
+	})
+	assert.NoError(t, err)
+
+	s, _ := startTestStage(t, server, "mirror", "unmirrored", "mirrored", 2)
+	defer s.End()
+
+	publishMessages(t, sc, "unmirrored",
+		Message{MessageSeriesId: "abc", MessageId: 0, Body: "a"},
+		Message{MessageSeriesId: "abc", MessageId: 1, Body: "b"},
+		Message{MessageSeriesId: "abc", MessageId: 2, Body: "c"},
+		Message{MessageSeriesId: "abc", MessageId: 3, Body: "d\n", End: true},
+	)
+
+	var bodies []string
+	for len(bodies) < 4 {
+		select {
+		case body := <-mirrored:
+			bodies = append(bodies, body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout reached - the mirrored row was never published!")
+		}
+	}
+
+	assert.Equal(t, []string{"d", "c", "b", "a\n"}, bodies)
+	assert.Equal(t, 4, s.GetStageStats().Published)
+}
+
+// Test that a failed publish leaves the message unacknowledged, and is retried - without transforming it again - when
+// the message is redelivered
+func TestStage_RetriesFailedPublish(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	sc := connectTestServer(t, server, "test-publisher")
+	defer sc.Close()
+
+	// STAN refuses to publish to a wildcard subject
+	s, redelivered := startTestStage(t, server, "upper", "lower", "upper.*", DefaultMaxAcksInFlight)
+	defer s.End()
+
+	publishMessages(t, sc, "lower", Message{MessageSeriesId: "abc", MessageId: 0, Body: "a"})
+
+	assert.Eventually(t, func() bool { return redelivered() > 0 && s.GetStageStats().Errors > 1 }, 5*time.Second,
+		50*time.Millisecond)
+
+	stats := s.GetStageStats()
+	assert.Equal(t, 1, stats.Received)
+	assert.Equal(t, 0, stats.Published)
+}
+
+// Test that a series passes through every stage of the pipeline and still verifies at the end
+func TestPipeline_Start(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	p := &Pipeline{}
+	assert.NoError(t, p.SetOptions(PipelineOptions{
+		Cluster:          server.ClusterId(),
+		ConnectionString: server.URL(),
+		Subject:          "piped",
+		Stages:           []string{"invert", " mirror"},
+	}))
+
+	stages := p.GetStages()
+	assert.Len(t, stages, 2)
+	assert.Equal(t, "piped.stage1", stages[0].Output)
+	assert.Equal(t, "piped.stage1", stages[1].Input)
+	assert.Equal(t, "piped.out", stages[1].Output)
+
+	for _, s := range stages {
+		s.SetOutput(discardOutput)
+	}
+
+	assert.NoError(t, p.Start())
+	defer p.End()
+
+	sc := connectTestServer(t, server, "test-publisher")
+	defer sc.Close()
+
+	verifier := SeriesVerifier{}
+	done := make(chan struct{})
+	_, err := sc.Subscribe("piped.out", func(m *stan.Msg) {
+		var msg Message
+		_ = json.Unmarshal(m.Data, &msg)
+		verifier.Add(msg)
+
+		if msg.End {
+			close(done)
+		}
+	})
+	assert.NoError(t, err)
+
+	bodies := []string{"@.", "\n", ".@", "@\n"}
+	for id, body := range bodies {
+		msg := Message{MessageSeriesId: "abc", MessageId: id, Body: body, Checksum: Checksum(body)}
+		if id == len(bodies)-1 {
+			msg.End = true
+			msg.Digest = SeriesDigest(bodies)
+		}
+
+		publishMessages(t, sc, "piped", msg)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout reached - the series never reached the end of the pipeline!")
+	}
+
+	result := verifier.Verify("abc")
+	assert.Equal(t, 4, result.Received)
+	assert.Empty(t, result.Corrupt)
+	assert.NotEmpty(t, result.Digest)
+	assert.True(t, result.Match())
+
+	assert.Equal(t, 4, stages[0].GetStageStats().Published)
+	assert.Equal(t, 4, stages[1].GetStageStats().Published)
+}
+
+// Test that a pipeline needs at least one valid stage, and generates client IDs for its stages by default
+func TestPipeline_SetOptions(t *testing.T) {
+	p := &Pipeline{}
+	assert.NoError(t, p.SetOptions(PipelineOptions{Stages: []string{"invert", "upper"}}))
+	assert.Equal(t, GenerateClientId(DefaultPipelineClientId, ""), p.GetOptions().ClientId)
+	assert.Equal(t, p.GetOptions().ClientId+"-2", p.GetStages()[1].conn.ClientId)
+
+	assert.Error(t, p.SetOptions(PipelineOptions{}))
+	assert.Error(t, p.SetOptions(PipelineOptions{Stages: []string{"rotate"}}))
+}
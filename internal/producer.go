@@ -1,10 +1,12 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/imdario/mergo"
+	"github.com/nats-io/stan.go"
 	"github.com/nu7hatch/gouuid"
 	"github.com/qeesung/image2ascii/convert"
 	"image"
@@ -12,7 +14,9 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -22,15 +26,66 @@ type ProducerOptions struct {
 	Cluster          string `json:"cluster,omitempty"`
 	ClientId         string `json:"client_id,omitempty"`
 	ConnectionString string `json:"connection_string,omitempty"`
+	NoRandomize      bool   `json:"no_randomize,omitempty"`
+	ConnectionAuth
+
+	// Without a ClientId, one is generated from the prefix - and connecting retries this many times with a numbered
+	// suffix while the ClientId is already in use
+	ClientIdPrefix  string `json:"client_id_prefix,omitempty"`
+	ClientIdRetries int    `json:"client_id_retries,omitempty"`
 
 	// Publishing
 	Subject         string        `json:"subject,omitempty"`
 	MaxInFlightAcks int           `json:"inflight,omitempty"`
-	PublishDelay    time.Duration `json:"delay, omitempty"`
+	PublishDelay    time.Duration `json:"delay,omitempty"`
 	DrainTimeout    time.Duration `json:"drain_timeout,omitempty"`
 	BatchSize       int           `json:"batch_size,omitempty"`
 	Sync            bool          `json:"sync,omitempty"`
 
+	// Rate Limiting
+	RateLimit     float64       `json:"rate,omitempty"`
+	ByteRateLimit float64       `json:"byte_rate,omitempty"`
+	Burst         int           `json:"burst,omitempty"`
+	RampProfile   string        `json:"ramp,omitempty"`
+	RampPeriod    time.Duration `json:"ramp_period,omitempty"`
+
+	// Retrying failed publishes
+	AckTimeout      time.Duration `json:"ack_timeout,omitempty"`
+	MaxAttempts     int           `json:"max_attempts,omitempty"`
+	RetryBackoff    time.Duration `json:"retry_backoff,omitempty"`
+	RetryMaxBackoff time.Duration `json:"retry_max_backoff,omitempty"`
+
+	// Partitioning
+	Partitions   int    `json:"partitions,omitempty"`
+	PartitionKey string `json:"partition_key,omitempty"`
+
+	// Processing Receipts
+	Receipts       int           `json:"receipts,omitempty"`
+	ReceiptTimeout time.Duration `json:"receipt_timeout,omitempty"`
+
+	// Checkpointing, saved every CheckpointInterval as messages are acknowledged as well as when closing
+	CheckpointFile     string        `json:"checkpoint,omitempty"`
+	CheckpointInterval time.Duration `json:"checkpoint_interval,omitempty"`
+	Resume             bool          `json:"resume,omitempty"`
+
+	// Concurrent Publishers
+	Publishers    int    `json:"publishers,omitempty"`
+	PublisherMode string `json:"publisher_mode,omitempty"`
+
+	// Compression
+	Compression       string `json:"compression,omitempty"`
+	CompressThreshold int    `json:"compress_threshold,omitempty"`
+
+	// Connection loss detection, and reconnecting once lost
+	PingInterval  int           `json:"ping_interval,omitempty"`
+	PingMaxOut    int           `json:"ping_max_out,omitempty"`
+	ReconnectWait time.Duration `json:"reconnect_wait,omitempty"`
+	MaxReconnects int           `json:"max_reconnects,omitempty"`
+
+	// Output format, and where the ASCII art goes when it isn't text
+	Output  string `json:"output,omitempty"`
+	ArtFile string `json:"art_file,omitempty"`
+
 	// File Inputs
 	LocalFile      string  `json:"local_file,omitempty"`
 	RemoteFile     string  `json:"remote_file"`
@@ -43,30 +98,84 @@ type ProducerStats struct {
 	start time.Time
 	// End Time
 	end time.Time
-	// How messages were sent
+	// How messages were sent, not counting those which permanently failed to publish
 	MessagesSent int
 	// Total Acks received back
 	AcksReceived int
+	// Total publishes retried after failing or timing out
+	Retries int
+	// Total messages that failed to publish after MaxAttempts
+	PermanentFailures int
+	// The MessageIds of the messages that failed to publish
+	FailedMessageIds []int
+	// Total bytes the published messages would have been without compression
+	RawBytes int
+	// Total bytes actually published
+	BytesSent int
+	// How many messages were sent compressed
+	CompressedMessages int
+	// The target rate of messages and bytes per second, when rate limited
+	TargetRate     float64
+	TargetByteRate float64
 }
 
 type Producer struct {
 	NatsClient
-	options ProducerOptions
-	stats   ProducerStats
+	options     ProducerOptions
+	limiter     *RateLimiter
+	backoff     Backoff
+	partitioner *Partitioner
+
+	// Tracks acks of the current series, for checkpointing
+	current     series
+	tracker     *ackTracker
+	interrupted bool
+
+	// Closed to stop saving the checkpoint periodically, which then closes `checkpointStopped`
+	checkpointDone    chan struct{}
+	checkpointStopped chan struct{}
+
+	// Collects processing receipts for the series this Producer published the End message of
+	collector *receiptCollector
+	ended     []string
+	receipts  map[string][]Receipt
+
+	// Stats are updated from the async ack handlers as well as the publishing loop
+	m     sync.Mutex
+	stats ProducerStats
 }
 
 // Set the options for the Producer
 func (p *Producer) SetOptions(opts ProducerOptions) error {
+	if opts.LocalFile == "" && opts.RemoteFile == "" {
+		return errors.New("an image file must be specified with `-file` or `-remote`")
+	}
+
+	return p.configure(opts)
+}
+
+// Sets the options, without requiring an image - for publishing messages that weren't converted from one
+func (p *Producer) configure(opts ProducerOptions) error {
 
 	// Set Default Values
 	d := ProducerOptions{
-		ClientId:        DefaultProducerClientId,
+		ClientIdPrefix:  DefaultProducerClientId,
 		Subject:         DefaultSubject,
 		MaxInFlightAcks: DefaultMaxPubAcksInflight,
 		ImageSizeRatio:  DefaultImageSizeRatio,
 		DrainTimeout:    60 * time.Second,
 		PublishDelay:    DefaultPublishDelay,
 		BatchSize:       1,
+		Burst:           1,
+		PartitionKey:    PartitionKeyId,
+		ReceiptTimeout:  30 * time.Second,
+		AckTimeout:      stan.DefaultAckWait,
+		MaxAttempts:     DefaultMaxPublishAttempts,
+		RetryBackoff:    100 * time.Millisecond,
+		RetryMaxBackoff: 5 * time.Second,
+
+		CheckpointInterval: DefaultCheckpointInterval,
+		CompressThreshold:  DefaultCompressThreshold,
 	}
 
 	if err := mergo.Merge(&d, opts, mergo.WithOverride); err != nil {
@@ -85,15 +194,54 @@ func (p *Producer) SetOptions(opts ProducerOptions) error {
 		d.ImageSizeRatio = d.ImageSizeRatio * 0.1
 	}
 
+	if d.ClientId == "" {
+		d.ClientId = GenerateClientId(d.ClientIdPrefix, "")
+	}
+
 	p.SetConnection(ConnectionInfo{
-		Cluster:          d.Cluster,
-		ClientId:         d.ClientId,
-		ConnectionString: d.ConnectionString,
-		Subject:          d.Subject,
+		Cluster:            d.Cluster,
+		ClientId:           d.ClientId,
+		ConnectionString:   d.ConnectionString,
+		NoRandomize:        d.NoRandomize,
+		ClientIdRetries:    d.ClientIdRetries,
+		Subject:            d.Subject,
+		PubAckWait:         d.AckTimeout,
+		MaxPubAcksInflight: d.MaxInFlightAcks,
+		PingInterval:       d.PingInterval,
+		PingMaxOut:         d.PingMaxOut,
+		ReconnectWait:      d.ReconnectWait,
+		MaxReconnects:      d.MaxReconnects,
+		ConnectionAuth:     d.ConnectionAuth,
 	})
 
-	if d.LocalFile == "" && d.RemoteFile == "" {
-		return errors.New("an image file must be specified with `-file` or `-remote`")
+	p.backoff = Backoff{Initial: d.RetryBackoff, Max: d.RetryMaxBackoff}
+
+	if err := ValidateCompression(d.Compression); err != nil {
+		return err
+	}
+
+	if d.RateLimit > 0 || d.ByteRateLimit > 0 {
+		profile, err := NewRampProfile(d.RampProfile, d.RampPeriod)
+		if err != nil {
+			return err
+		}
+
+		p.limiter = NewRateLimiter(d.RateLimit, d.ByteRateLimit, d.Burst, profile)
+		p.stats.TargetRate = d.RateLimit
+		p.stats.TargetByteRate = d.ByteRateLimit
+	}
+
+	if d.Partitions > 0 {
+		partitioner, err := NewPartitioner(d.Partitions, d.PartitionKey)
+		if err != nil {
+			return err
+		}
+
+		p.partitioner = partitioner
+	}
+
+	if d.Resume && d.CheckpointFile == "" {
+		d.CheckpointFile = DefaultCheckpointFile
 	}
 
 	p.options = d
@@ -148,71 +296,453 @@ func batchCharacters(characters []string, chunksize int) []string {
 	return chunked
 }
 
-func (p *Producer) Publish(messages []string) error {
-	defer func() { p.stats.end = time.Now() }()
-	p.stats.start = time.Now()
+// A single image (series of messages) to be published
+type series struct {
+	id       string
+	messages []string
+	digest   string
+	rows     []int
+}
 
+// Creates a new series with a unique MessageSeriesId
+func newSeries(messages []string) (series, error) {
 	id, err := uuid.NewV4()
 	if err != nil {
-		return fmt.Errorf("failed to generate id: %v", err)
+		return series{}, fmt.Errorf("failed to generate id: %v", err)
+	}
+
+	return makeSeries(id.String(), messages), nil
+}
+
+// Creates the series for the given MessageSeriesId
+func makeSeries(id string, messages []string) series {
+	return series{
+		id:       id,
+		messages: messages,
+		digest:   SeriesDigest(messages),
+		rows:     seriesRows(messages),
+	}
+}
+
+// Publishes every message as a single new series
+func (p *Producer) Publish(messages []string) error {
+	if p.options.Resume {
+		return p.resume(messages)
+	}
+
+	s, err := newSeries(messages)
+	if err != nil {
+		return err
+	}
+
+	p.current = s
+	p.tracker = newAckTracker(0)
+
+	if err := p.startCheckpoints(); err != nil {
+		return err
+	}
+
+	return p.publishSeries(s, 0, 1, len(s.messages))
+}
+
+// Continues publishing the series from the checkpoint, starting with the first message that wasn't acknowledged
+func (p *Producer) resume(messages []string) error {
+	c, err := LoadCheckpoint(p.options.CheckpointFile)
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoint: %v", err)
+	}
+
+	if c.Complete {
+		return fmt.Errorf("series %s in checkpoint %s has already completed", c.MessageSeriesId, p.options.CheckpointFile)
+	}
+
+	s := makeSeries(c.MessageSeriesId, messages)
+	if c.Total != len(messages) || c.Digest != s.digest {
+		return fmt.Errorf("image does not match the series %s in checkpoint %s", c.MessageSeriesId, p.options.CheckpointFile)
+	}
+
+	p.Output().Event("series_resumed", map[string]interface{}{
+		"message_series_id": s.id,
+		"message_id":        c.LastAckedId + 1,
+	}, fmt.Sprintf("\nResuming series %s from MessageId %d\n", s.id, c.LastAckedId+1))
+
+	p.current = s
+	p.tracker = newAckTracker(c.LastAckedId + 1)
+
+	if err := p.startCheckpoints(); err != nil {
+		return err
+	}
+
+	return p.publishSeries(s, c.LastAckedId+1, 1, len(s.messages))
+}
+
+// Saves how far through the current series has been acknowledged to the checkpoint file
+func (p *Producer) saveCheckpoint() error {
+	if p.options.CheckpointFile == "" || p.tracker == nil {
+		return nil
+	}
+
+	last := p.tracker.LastAcked()
+
+	return Checkpoint{
+		MessageSeriesId: p.current.id,
+		LastAckedId:     last,
+		Total:           len(p.current.messages),
+		Digest:          p.current.digest,
+		Complete:        last == len(p.current.messages)-1,
+	}.Save(p.options.CheckpointFile)
+}
+
+// Saves the checkpoint of the series straight away, then again whenever more of it has been acknowledged - so a
+// producer which is killed, rather than interrupted, can still be resumed from close to where it was
+func (p *Producer) startCheckpoints() error {
+	if p.options.CheckpointFile == "" {
+		return nil
+	}
+
+	p.stopCheckpoints()
+	if err := p.saveCheckpoint(); err != nil {
+		return fmt.Errorf("error saving checkpoint: %v", err)
+	}
+
+	p.checkpointDone = make(chan struct{})
+	p.checkpointStopped = make(chan struct{})
+
+	go func() {
+		defer close(p.checkpointStopped)
+
+		ticker := time.NewTicker(p.options.CheckpointInterval)
+		defer ticker.Stop()
+
+		saved := p.tracker.LastAcked()
+		for {
+			select {
+			case <-ticker.C:
+				if last := p.tracker.LastAcked(); last != saved {
+					if err := p.saveCheckpoint(); err != nil {
+						p.Output().Error(fmt.Errorf("error saving checkpoint: %v", err))
+						continue
+					}
+
+					saved = last
+				}
+			case <-p.checkpointDone:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stops saving the checkpoint periodically, waiting for any save in progress
+func (p *Producer) stopCheckpoints() {
+	if p.checkpointDone == nil {
+		return
+	}
+
+	close(p.checkpointDone)
+	<-p.checkpointStopped
+
+	p.checkpointDone = nil
+}
+
+// Whether publishing was stopped early by an interrupt
+func (p *Producer) Interrupted() bool {
+	return p.interrupted
+}
+
+// Subscribes for processing receipts, which consumers send once they've processed the End message of a series
+func (p *Producer) Connect() error {
+	if err := p.NatsClient.Connect(); err != nil {
+		return err
+	}
+
+	if p.options.Receipts > 0 {
+		collector, err := newReceiptCollector(p.NatsConn())
+		if err != nil {
+			return err
+		}
+
+		p.collector = collector
 	}
 
+	return nil
+}
+
+// Waits for the expected number of consumers to send receipts for each series this Producer ended - any consumer
+// which doesn't send one before the ReceiptTimeout is simply missing from the receipts
+func (p *Producer) waitForReceipts() {
+	if p.collector == nil {
+		return
+	}
+	defer p.collector.close()
+
+	p.receipts = map[string][]Receipt{}
+
+	for _, id := range p.ended {
+		p.receipts[id], _ = p.collector.wait(id, p.options.Receipts, p.options.ReceiptTimeout)
+	}
+}
+
+// Returns the processing receipts received for each series, by MessageSeriesId
+func (p *Producer) GetReceipts() map[string][]Receipt {
+	return p.receipts
+}
+
+// Publishes the messages of the series starting at `offset` and then every `stride` messages after that, up to (but
+// not including) `end` - which allows several publishers to share a single series between them.
+func (p *Producer) publishSeries(s series, offset int, stride int, end int) error {
+	defer p.update(func(stats *ProducerStats) { stats.end = time.Now() })
+	p.update(func(stats *ProducerStats) { stats.start = time.Now() })
+
 	ctlc := make(chan os.Signal, 2)
 	signal.Notify(ctlc, os.Interrupt, syscall.SIGTERM)
-
-	var x int
-	for pos, char := range messages {
+	defer signal.Stop(ctlc)
+
+	p.Output().Event("series_start", map[string]interface{}{
+		"message_series_id": s.id,
+		"client_id":         p.conn.ClientId,
+		"messages":          len(s.messages),
+		"offset":            offset,
+	}, "")
+
+	defer func() {
+		p.Output().Event("series_end", map[string]interface{}{
+			"message_series_id": s.id,
+			"client_id":         p.conn.ClientId,
+			"interrupted":       p.interrupted,
+		}, "")
+	}()
+
+	for pos := offset; pos < end; pos += stride {
 		select {
 		case <-ctlc:
+			p.interrupted = true
 			return nil
 		default:
-			data, err := json.Marshal(Message{
-				MessageSeriesId: id.String(),
-				MessageId:       pos,
-				Body:            char,
-				End:             x == len(messages)-1,
-			})
-
-			if err != nil {
+			if err := p.publishMessage(s, pos); err != nil {
 				return err
 			}
 
-			if p.options.Sync {
-				if err := p.Conn.Publish(p.options.Subject, data); err != nil {
-					return err
-				} else {
-					p.stats.AcksReceived++
-				}
+			time.Sleep(p.options.PublishDelay)
+		}
+	}
 
-			} else {
-				_, err := p.PublishAsync(p.options.Subject, data, p.AckHandler(func(id string, err error) {
-					if err != nil {
-						fmt.Printf("Oh no! Message %s has errored: %+v\n", id, err)
-					}
+	return nil
+}
 
-					p.stats.AcksReceived++
-				}))
+// Publishes the message at `pos` in the series, only returning an error if it can't be published at all - a failed
+// publish is otherwise retried, or recorded as a permanent failure
+func (p *Producer) publishMessage(s series, pos int) error {
+	char := s.messages[pos]
+	msg := Message{
+		MessageSeriesId: s.id,
+		MessageId:       pos,
+		Body:            char,
+		End:             pos == len(s.messages)-1,
+		Checksum:        Checksum(char),
+		Timestamp:       time.Now().UnixNano(),
+	}
 
-				if err != nil {
-					return err
-				}
-			}
+	if msg.End {
+		msg.Digest = s.digest
 
-			x++
-			p.stats.MessagesSent++
-			time.Sleep(p.options.PublishDelay)
+		if p.collector != nil {
+			msg.Reply = p.collector.subject
+			p.ended = append(p.ended, s.id)
+		}
+	}
+
+	data, err := p.encode(msg)
+
+	if err != nil {
+		return err
+	}
+
+	if p.limiter != nil {
+		p.limiter.Wait(len(data))
+	}
+
+	// Counted before publishing, so that a message which permanently fails is always uncounted after it
+	p.update(func(stats *ProducerStats) { stats.MessagesSent++ })
+
+	subject := p.options.Subject
+	if p.partitioner != nil {
+		subject = PartitionSubject(subject, p.partitioner.Partition(s, pos))
+	}
+
+	if p.options.Sync {
+		if err := p.publishSync(subject, pos, data); err == stan.ErrConnectionClosed {
+			return err
+		}
+	} else {
+		err := p.publishAsync(subject, pos, data, 1)
+
+		// The connection may have been lost, rather than closed - in which case wait for it to reconnect
+		if err == stan.ErrConnectionClosed && !p.awaitConnection(p.options.DrainTimeout) {
+			return err
+		} else if err != nil {
+			p.retry(subject, pos, data, 1, err)
 		}
 	}
 
 	return nil
 }
 
-// Drains the pending Acks from PublishAsync and closes the connection
+// Publishes synchronously, retrying with backoff up to MaxAttempts before giving up on the message
+func (p *Producer) publishSync(subject string, id int, data []byte) error {
+	for attempt := 1; ; attempt++ {
+		err := p.Conn.Publish(subject, data)
+		if err == nil {
+			p.acked(id)
+			return nil
+		}
+
+		if attempt >= p.options.MaxAttempts {
+			p.fail(id, err)
+			return err
+		}
+
+		// The connection may have been lost, rather than closed - in which case wait for it to reconnect
+		if err == stan.ErrConnectionClosed && !p.awaitConnection(p.options.DrainTimeout) {
+			p.fail(id, err)
+			return err
+		}
+
+		p.update(func(stats *ProducerStats) { stats.Retries++ })
+		time.Sleep(p.backoff.Duration(attempt))
+	}
+}
+
+// Publishes asynchronously, where a failed or timed out ack will retry the publish
+func (p *Producer) publishAsync(subject string, id int, data []byte, attempt int) error {
+	_, err := p.PublishAsync(subject, data, p.AckHandler(func(_ string, err error) {
+		if err != nil {
+			p.retry(subject, id, data, attempt, err)
+			return
+		}
+
+		p.acked(id)
+	}))
+
+	return err
+}
+
+// Schedules the message to be published again after a backoff, unless it has already reached MaxAttempts.
+//
+// The pending retry is held in the Drainable Queue until it has been published again, so that draining waits for it.
+func (p *Producer) retry(subject string, id int, data []byte, attempt int, cause error) {
+	if attempt >= p.options.MaxAttempts {
+		p.fail(id, cause)
+		return
+	}
+
+	key := fmt.Sprintf("retry:%d:%d", id, attempt)
+	p.add(key)
+	p.update(func(stats *ProducerStats) { stats.Retries++ })
+
+	go func() {
+		defer p.remove(key)
+
+		time.Sleep(p.backoff.Duration(attempt))
+		p.awaitConnection(p.options.DrainTimeout)
+
+		if err := p.publishAsync(subject, id, data, attempt+1); err != nil {
+			p.retry(subject, id, data, attempt+1, err)
+		}
+	}()
+}
+
+// Records that the message was successfully acknowledged
+func (p *Producer) acked(id int) {
+	if p.tracker != nil {
+		p.tracker.Ack(id)
+	}
+
+	p.update(func(stats *ProducerStats) { stats.AcksReceived++ })
+}
+
+// Records that the message has permanently failed to publish
+func (p *Producer) fail(id int, cause error) {
+	p.Output().Event("publish_failed", map[string]interface{}{
+		"message_id": id,
+		"error":      cause.Error(),
+	}, fmt.Sprintf("Oh no! Message %d failed to publish: %+v\n", id, cause))
+
+	p.update(func(stats *ProducerStats) {
+		stats.MessagesSent--
+		stats.PermanentFailures++
+		stats.FailedMessageIds = append(stats.FailedMessageIds, id)
+	})
+}
+
+// Safely updates the stats, which may be modified concurrently by ack handlers
+func (p *Producer) update(fn func(stats *ProducerStats)) {
+	defer p.m.Unlock()
+
+	p.m.Lock()
+	fn(&p.stats)
+}
+
+// Serializes the Message, compressing the body if configured to, and tracks the raw and compressed sizes
+func (p *Producer) encode(msg Message) ([]byte, error) {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := msg.Compress(p.options.Compression, p.options.CompressThreshold); err != nil {
+		return nil, err
+	}
+
+	// Left uncompressed when below the threshold, or when compressing wouldn't have made it any smaller
+	if msg.Compression == CompressionNone {
+		p.update(func(stats *ProducerStats) {
+			stats.RawBytes += len(raw)
+			stats.BytesSent += len(raw)
+		})
+
+		return raw, nil
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.update(func(stats *ProducerStats) {
+		stats.RawBytes += len(raw)
+		stats.BytesSent += len(data)
+		stats.CompressedMessages++
+	})
+
+	return data, nil
+}
+
+// Drains the pending Acks from PublishAsync, saves the checkpoint and closes the connection
 func (p *Producer) DrainAndClose() error {
-	if err := p.Drain(p.options.DrainTimeout); err != nil {
-		return fmt.Errorf("error draining: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), p.options.DrainTimeout)
+	defer cancel()
+
+	pending, drainErr := p.Drain(ctx)
+	if len(pending) > 0 {
+		p.Output().Event("drain_timed_out", map[string]interface{}{"pending": pending}, "")
+	}
+
+	// Save the checkpoint regardless, whatever was acked before the timeout can still be skipped when resuming
+	p.stopCheckpoints()
+	if err := p.saveCheckpoint(); err != nil {
+		return fmt.Errorf("error saving checkpoint: %v", err)
 	}
 
+	if drainErr != nil {
+		return fmt.Errorf("error draining: %v", drainErr)
+	}
+
+	// Consumers can only send receipts once everything has been published, so only wait once drained
+	p.waitForReceipts()
+
 	if err := p.Close(); err != nil {
 		return fmt.Errorf("error closing connection: %v", err)
 	}
@@ -222,7 +752,37 @@ func (p *Producer) DrainAndClose() error {
 
 // Return the ProducerStats for the subscription
 func (p *Producer) GetPublishStats() ProducerStats {
-	return p.stats
+	defer p.m.Unlock()
+
+	p.m.Lock()
+	stats := p.stats
+	stats.FailedMessageIds = append([]int(nil), p.stats.FailedMessageIds...)
+	sort.Ints(stats.FailedMessageIds)
+
+	return stats
+}
+
+// Combines the stats of another Producer into these stats, covering the time taken by both. The target rates aren't
+// added together, as Producers publishing together share their rate limits.
+func (s *ProducerStats) Merge(o ProducerStats) {
+	if s.start.IsZero() || (!o.start.IsZero() && o.start.Before(s.start)) {
+		s.start = o.start
+	}
+
+	if o.end.After(s.end) {
+		s.end = o.end
+	}
+
+	s.MessagesSent += o.MessagesSent
+	s.AcksReceived += o.AcksReceived
+	s.Retries += o.Retries
+	s.PermanentFailures += o.PermanentFailures
+	s.FailedMessageIds = append(s.FailedMessageIds, o.FailedMessageIds...)
+	s.RawBytes += o.RawBytes
+	s.BytesSent += o.BytesSent
+	s.CompressedMessages += o.CompressedMessages
+	s.TargetRate = math.Max(s.TargetRate, o.TargetRate)
+	s.TargetByteRate = math.Max(s.TargetByteRate, o.TargetByteRate)
 }
 
 // Return the Time Taken to deliver messages
@@ -253,6 +813,24 @@ func (s *ProducerStats) GetMessagesPerSecond() float64 {
 	return 0.0
 }
 
+// Return the Bytes Per Second for the Publisher
+func (s *ProducerStats) GetBytesPerSecond() float64 {
+	if !s.start.IsZero() && !s.end.IsZero() {
+		return math.Round(float64(s.BytesSent) / s.end.Sub(s.start).Seconds())
+	}
+
+	return 0.0
+}
+
+// Return the ratio of bytes sent against the uncompressed size of the messages
+func (s *ProducerStats) GetCompressionRatio() float64 {
+	if s.RawBytes == 0 {
+		return 1.0
+	}
+
+	return math.Round(float64(s.BytesSent)/float64(s.RawBytes)*1000) / 1000
+}
+
 // Download remote images
 func downloadImage(url string) (image.Image, string, error) {
 	resp, err := http.Get(url)
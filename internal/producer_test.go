@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+// Creates a Producer publishing through the mock, which hands each publish's AckHandler to `handlers`
+func newMockProducer(m *MockStan, maxAttempts int) (*Producer, chan stan.AckHandler) {
+	p := &Producer{
+		options: ProducerOptions{Subject: "foo", MaxAttempts: maxAttempts},
+		backoff: Backoff{Initial: 100 * time.Millisecond},
+	}
+	p.SetOutput(discardOutput)
+	p.Conn = m
+
+	handlers := make(chan stan.AckHandler, 10)
+	m.On("PublishAsync", "foo", []byte("bar"), mock.Anything).Run(func(args mock.Arguments) {
+		handlers <- args.Get(2).(stan.AckHandler)
+	}).Return("abc", nil)
+
+	return p, handlers
+}
+
+// Waits for the next publish, failing if it doesn't happen in time
+func nextPublish(t *testing.T, handlers chan stan.AckHandler) stan.AckHandler {
+	select {
+	case ah := <-handlers:
+		return ah
+	case <-time.After(time.Second):
+		t.Fatal("timeout reached - the message was never published again!")
+		return nil
+	}
+}
+
+// Test that a failed ack is retried, with the pending retry keeping Drain waiting until it's published again
+func TestProducer_Retry(t *testing.T) {
+	m := &MockStan{}
+	p, handlers := newMockProducer(m, 3)
+
+	assert.NoError(t, p.publishAsync("foo", 0, []byte("bar"), 1))
+	nextPublish(t, handlers)("abc", errors.New("ack timeout"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	pending, err := p.Drain(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"retry:0:1"}, pending)
+
+	nextPublish(t, handlers)("abc", nil)
+	assert.Empty(t, p.Pending())
+
+	stats := p.GetPublishStats()
+	assert.Equal(t, 1, stats.Retries)
+	assert.Equal(t, 1, stats.AcksReceived)
+	assert.Empty(t, stats.FailedMessageIds)
+	m.AssertExpectations(t)
+}
+
+// Test that a message is given up on once its acks have failed MaxAttempts times
+func TestProducer_RetryMaxAttempts(t *testing.T) {
+	m := &MockStan{}
+	p, handlers := newMockProducer(m, 2)
+
+	assert.NoError(t, p.publishAsync("foo", 7, []byte("bar"), 1))
+	nextPublish(t, handlers)("abc", errors.New("ack timeout"))
+	nextPublish(t, handlers)("abc", errors.New("ack timeout"))
+
+	assert.Empty(t, p.Pending())
+
+	stats := p.GetPublishStats()
+	assert.Equal(t, 1, stats.Retries)
+	assert.Equal(t, 1, stats.PermanentFailures)
+	assert.Equal(t, []int{7}, stats.FailedMessageIds)
+	assert.Zero(t, stats.AcksReceived)
+}
+
+// Test that messages which permanently failed to publish aren't counted as sent
+func TestProducer_MessagesSent(t *testing.T) {
+	m := &MockStan{}
+	m.On("PublishAsync", "foo", mock.Anything, mock.Anything).Return("abc", nil).Once()
+	m.On("PublishAsync", "foo", mock.Anything, mock.Anything).Return("", errors.New("nope"))
+
+	p := &Producer{options: ProducerOptions{Subject: "foo", MaxAttempts: 1}}
+	p.SetOutput(discardOutput)
+	p.Conn = m
+
+	assert.NoError(t, p.publishSeries(makeSeries("abc", []string{"a", "b", "c"}), 0, 1, 3))
+
+	stats := p.GetPublishStats()
+	assert.Equal(t, 1, stats.MessagesSent)
+	assert.Equal(t, []int{1, 2}, stats.FailedMessageIds)
+}
+
+// Test that publishing blocks once MaxInFlightAcks messages are waiting on an ack, until the first ack arrives - here
+// once it times out, as the streaming server is stopped so nothing is acked
+func TestProducer_MaxInFlightAcks(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	p := &Producer{}
+	p.SetOutput(discardOutput)
+
+	assert.NoError(t, p.configure(ProducerOptions{
+		Cluster:          server.ClusterId(),
+		ClientId:         "test-producer",
+		ConnectionString: server.URL(),
+		Subject:          "foo",
+		AckTimeout:       500 * time.Millisecond,
+		MaxInFlightAcks:  1,
+	}))
+	assert.NoError(t, p.Connect())
+	defer p.Close()
+
+	server.stan.Shutdown()
+
+	acked := make(chan error, 1)
+	_, err := p.Conn.PublishAsync("foo", []byte("bar"), func(_ string, err error) { acked <- err })
+	assert.NoError(t, err)
+
+	published := make(chan struct{})
+	go func() {
+		_, _ = p.Conn.PublishAsync("foo", []byte("bar"), func(string, error) {})
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		t.Fatal("the second message was published while the first was still waiting on an ack!")
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	select {
+	case err := <-acked:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("timeout reached - the first message was never acked!")
+	}
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("timeout reached - the second message was never published!")
+	}
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// The lowest fraction of the target rate a RampProfile will go to, so that a profile never stalls the producer entirely
+const minimumRampFactor = 0.05
+
+// A RampProfile returns the fraction (0 to 1) of the target rate that should be used after `elapsed` time.
+type RampProfile func(elapsed time.Duration) float64
+
+// Returns the named RampProfile, which repeats (or for linear, completes) over the given `period`
+//   - 'linear' ramps from nothing to the full rate over the period, then holds
+//   - 'step' increases the rate in four equal steps over the period, then starts over
+//   - 'sine' oscillates between nothing and the full rate over the period
+func NewRampProfile(name string, period time.Duration) (RampProfile, error) {
+	if period <= 0 && name != "" && name != "none" {
+		return nil, fmt.Errorf("ramp profile %q requires a period", name)
+	}
+
+	switch name {
+	case "", "none":
+		return func(time.Duration) float64 { return 1 }, nil
+	case "linear":
+		return func(elapsed time.Duration) float64 {
+			return math.Max(minimumRampFactor, math.Min(1, float64(elapsed)/float64(period)))
+		}, nil
+	case "step":
+		return func(elapsed time.Duration) float64 {
+			step := (elapsed % period) * 4 / period
+			return float64(step+1) / 4
+		}, nil
+	case "sine":
+		return func(elapsed time.Duration) float64 {
+			x := 2 * math.Pi * float64(elapsed%period) / float64(period)
+			return math.Max(minimumRampFactor, 0.5-0.5*math.Cos(x))
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported ramp profile %q - allows 'linear', 'step' or 'sine'", name)
+}
+
+// A classic token bucket - tokens refill at `rate` per second up to `burst`, and taking tokens that aren't
+// available yet returns how long the caller should wait for them.
+type TokenBucket struct {
+	m      sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Creates a TokenBucket which starts full
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Changes the refill rate of the bucket, keeping any tokens accumulated so far
+func (b *TokenBucket) SetRate(rate float64, now time.Time) {
+	defer b.m.Unlock()
+
+	b.m.Lock()
+	b.refill(now)
+	b.rate = rate
+}
+
+// Takes `n` tokens from the bucket and returns how long to wait until they would have been available.
+//
+// The bucket is allowed to go into debt, so a request larger than the burst simply waits longer.
+func (b *TokenBucket) Reserve(n float64, now time.Time) time.Duration {
+	defer b.m.Unlock()
+
+	b.m.Lock()
+	b.refill(now)
+	b.tokens -= n
+
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+
+	b.last = now
+}
+
+// Limits publishing by messages and/or bytes per second, following a RampProfile. It can be shared by several
+// publishers, limiting them together.
+type RateLimiter struct {
+	m        sync.Mutex
+	messages *TokenBucket
+	bytes    *TokenBucket
+
+	messageRate float64
+	byteRate    float64
+	profile     RampProfile
+	start       time.Time
+}
+
+// Creates a RateLimiter - a rate of 0 disables that limit
+func NewRateLimiter(messageRate float64, byteRate float64, burst int, profile RampProfile) *RateLimiter {
+	l := &RateLimiter{
+		messageRate: messageRate,
+		byteRate:    byteRate,
+		profile:     profile,
+	}
+
+	if messageRate > 0 {
+		l.messages = NewTokenBucket(messageRate, burst)
+	}
+
+	if byteRate > 0 {
+		// The byte bucket needs to hold at least a burst worth of reasonably sized messages
+		l.bytes = NewTokenBucket(byteRate, int(math.Max(byteRate/10, float64(burst))))
+	}
+
+	return l
+}
+
+// Blocks until a message of `size` bytes is allowed to be published
+func (l *RateLimiter) Wait(size int) {
+	time.Sleep(l.Reserve(size, time.Now()))
+}
+
+// Reserves a message of `size` bytes and returns how long to wait before publishing it
+func (l *RateLimiter) Reserve(size int, now time.Time) time.Duration {
+	defer l.m.Unlock()
+
+	l.m.Lock()
+	if l.start.IsZero() {
+		l.start = now
+	}
+
+	factor := 1.0
+	if l.profile != nil {
+		factor = l.profile(now.Sub(l.start))
+	}
+
+	var wait time.Duration
+
+	if l.messages != nil {
+		l.messages.SetRate(l.messageRate*factor, now)
+		wait = l.messages.Reserve(1, now)
+	}
+
+	if l.bytes != nil {
+		l.bytes.SetRate(l.byteRate*factor, now)
+		if w := l.bytes.Reserve(float64(size), now); w > wait {
+			wait = w
+		}
+	}
+
+	return wait
+}
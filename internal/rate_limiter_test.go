@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that the bucket allows a burst, then paces requests at the given rate
+func TestTokenBucket_Reserve(t *testing.T) {
+	now := time.Now()
+	b := NewTokenBucket(10, 2)
+
+	assert.Zero(t, b.Reserve(1, now))
+	assert.Zero(t, b.Reserve(1, now))
+	assert.Equal(t, 100*time.Millisecond, b.Reserve(1, now))
+
+	// After a second, the bucket should have refilled up to the burst only
+	later := now.Add(time.Second)
+	assert.Zero(t, b.Reserve(1, later))
+	assert.Zero(t, b.Reserve(1, later))
+	assert.Equal(t, 100*time.Millisecond, b.Reserve(1, later))
+}
+
+// Test that the byte limit applies when it is the stricter of the two
+func TestRateLimiter_ByteLimit(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(1000, 100, 1, nil)
+
+	// The byte bucket starts with a burst of 10 bytes, so 110 bytes leaves a 1 second debt
+	assert.Equal(t, time.Second, l.Reserve(110, now))
+}
+
+// Test the shape of each of the ramp profiles
+func TestNewRampProfile(t *testing.T) {
+	period := 4 * time.Second
+
+	linear, _ := NewRampProfile("linear", period)
+	assert.Equal(t, minimumRampFactor, linear(0))
+	assert.Equal(t, 0.5, linear(2*time.Second))
+	assert.Equal(t, 1.0, linear(10*time.Second))
+
+	step, _ := NewRampProfile("step", period)
+	assert.Equal(t, 0.25, step(0))
+	assert.Equal(t, 0.75, step(2*time.Second))
+	assert.Equal(t, 0.25, step(period))
+
+	sine, _ := NewRampProfile("sine", period)
+	assert.Equal(t, minimumRampFactor, sine(0))
+	assert.InDelta(t, 1.0, sine(2*time.Second), 0.0001)
+
+	_, err := NewRampProfile("sawtooth", period)
+	assert.Error(t, err)
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"sync"
+	"time"
+)
+
+// A processing receipt, sent by a consumer back to the producer once it has processed a whole series
+type Receipt struct {
+	ClientId        string `json:"client_id"`
+	MessageSeriesId string `json:"message_series_id"`
+	Received        int    `json:"received"`
+	Expected        int    `json:"expected"`
+	Verified        bool   `json:"verified"`
+}
+
+// Creates a Receipt from the verification of a series
+func NewReceipt(clientId string, result VerificationResult) Receipt {
+	return Receipt{
+		ClientId:        clientId,
+		MessageSeriesId: result.MessageSeriesId,
+		Received:        result.Received,
+		Expected:        result.Expected,
+		Verified:        result.Match(),
+	}
+}
+
+// Collects receipts sent to a reply subject
+type receiptCollector struct {
+	m        sync.Mutex
+	sub      *nats.Subscription
+	subject  string
+	receipts map[string]map[string]Receipt
+	notify   chan struct{}
+}
+
+// Subscribes to a new unique reply subject for receipts
+func newReceiptCollector(nc *nats.Conn) (*receiptCollector, error) {
+	if nc == nil {
+		return nil, errors.New("no nats connection to receive receipts on")
+	}
+
+	rc := &receiptCollector{
+		subject:  nats.NewInbox(),
+		receipts: map[string]map[string]Receipt{},
+		notify:   make(chan struct{}, 1),
+	}
+
+	sub, err := nc.Subscribe(rc.subject, rc.handle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe for receipts: %v", err)
+	}
+
+	rc.sub = sub
+
+	return rc, nil
+}
+
+func (rc *receiptCollector) handle(m *nats.Msg) {
+	var r Receipt
+	if err := json.Unmarshal(m.Data, &r); err != nil {
+		return
+	}
+
+	rc.m.Lock()
+	if rc.receipts[r.MessageSeriesId] == nil {
+		rc.receipts[r.MessageSeriesId] = map[string]Receipt{}
+	}
+	rc.receipts[r.MessageSeriesId][r.ClientId] = r
+	rc.m.Unlock()
+
+	select {
+	case rc.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the receipts received for the series so far
+func (rc *receiptCollector) get(seriesId string) []Receipt {
+	defer rc.m.Unlock()
+
+	rc.m.Lock()
+	receipts := make([]Receipt, 0, len(rc.receipts[seriesId]))
+	for _, r := range rc.receipts[seriesId] {
+		receipts = append(receipts, r)
+	}
+
+	return receipts
+}
+
+// Blocks until receipts from `n` consumers have been received for the series, or the timeout is reached
+func (rc *receiptCollector) wait(seriesId string, n int, timeout time.Duration) ([]Receipt, error) {
+	to := time.NewTimer(timeout)
+	defer to.Stop()
+
+	for {
+		if receipts := rc.get(seriesId); len(receipts) >= n {
+			return receipts, nil
+		}
+
+		select {
+		case <-rc.notify:
+		case <-to.C:
+			receipts := rc.get(seriesId)
+			return receipts, fmt.Errorf("timed out waiting for receipts, received %d of %d", len(receipts), n)
+		}
+	}
+}
+
+func (rc *receiptCollector) close() error {
+	return rc.sub.Unsubscribe()
+}
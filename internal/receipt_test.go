@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func receiptMsg(r Receipt) *nats.Msg {
+	data, _ := json.Marshal(r)
+	return &nats.Msg{Data: data}
+}
+
+// Test that waiting returns once receipts from enough distinct consumers have arrived
+func TestReceiptCollector_Wait(t *testing.T) {
+	rc := &receiptCollector{receipts: map[string]map[string]Receipt{}, notify: make(chan struct{}, 1)}
+
+	go func() {
+		rc.handle(receiptMsg(Receipt{ClientId: "foo", MessageSeriesId: "abc", Verified: true}))
+		// A second receipt from the same consumer shouldn't count twice
+		rc.handle(receiptMsg(Receipt{ClientId: "foo", MessageSeriesId: "abc", Verified: true}))
+		rc.handle(receiptMsg(Receipt{ClientId: "bar", MessageSeriesId: "abc"}))
+	}()
+
+	receipts, err := rc.wait("abc", 2, time.Second)
+
+	assert.NoError(t, err)
+	assert.Len(t, receipts, 2)
+}
+
+// Test that waiting times out with whichever receipts did arrive
+func TestReceiptCollector_WaitTimesout(t *testing.T) {
+	rc := &receiptCollector{receipts: map[string]map[string]Receipt{}, notify: make(chan struct{}, 1)}
+	rc.handle(receiptMsg(Receipt{ClientId: "foo", MessageSeriesId: "abc"}))
+	rc.handle(receiptMsg(Receipt{ClientId: "bar", MessageSeriesId: "xyz"}))
+
+	receipts, err := rc.wait("abc", 2, 5*time.Millisecond)
+
+	assert.Error(t, err)
+	assert.Len(t, receipts, 1)
+	assert.Equal(t, "foo", receipts[0].ClientId)
+}
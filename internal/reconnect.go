@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/stan.go"
+	"sync"
+	"time"
+)
+
+// A stan.Conn which is swapped for a new connection once reconnected - so publishers and subscribers holding the
+// connection carry on with the new one, without needing to know that it was lost.
+type reconnectableConn struct {
+	m      sync.RWMutex
+	conn   stan.Conn
+	closed bool
+}
+
+// The current connection
+func (r *reconnectableConn) current() stan.Conn {
+	defer r.m.RUnlock()
+
+	r.m.RLock()
+	return r.conn
+}
+
+// Swaps in the new connection, unless the connection has been closed in the meantime
+func (r *reconnectableConn) replace(conn stan.Conn) bool {
+	defer r.m.Unlock()
+
+	r.m.Lock()
+	if r.closed {
+		return false
+	}
+
+	r.conn = conn
+	return true
+}
+
+// Whether the connection has been closed, rather than lost
+func (r *reconnectableConn) isClosed() bool {
+	defer r.m.RUnlock()
+
+	r.m.RLock()
+	return r.closed
+}
+
+// Whether the current connection is usable - a lost connection is closed until it's replaced
+func (r *reconnectableConn) isConnected() bool {
+	return !r.isClosed() && r.current().NatsConn() != nil
+}
+
+func (r *reconnectableConn) Publish(subject string, data []byte) error {
+	return r.current().Publish(subject, data)
+}
+
+func (r *reconnectableConn) PublishAsync(subject string, data []byte, ah stan.AckHandler) (string, error) {
+	return r.current().PublishAsync(subject, data, ah)
+}
+
+func (r *reconnectableConn) Subscribe(subject string, cb stan.MsgHandler, opts ...stan.SubscriptionOption) (stan.Subscription, error) {
+	return r.current().Subscribe(subject, cb, opts...)
+}
+
+func (r *reconnectableConn) QueueSubscribe(subject, qgroup string, cb stan.MsgHandler, opts ...stan.SubscriptionOption) (stan.Subscription, error) {
+	return r.current().QueueSubscribe(subject, qgroup, cb, opts...)
+}
+
+// Closes the connection, stopping any reconnect in progress
+func (r *reconnectableConn) Close() error {
+	r.m.Lock()
+	r.closed = true
+	conn := r.conn
+	r.m.Unlock()
+
+	return conn.Close()
+}
+
+func (r *reconnectableConn) NatsConn() *nats.Conn {
+	return r.current().NatsConn()
+}
+
+// A STAN connection along with the NATS connection it was made over, which is closed along with it
+type ownedConn struct {
+	stan.Conn
+	nc *nats.Conn
+}
+
+func (c *ownedConn) Close() error {
+	defer c.nc.Close()
+
+	return c.Conn.Close()
+}
+
+// Registers a function to be called once reconnected - ie to rebuild subscriptions
+func (nc *NatsClient) OnReconnect(fn func() error) {
+	nc.reconnected = append(nc.reconnected, fn)
+}
+
+// Called by STAN once the connection is lost - either the server stopped answering pings, or it no longer knows
+// about this client, ie after a restart
+func (nc *NatsClient) connectionLost(_ stan.Conn, reason error) {
+	nc.Output().Event("connection_lost", map[string]string{"error": reason.Error()},
+		fmt.Sprintf("\nConnection lost: %v \n", reason))
+
+	go nc.reconnect()
+}
+
+// Keeps trying to connect again with backoff, until connected, closed or out of attempts
+func (nc *NatsClient) reconnect() {
+	backoff := Backoff{Initial: nc.conn.ReconnectWait, Max: nc.conn.ReconnectMaxWait}
+
+	for attempt := 1; nc.conn.MaxReconnects <= 0 || attempt <= nc.conn.MaxReconnects; attempt++ {
+		if nc.rc.isClosed() {
+			return
+		}
+
+		wait := backoff.Duration(attempt)
+		nc.Output().Event("reconnecting", map[string]interface{}{"attempt": attempt, "wait_ms": wait.Milliseconds()},
+			fmt.Sprintf("Reconnecting in %s (attempt %d)... \n", wait.Round(time.Millisecond), attempt))
+
+		time.Sleep(wait)
+
+		client, err := nc.dial()
+		if err != nil {
+			continue
+		}
+
+		// The lost connection is closed by STAN, but not the NATS connection it was made over
+		lost := nc.rc.current()
+		if !nc.rc.replace(client) {
+			_ = client.Close()
+			return
+		}
+
+		_ = lost.Close()
+
+		nc.Output().Event("reconnected", map[string]interface{}{"client_id": nc.conn.ClientId, "attempts": attempt},
+			fmt.Sprintf("Reconnected after %d attempts. \n", attempt))
+
+		for _, fn := range nc.reconnected {
+			if err := fn(); err != nil {
+				nc.Output().Error(err)
+			}
+		}
+
+		return
+	}
+
+	nc.Output().Event("reconnect_failed", map[string]int{"attempts": nc.conn.MaxReconnects},
+		fmt.Sprintf("Gave up reconnecting after %d attempts. \n", nc.conn.MaxReconnects))
+}
+
+// Waits until the connection is usable - returning false if it was closed, or not reconnected within the timeout
+func (nc *NatsClient) awaitConnection(timeout time.Duration) bool {
+	if nc.rc == nil {
+		return false
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !nc.rc.isConnected() {
+		if nc.rc.isClosed() || time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return true
+}
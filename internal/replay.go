@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/imdario/mergo"
+	"github.com/nats-io/stan.go"
+	"sync"
+	"time"
+)
+
+type ReplayOptions struct {
+	// Connection Info
+	Cluster          string
+	ClientId         string
+	ConnectionString string
+	NoRandomize      bool
+	ConnectionAuth
+
+	// The subject to replay from, and the MessageSeriesId to replay
+	Subject  string
+	SeriesId string
+
+	// An index of the subject, built by the index command, to look up where the series starts instead of scanning
+	IndexFile string
+
+	// How long finding the series, and then replaying it, can each take
+	Timeout time.Duration
+}
+
+// The outcome of replaying a series
+type ReplayResult struct {
+	VerificationResult
+
+	// The sequences the series started at and the replay stopped at, and how many messages of any series were read
+	StartSequence uint64 `json:"start_sequence"`
+	EndSequence   uint64 `json:"end_sequence"`
+	Read          int    `json:"read"`
+
+	// How many messages of the series failed to decompress
+	DecompressErrors int `json:"decompress_errors"`
+
+	// The bodies of the series, in MessageId order - any missing are left empty
+	Bodies []string `json:"-"`
+}
+
+// Replays a single series from a channel, starting from its first message and stopping once every message up to its
+// End message has been received
+type SeriesReplay struct {
+	NatsClient
+	options ReplayOptions
+}
+
+// Set the options for the SeriesReplay
+func (r *SeriesReplay) SetOptions(opts ReplayOptions) error {
+
+	// Set Default Values
+	d := ReplayOptions{
+		Subject: DefaultSubject,
+		Timeout: DefaultSeriesScanTimeout,
+	}
+
+	if err := mergo.Merge(&d, opts, mergo.WithOverride); err != nil {
+		return err
+	}
+
+	if d.SeriesId == "" {
+		return errors.New("a series to replay is required, with `-series`")
+	}
+
+	if d.ClientId == "" {
+		d.ClientId = GenerateClientId(DefaultReplayClientId, "")
+	}
+
+	r.SetConnection(ConnectionInfo{
+		Cluster:          d.Cluster,
+		ClientId:         d.ClientId,
+		ConnectionString: d.ConnectionString,
+		NoRandomize:      d.NoRandomize,
+		Subject:          d.Subject,
+		ConnectionAuth:   d.ConnectionAuth,
+	})
+
+	r.options = d
+
+	return nil
+}
+
+// Returns the currently set options
+func (r *SeriesReplay) GetOptions() ReplayOptions {
+	return r.options
+}
+
+// Finds where the series starts, and replays it from there
+func (r *SeriesReplay) Run() (ReplayResult, error) {
+	if r.Conn == nil {
+		return ReplayResult{}, errors.New("replay failed, no stan connection")
+	}
+
+	start, from, err := locateSeries(r.Conn, r.conn.Cluster, r.options.Subject, r.options.SeriesId,
+		r.options.IndexFile, r.options.Timeout)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+
+	r.Output().Event("series_found", map[string]interface{}{
+		"message_series_id": r.options.SeriesId,
+		"sequence":          start,
+		"from":              from,
+	}, fmt.Sprintf("\nSeries %s starts at sequence %d, %s. \n", r.options.SeriesId, start, foundBy(from)))
+
+	return r.replay(start)
+}
+
+// Replays the series from the given sequence
+func (r *SeriesReplay) replay(start uint64) (ReplayResult, error) {
+	last, err := lastSequence(r.Conn, r.options.Subject, r.options.Timeout)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+
+	result := ReplayResult{StartSequence: start}
+	verifier := SeriesVerifier{}
+	bodies := map[int]string{}
+	end := -1
+
+	var m sync.Mutex
+	done := make(chan struct{})
+
+	sub, err := r.Subscribe(r.options.Subject, func(sm *stan.Msg) {
+		defer m.Unlock()
+
+		m.Lock()
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		result.Read++
+		result.EndSequence = sm.Sequence
+
+		var msg Message
+		if err := json.Unmarshal(sm.Data, &msg); err == nil && msg.MessageSeriesId == r.options.SeriesId {
+			if err := msg.Decompress(); err != nil {
+				result.DecompressErrors++
+			}
+
+			verifier.Add(msg)
+			bodies[msg.MessageId] = msg.Body
+
+			if msg.End {
+				end = msg.MessageId
+			}
+		}
+
+		// Messages of a series can be published after its End message, ie when several producers share a series or
+		// a publish is retried - so the replay only stops early once every message up to the End has arrived
+		if (end >= 0 && len(bodies) > end) || sm.Sequence >= last {
+			close(done)
+		}
+	}, stan.StartAtSequence(start))
+
+	if err != nil {
+		return ReplayResult{}, fmt.Errorf("failed to replay %s from sequence %d: %v", r.options.Subject, start, err)
+	}
+
+	defer sub.Unsubscribe()
+
+	select {
+	case <-done:
+	case <-time.After(r.options.Timeout):
+		return ReplayResult{}, fmt.Errorf("timed out replaying series %s", r.options.SeriesId)
+	}
+
+	defer m.Unlock()
+
+	m.Lock()
+	result.VerificationResult = verifier.Verify(r.options.SeriesId)
+	result.Bodies = make([]string, result.Expected)
+	for id := range result.Bodies {
+		result.Bodies[id] = bodies[id]
+	}
+
+	return result, nil
+}
+
+// Closes the connection
+func (r *SeriesReplay) End() error {
+	return r.Close()
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that only the replayed series is read back, in order, including a message published after its End message
+func TestSeriesReplay_Run(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	sc := connectTestServer(t, server, "test-publisher")
+	defer sc.Close()
+
+	// Another series before and during the one being replayed, which has a message published after its End message
+	bodies := []string{"a", "b", "c", "d"}
+	publishMessages(t, sc, "replay",
+		Message{MessageSeriesId: "other", MessageId: 0, Body: "x"},
+		Message{MessageSeriesId: "image", MessageId: 0, Body: "a"},
+		Message{MessageSeriesId: "other", MessageId: 1, Body: "y"},
+		Message{MessageSeriesId: "image", MessageId: 1, Body: "b"},
+		Message{MessageSeriesId: "image", MessageId: 3, Body: "d", End: true, Digest: SeriesDigest(bodies)},
+		Message{MessageSeriesId: "image", MessageId: 2, Body: "c"},
+		Message{MessageSeriesId: "other", MessageId: 2, Body: "z"},
+	)
+
+	r := &SeriesReplay{}
+	r.SetOutput(discardOutput)
+	assert.NoError(t, r.SetOptions(ReplayOptions{
+		Cluster:          server.ClusterId(),
+		ConnectionString: server.URL(),
+		Subject:          "replay",
+		SeriesId:         "image",
+		Timeout:          5 * time.Second,
+	}))
+	assert.NoError(t, r.Connect())
+	defer r.End()
+
+	result, err := r.Run()
+	assert.NoError(t, err)
+
+	assert.True(t, result.Match())
+	assert.Equal(t, bodies, result.Bodies)
+	assert.Equal(t, uint64(2), result.StartSequence)
+	assert.Equal(t, uint64(6), result.EndSequence)
+	assert.Equal(t, 5, result.Read)
+}
+
+// Test that a series missing messages is replayed as far as the end of the channel, reporting which are missing
+func TestSeriesReplay_RunMissingMessages(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	sc := connectTestServer(t, server, "test-publisher")
+	defer sc.Close()
+
+	publishMessages(t, sc, "replay",
+		Message{MessageSeriesId: "image", MessageId: 0, Body: "a"},
+		Message{MessageSeriesId: "image", MessageId: 2, Body: "c", End: true},
+	)
+
+	r := &SeriesReplay{}
+	r.SetOutput(discardOutput)
+	assert.NoError(t, r.SetOptions(ReplayOptions{
+		Cluster:          server.ClusterId(),
+		ConnectionString: server.URL(),
+		Subject:          "replay",
+		SeriesId:         "image",
+		Timeout:          5 * time.Second,
+	}))
+	assert.NoError(t, r.Connect())
+	defer r.End()
+
+	// The replay stops at the end of the channel, rather than waiting for the missing message
+	result, err := r.Run()
+	assert.NoError(t, err)
+
+	assert.False(t, result.Match())
+	assert.Equal(t, []int{1}, result.Missing)
+	assert.Equal(t, []string{"a", "", "c"}, result.Bodies)
+}
+
+// Test that a series to replay is required
+func TestSeriesReplay_SetOptions(t *testing.T) {
+	r := &SeriesReplay{}
+	assert.EqualError(t, r.SetOptions(ReplayOptions{}), "a series to replay is required, with `-series`")
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+)
+
+// The upper bounds of the lateness histogram buckets, in how many sequences behind the highest sequence seen a
+// message arrived. The last bucket catches everything later.
+var latenessBounds = []uint64{1, 2, 5, 10, 50, 100, 500, 1000}
+
+// A histogram of how late out of order messages arrived
+type LatenessHistogram struct {
+	Buckets []LatenessBucket `json:"buckets"`
+}
+
+type LatenessBucket struct {
+	// Label for the range of the bucket, ie "2-5" or "1000+"
+	Range string `json:"range"`
+	// The inclusive upper bound of the bucket, 0 for the last bucket which has none
+	UpTo  uint64 `json:"up_to"`
+	Count int    `json:"count"`
+}
+
+func newLatenessHistogram() LatenessHistogram {
+	h := LatenessHistogram{}
+
+	var lower uint64 = 1
+	for _, bound := range latenessBounds {
+		label := fmt.Sprintf("%d-%d", lower, bound)
+		if lower == bound {
+			label = fmt.Sprintf("%d", bound)
+		}
+
+		h.Buckets = append(h.Buckets, LatenessBucket{Range: label, UpTo: bound})
+		lower = bound + 1
+	}
+
+	h.Buckets = append(h.Buckets, LatenessBucket{Range: fmt.Sprintf("%d+", lower)})
+
+	return h
+}
+
+// Records a message that arrived `lateness` sequences behind
+func (h *LatenessHistogram) add(lateness uint64) {
+	for i := range h.Buckets {
+		if h.Buckets[i].UpTo == 0 || lateness <= h.Buckets[i].UpTo {
+			h.Buckets[i].Count++
+			return
+		}
+	}
+}
+
+// Stats on the order messages were delivered in
+type SequenceStats struct {
+	// Messages STAN flagged as redelivered
+	Redelivered int `json:"redelivered"`
+	// Messages that arrived after a higher sequence had already arrived
+	OutOfOrder int `json:"out_of_order"`
+	// Messages with a sequence that had already arrived
+	DuplicateSequences int `json:"duplicate_sequences"`
+	// How many times the sequence jumped ahead, skipping one or more sequences
+	SequenceGaps int `json:"sequence_gaps"`
+	// Sequences skipped over which still haven't arrived
+	MissingSequences int `json:"missing_sequences"`
+	// How late the out of order messages were
+	Lateness LatenessHistogram `json:"lateness"`
+}
+
+// Tracks the sequence of the messages received on each subject, which STAN numbers independently
+type SequenceTracker struct {
+	m        sync.Mutex
+	subjects map[string]*subjectSequence
+	stats    SequenceStats
+}
+
+type subjectSequence struct {
+	// Every sequence from the first observed, up to and including the floor, has arrived
+	first   uint64
+	floor   uint64
+	highest uint64
+	seen    map[uint64]struct{}
+
+	// Sequences which arrived below the first observed, ie redeliveries of messages delivered before it
+	below map[uint64]struct{}
+}
+
+// Records a message received on the subject
+func (t *SequenceTracker) Observe(subject string, seq uint64, redelivered bool) {
+	defer t.m.Unlock()
+
+	t.m.Lock()
+	if t.subjects == nil {
+		t.subjects = map[string]*subjectSequence{}
+		t.stats.Lateness = newLatenessHistogram()
+	}
+
+	if redelivered {
+		t.stats.Redelivered++
+	}
+
+	s, ok := t.subjects[subject]
+	if !ok {
+		// We can't know what came before the first message, so start from there
+		t.subjects[subject] = &subjectSequence{
+			first:   seq,
+			floor:   seq,
+			highest: seq,
+			seen:    map[uint64]struct{}{},
+			below:   map[uint64]struct{}{},
+		}
+		return
+	}
+
+	// Only a duplicate if it already arrived - the first message observed needn't have been the lowest sequence
+	if seq < s.first {
+		if _, ok := s.below[seq]; ok {
+			t.stats.DuplicateSequences++
+			return
+		}
+
+		s.below[seq] = struct{}{}
+		t.stats.OutOfOrder++
+		t.stats.Lateness.add(s.highest - seq)
+		return
+	}
+
+	if _, ok := s.seen[seq]; ok || seq <= s.floor {
+		t.stats.DuplicateSequences++
+		return
+	}
+
+	if seq > s.highest {
+		if seq > s.highest+1 {
+			t.stats.SequenceGaps++
+			t.stats.MissingSequences += int(seq - s.highest - 1)
+		}
+
+		s.highest = seq
+	} else {
+		t.stats.OutOfOrder++
+		t.stats.MissingSequences--
+		t.stats.Lateness.add(s.highest - seq)
+	}
+
+	s.seen[seq] = struct{}{}
+
+	for {
+		if _, ok := s.seen[s.floor+1]; !ok {
+			break
+		}
+
+		delete(s.seen, s.floor+1)
+		s.floor++
+	}
+}
+
+// Returns the stats so far
+func (t *SequenceTracker) GetSequenceStats() SequenceStats {
+	defer t.m.Unlock()
+
+	t.m.Lock()
+	stats := t.stats
+	if stats.Lateness.Buckets == nil {
+		stats.Lateness = newLatenessHistogram()
+	}
+	stats.Lateness.Buckets = append([]LatenessBucket(nil), stats.Lateness.Buckets...)
+
+	return stats
+}
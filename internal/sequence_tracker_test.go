@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Test that gaps, out of order, duplicate and redelivered messages are all counted
+func TestSequenceTracker_Observe(t *testing.T) {
+	tracker := SequenceTracker{}
+
+	tracker.Observe("ascii", 1, false)
+	tracker.Observe("ascii", 2, false)
+	tracker.Observe("ascii", 5, false)
+	tracker.Observe("ascii", 6, false)
+	tracker.Observe("ascii", 3, true)
+	tracker.Observe("ascii", 3, true)
+	tracker.Observe("ascii", 1, true)
+
+	stats := tracker.GetSequenceStats()
+
+	assert.Equal(t, 3, stats.Redelivered)
+	assert.Equal(t, 1, stats.SequenceGaps)
+	assert.Equal(t, 1, stats.MissingSequences, "4 never arrived")
+	assert.Equal(t, 1, stats.OutOfOrder)
+	assert.Equal(t, 2, stats.DuplicateSequences)
+
+	// 3 arrived 3 sequences behind 6
+	assert.Equal(t, "3-5", stats.Lateness.Buckets[2].Range)
+	assert.Equal(t, 1, stats.Lateness.Buckets[2].Count)
+}
+
+// Test that a redelivery below the first message observed is only a duplicate once it has arrived before
+func TestSequenceTracker_ObserveBelowFirst(t *testing.T) {
+	tracker := SequenceTracker{}
+
+	tracker.Observe("ascii", 5, false)
+	tracker.Observe("ascii", 6, false)
+	tracker.Observe("ascii", 3, true)
+
+	stats := tracker.GetSequenceStats()
+	assert.Zero(t, stats.DuplicateSequences)
+	assert.Equal(t, 1, stats.OutOfOrder)
+	assert.Zero(t, stats.MissingSequences)
+
+	tracker.Observe("ascii", 3, true)
+	tracker.Observe("ascii", 5, true)
+
+	stats = tracker.GetSequenceStats()
+	assert.Equal(t, 2, stats.DuplicateSequences)
+	assert.Equal(t, 1, stats.OutOfOrder)
+}
+
+// Test that each subject is tracked independently
+func TestSequenceTracker_Subjects(t *testing.T) {
+	tracker := SequenceTracker{}
+
+	tracker.Observe("ascii.0", 1, false)
+	tracker.Observe("ascii.1", 1, false)
+	tracker.Observe("ascii.0", 2, false)
+	tracker.Observe("ascii.1", 2, false)
+
+	stats := tracker.GetSequenceStats()
+
+	assert.Zero(t, stats.DuplicateSequences)
+	assert.Zero(t, stats.OutOfOrder)
+	assert.Zero(t, stats.SequenceGaps)
+}
+
+// Test that lateness lands in the expected buckets
+func TestLatenessHistogram(t *testing.T) {
+	h := newLatenessHistogram()
+
+	h.add(1)
+	h.add(7)
+	h.add(5000)
+
+	assert.Equal(t, "1", h.Buckets[0].Range)
+	assert.Equal(t, 1, h.Buckets[0].Count)
+	assert.Equal(t, "6-10", h.Buckets[3].Range)
+	assert.Equal(t, 1, h.Buckets[3].Count)
+	assert.Equal(t, "1001+", h.Buckets[len(h.Buckets)-1].Range)
+	assert.Equal(t, 1, h.Buckets[len(h.Buckets)-1].Count)
+}
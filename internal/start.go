@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/stan.go"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StartNow    string = "now"
+	StartAll    string = "all"
+	StartLast   string = "last"
+	StartTime   string = "time"
+	StartAgo    string = "ago"
+	StartSeries string = "series"
+)
+
+// Where in the channel a subscription starts, parsed from a starting offset
+type StartingOffset struct {
+	// One of the Start kinds above
+	Kind string
+
+	// The time to start at, how long ago to start from, or the MessageSeriesId to start from the beginning of
+	Time     time.Time
+	Ago      time.Duration
+	SeriesId string
+}
+
+// Parses a starting offset - 'now', 'all', 'last', an RFC3339 timestamp, a duration ago such as '90s' or '1h', or
+// 'series:<id>' for the beginning of a MessageSeriesId
+func ParseStartingOffset(offset string) (StartingOffset, error) {
+	switch offset {
+	case StartNow, StartAll, StartLast:
+		return StartingOffset{Kind: offset}, nil
+	}
+
+	if strings.HasPrefix(offset, StartSeries+":") {
+		id := strings.TrimPrefix(offset, StartSeries+":")
+		if id == "" {
+			return StartingOffset{}, fmt.Errorf("starting offset %q is missing the series ID", offset)
+		}
+
+		return StartingOffset{Kind: StartSeries, SeriesId: id}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, offset); err == nil {
+		return StartingOffset{Kind: StartTime, Time: t}, nil
+	}
+
+	if d, err := time.ParseDuration(offset); err == nil {
+		if d <= 0 {
+			return StartingOffset{}, fmt.Errorf("starting offset %q must be a duration more than 0", offset)
+		}
+
+		return StartingOffset{Kind: StartAgo, Ago: d}, nil
+	}
+
+	return StartingOffset{}, fmt.Errorf("unknown starting offset %q - allows 'now', 'all', 'last', an RFC3339 time, "+
+		"a duration ago or 'series:<id>'", offset)
+}
+
+// Returns the subscription option starting at the offset, relative to `now`. Starting from a series needs the channel
+// scanned for it first, with FindSeriesStart.
+func (o StartingOffset) Option(now time.Time) stan.SubscriptionOption {
+	switch o.Kind {
+	case StartAll:
+		return stan.DeliverAllAvailable()
+	case StartLast:
+		return stan.StartWithLastReceived()
+	case StartTime:
+		return stan.StartAtTime(o.Time)
+	case StartAgo:
+		// The same as stan.StartAtTimeDelta, except fixed to `now` - so resubscribing later starts at the same time
+		return stan.StartAtTime(now.Add(-o.Ago))
+	default:
+		return stan.StartAtTime(now)
+	}
+}
+
+// Scans the subject from the beginning for the first message of the series, returning its sequence. Gives up once the
+// last message on the subject has been scanned without finding it, or after `timeout`.
+func FindSeriesStart(sc stan.Conn, subject string, seriesId string, timeout time.Duration) (uint64, error) {
+	return findSeriesFrom(sc, subject, seriesId, 1, timeout)
+}
+
+// Scans the subject for the first message of the series, starting from the given sequence
+func findSeriesFrom(sc stan.Conn, subject string, seriesId string, from uint64, timeout time.Duration) (uint64, error) {
+	last, err := lastSequence(sc, subject, timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	if from > last {
+		return 0, fmt.Errorf("series %s was not found on %s", seriesId, subject)
+	}
+
+	found := make(chan uint64, 1)
+	scanned := make(chan struct{})
+
+	var foundOnce, scannedOnce sync.Once
+	sub, err := sc.Subscribe(subject, func(m *stan.Msg) {
+		var msg Message
+		if err := json.Unmarshal(m.Data, &msg); err == nil && msg.MessageSeriesId == seriesId {
+			foundOnce.Do(func() { found <- m.Sequence })
+		}
+
+		if m.Sequence >= last {
+			scannedOnce.Do(func() { close(scanned) })
+		}
+	}, stan.StartAtSequence(from))
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan %s for series %s: %v", subject, seriesId, err)
+	}
+
+	defer sub.Unsubscribe()
+
+	select {
+	case seq := <-found:
+		return seq, nil
+	case <-scanned:
+		// Messages are handled in order, so the series would already have been found by the last one
+		select {
+		case seq := <-found:
+			return seq, nil
+		default:
+			return 0, fmt.Errorf("series %s was not found on %s", seriesId, subject)
+		}
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("timed out scanning %s for series %s", subject, seriesId)
+	}
+}
+
+// Returns the sequence of the last message on the subject
+func lastSequence(sc stan.Conn, subject string, timeout time.Duration) (uint64, error) {
+	return edgeSequence(sc, subject, "last", stan.StartWithLastReceived(), timeout)
+}
+
+// Returns the sequence of the first message still stored on the subject, which is past 1 once the channel's limits
+// have removed older messages
+func firstSequence(sc stan.Conn, subject string, timeout time.Duration) (uint64, error) {
+	return edgeSequence(sc, subject, "first", stan.DeliverAllAvailable(), timeout)
+}
+
+// Returns the sequence of the first message delivered to a subscription starting at the given position
+func edgeSequence(sc stan.Conn, subject string, edge string, start stan.SubscriptionOption,
+	timeout time.Duration) (uint64, error) {
+	seq := make(chan uint64, 1)
+
+	sub, err := sc.Subscribe(subject, func(m *stan.Msg) {
+		select {
+		case seq <- m.Sequence:
+		default:
+		}
+	}, start)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the %s message on %s: %v", edge, subject, err)
+	}
+
+	defer sub.Unsubscribe()
+
+	select {
+	case s := <-seq:
+		return s, nil
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("no messages on %s to scan", subject)
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test that each kind of starting offset is parsed, and invalid ones are refused
+func TestParseStartingOffset(t *testing.T) {
+	for _, kind := range []string{StartNow, StartAll, StartLast} {
+		offset, err := ParseStartingOffset(kind)
+		assert.NoError(t, err)
+		assert.Equal(t, StartingOffset{Kind: kind}, offset)
+	}
+
+	offset, err := ParseStartingOffset("2020-03-01T12:30:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, StartTime, offset.Kind)
+	assert.Equal(t, time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC), offset.Time.UTC())
+
+	offset, err = ParseStartingOffset("90s")
+	assert.NoError(t, err)
+	assert.Equal(t, StartingOffset{Kind: StartAgo, Ago: 90 * time.Second}, offset)
+
+	offset, err = ParseStartingOffset("series:abc-123")
+	assert.NoError(t, err)
+	assert.Equal(t, StartingOffset{Kind: StartSeries, SeriesId: "abc-123"}, offset)
+
+	for _, invalid := range []string{"", "later", "-5m", "series:", "2020-03-01"} {
+		_, err := ParseStartingOffset(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// Test that each starting offset becomes the matching subscription option, relative to the given time
+func TestStartingOffset_Option(t *testing.T) {
+	now := time.Now()
+	options := func(o StartingOffset) stan.SubscriptionOptions {
+		var opts stan.SubscriptionOptions
+		assert.NoError(t, o.Option(now)(&opts))
+
+		return opts
+	}
+
+	assert.Equal(t, now, options(StartingOffset{Kind: StartNow}).StartTime)
+	assert.Equal(t, now.Add(-time.Hour), options(StartingOffset{Kind: StartAgo, Ago: time.Hour}).StartTime)
+	assert.Equal(t, now.Add(time.Minute), options(StartingOffset{Kind: StartTime, Time: now.Add(time.Minute)}).StartTime)
+	assert.NotEqual(t, options(StartingOffset{Kind: StartAll}).StartAt, options(StartingOffset{Kind: StartLast}).StartAt)
+}
+
+// Test that the subject is scanned for the first message of the series, failing when it isn't there
+func TestFindSeriesStart(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Shutdown()
+
+	sc := connectTestServer(t, server, "test-scanner")
+	defer sc.Close()
+
+	_, err := FindSeriesStart(sc, "scan", "first", time.Second)
+	assert.EqualError(t, err, "no messages on scan to scan")
+
+	for _, id := range []string{"first", "first", "second", "second", "second"} {
+		publishMessages(t, sc, "scan", Message{MessageSeriesId: id, Body: "#"})
+	}
+
+	seq, err := FindSeriesStart(sc, "scan", "first", 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+
+	seq, err = FindSeriesStart(sc, "scan", "second", 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), seq)
+
+	_, err = FindSeriesStart(sc, "scan", "third", 5*time.Second)
+	assert.EqualError(t, err, "series third was not found on scan")
+}
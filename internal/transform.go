@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The characters image2ascii uses, from the lightest to the darkest pixel
+const asciiPixels = " .,:;i1tfLCG08@"
+
+// The terminal colors available to the color transform
+var transformColors = map[string]string{
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+	"white":   "37",
+}
+
+// A Transform takes a message and returns the messages to publish in its place. It may return no messages while it
+// waits for more (or to filter the message out entirely), or several at once.
+type Transform func(msg Message) []Message
+
+// Returns a new Transform for the given spec, which is the name of the transform with an optional `=argument`:
+//   - 'invert' swaps light and dark characters
+//   - 'upper' upper-cases every character
+//   - 'mirror' reverses each row of the image
+//   - 'color' or 'color=<name>' strips the existing colors and colors every character, green by default
+//   - 'filter' or 'filter=<chars>' blanks out the given characters, the lightest pixels (.,:) by default
+func NewTransform(spec string) (Transform, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+
+	switch name {
+	case "invert":
+		return mapTransform(invertPixel), nil
+	case "upper":
+		return mapTransform(unicode.ToUpper), nil
+	case "mirror":
+		return mirrorTransform(), nil
+	case "color":
+		if arg == "" {
+			arg = "green"
+		}
+
+		code, ok := transformColors[arg]
+		if !ok {
+			return nil, fmt.Errorf("unsupported color %q", arg)
+		}
+
+		return colorTransform(code), nil
+	case "filter":
+		if arg == "" {
+			arg = ".,:"
+		}
+
+		return mapTransform(func(r rune) rune {
+			if strings.ContainsRune(arg, r) {
+				return ' '
+			}
+
+			return r
+		}), nil
+	}
+
+	return nil, fmt.Errorf("unsupported transform %q - allows 'invert', 'upper', 'mirror', 'color' or 'filter'", name)
+}
+
+// Swaps a pixel character for its opposite on the scale from light to dark
+func invertPixel(r rune) rune {
+	if i := strings.IndexRune(asciiPixels, r); i >= 0 {
+		return rune(asciiPixels[len(asciiPixels)-1-i])
+	}
+
+	return r
+}
+
+// A Transform which maps each visible character of the body, leaving any terminal colors in place
+func mapTransform(fn func(rune) rune) Transform {
+	return func(msg Message) []Message {
+		cells := splitCells(msg.Body)
+		for i := range cells {
+			cells[i].char = fn(cells[i].char)
+		}
+
+		msg.Body = joinCells(cells)
+
+		return []Message{msg}
+	}
+}
+
+// A Transform which replaces any terminal colors with the given color code
+func colorTransform(code string) Transform {
+	return func(msg Message) []Message {
+		var b strings.Builder
+
+		for _, c := range splitCells(msg.Body) {
+			if unicode.IsSpace(c.char) {
+				b.WriteRune(c.char)
+			} else {
+				b.WriteString("\033[" + code + "m" + string(c.char) + "\033[0m")
+			}
+		}
+
+		msg.Body = b.String()
+
+		return []Message{msg}
+	}
+}
+
+// A Transform which reverses each row of the image.
+//
+// Messages are held until the buffered messages end exactly on a row, then the characters of each row are reversed
+// and handed back out to the same messages - so every message keeps its MessageId and number of characters.
+func mirrorTransform() Transform {
+	var held []Message
+
+	return func(msg Message) []Message {
+		held = append(held, msg)
+
+		if !strings.HasSuffix(msg.Body, "\n") && !msg.End {
+			return nil
+		}
+
+		var cells []cell
+		counts := make([]int, len(held))
+		for i, m := range held {
+			c := splitCells(m.Body)
+			counts[i] = len(c)
+			cells = append(cells, c...)
+		}
+
+		start := 0
+		for i := 0; i <= len(cells); i++ {
+			if i == len(cells) || cells[i].char == '\n' {
+				reverseCells(cells[start:i])
+				start = i + 1
+			}
+		}
+
+		out := held
+		held = nil
+
+		for i := range out {
+			out[i].Body = joinCells(cells[:counts[i]])
+			cells = cells[counts[i]:]
+		}
+
+		return out
+	}
+}
+
+// A single visible character, along with the terminal escape sequences around it
+type cell struct {
+	prefix string
+	char   rune
+	suffix string
+}
+
+// Splits a body into its visible characters, keeping each with its surrounding color escape sequences
+func splitCells(body string) []cell {
+	var cells []cell
+	var prefix strings.Builder
+
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '\033' {
+			seq, end := escapeSequence(runes, i)
+			i = end
+
+			// A reset directly after a character belongs to that character
+			if isReset(seq) && prefix.Len() == 0 && len(cells) > 0 && cells[len(cells)-1].suffix == "" {
+				cells[len(cells)-1].suffix = seq
+			} else {
+				prefix.WriteString(seq)
+			}
+
+			continue
+		}
+
+		cells = append(cells, cell{prefix: prefix.String(), char: runes[i]})
+		prefix.Reset()
+	}
+
+	// Any trailing escape sequences are kept on the last character
+	if prefix.Len() > 0 {
+		if len(cells) == 0 {
+			cells = append(cells, cell{prefix: prefix.String()})
+		} else {
+			cells[len(cells)-1].suffix += prefix.String()
+		}
+	}
+
+	return cells
+}
+
+// Returns the escape sequence starting at `start` and the index of its last rune
+func escapeSequence(runes []rune, start int) (string, int) {
+	end := start + 1
+	if end < len(runes) && runes[end] == '[' {
+		for end++; end < len(runes); end++ {
+			if (runes[end] >= 'a' && runes[end] <= 'z') || (runes[end] >= 'A' && runes[end] <= 'Z') {
+				break
+			}
+		}
+	}
+
+	if end >= len(runes) {
+		end = len(runes) - 1
+	}
+
+	return string(runes[start : end+1]), end
+}
+
+// Whether the escape sequence resets the terminal colors
+func isReset(seq string) bool {
+	return strings.HasPrefix(seq, "\033[") && strings.HasSuffix(seq, "m") && strings.Trim(seq[2:len(seq)-1], "0;") == ""
+}
+
+func joinCells(cells []cell) string {
+	var b strings.Builder
+
+	for _, c := range cells {
+		b.WriteString(c.prefix)
+		if c.char != 0 {
+			b.WriteRune(c.char)
+		}
+		b.WriteString(c.suffix)
+	}
+
+	return b.String()
+}
+
+func reverseCells(cells []cell) {
+	for i, j := 0, len(cells)-1; i < j; i, j = i+1, j-1 {
+		cells[i], cells[j] = cells[j], cells[i]
+	}
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func bodies(messages []Message) []string {
+	var b []string
+	for _, m := range messages {
+		b = append(b, m.Body)
+	}
+
+	return b
+}
+
+// Test that inverting swaps pixels on the light to dark scale and leaves colors alone
+func TestNewTransform_Invert(t *testing.T) {
+	invert, err := NewTransform("invert")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := invert(Message{Body: "\033[38;5;1m@\033[0;00m \n"})
+	assert.Equal(t, []string{"\033[38;5;1m \033[0;00m@\n"}, bodies(out))
+}
+
+// Test that upper-casing doesn't touch the escape sequences, which are case sensitive
+func TestNewTransform_Upper(t *testing.T) {
+	upper, _ := NewTransform("upper")
+
+	out := upper(Message{Body: "\033[38;5;1mi\033[0;00mt"})
+	assert.Equal(t, []string{"\033[38;5;1mI\033[0;00mT"}, bodies(out))
+}
+
+// Test that mirror holds messages until the end of a row, then reverses it across the messages
+func TestNewTransform_Mirror(t *testing.T) {
+	mirror, _ := NewTransform("mirror")
+
+	assert.Empty(t, mirror(Message{MessageId: 0, Body: "ab"}))
+	assert.Empty(t, mirror(Message{MessageId: 1, Body: "c"}))
+
+	out := mirror(Message{MessageId: 2, Body: "d\nef"})
+	assert.Empty(t, out, "the row 'ef' hasn't ended yet")
+
+	out = mirror(Message{MessageId: 3, Body: "g\n", End: true})
+	assert.Equal(t, []string{"dc", "b", "a\ngf", "e\n"}, bodies(out))
+	assert.Equal(t, 0, out[0].MessageId)
+	assert.True(t, out[3].End)
+}
+
+// Test that filter blanks out the given characters
+func TestNewTransform_Filter(t *testing.T) {
+	filter, _ := NewTransform("filter=@")
+
+	out := filter(Message{Body: "@.@\n"})
+	assert.Equal(t, []string{" . \n"}, bodies(out))
+}
+
+// Test that unknown transforms and colors are rejected
+func TestNewTransform_Unsupported(t *testing.T) {
+	_, err := NewTransform("rotate")
+	assert.Error(t, err)
+
+	_, err = NewTransform("color=plaid")
+	assert.Error(t, err)
+}
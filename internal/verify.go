@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Calculates the per message checksum of a message body
+func Checksum(body string) uint32 {
+	return crc32.ChecksumIEEE([]byte(body))
+}
+
+// Calculates the series level digest over every message body, in MessageId order
+func SeriesDigest(bodies []string) string {
+	h := sha256.New()
+
+	for _, body := range bodies {
+		h.Write([]byte(body))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The outcome of verifying a reassembled series against the digest published in its End message
+type VerificationResult struct {
+	MessageSeriesId string `json:"message_series_id"`
+	// How many messages the series was published with, based on the End message
+	Expected int `json:"expected"`
+	// How many unique messages were received
+	Received int `json:"received"`
+	// MessageIds never received
+	Missing []int `json:"missing"`
+	// MessageIds received more than once
+	Duplicates []int `json:"duplicates"`
+	// MessageIds whose body did not match its checksum
+	Corrupt []int `json:"corrupt"`
+	// Whether the End message was received at all
+	EndReceived bool `json:"end_received"`
+
+	ExpectedDigest string `json:"expected_digest"`
+	Digest         string `json:"digest"`
+}
+
+// Whether the series was reconstructed exactly as it was published
+func (r VerificationResult) Match() bool {
+	return r.EndReceived && len(r.Missing) == 0 && len(r.Corrupt) == 0 && r.Digest == r.ExpectedDigest
+}
+
+// Collects messages per series so the reassembled series can be verified once it ends
+type SeriesVerifier struct {
+	m      sync.Mutex
+	series map[string]*verifiedSeries
+
+	// When each series was verified, so messages redelivered after it don't start the series again
+	verified map[string]time.Time
+}
+
+type verifiedSeries struct {
+	bodies     map[int]string
+	duplicates map[int]struct{}
+	corrupt    map[int]struct{}
+	end        *Message
+
+	// When the End message first arrived, and when the last message of any kind did
+	endAt   time.Time
+	updated time.Time
+}
+
+// Whether the End message and every message before it have arrived
+func (s *verifiedSeries) complete() bool {
+	return s.end != nil && len(s.bodies) > s.end.MessageId
+}
+
+// Adds a received message to its series, returning whether the series is complete and so can be verified. Messages of
+// a series which was verified recently are ignored.
+func (v *SeriesVerifier) Add(msg Message) bool {
+	defer v.m.Unlock()
+
+	v.m.Lock()
+	if v.series == nil {
+		v.series = map[string]*verifiedSeries{}
+		v.verified = map[string]time.Time{}
+	}
+
+	if _, ok := v.verified[msg.MessageSeriesId]; ok {
+		return false
+	}
+
+	s, ok := v.series[msg.MessageSeriesId]
+	if !ok {
+		s = &verifiedSeries{
+			bodies:     map[int]string{},
+			duplicates: map[int]struct{}{},
+			corrupt:    map[int]struct{}{},
+		}
+		v.series[msg.MessageSeriesId] = s
+	}
+
+	if msg.Checksum != 0 && Checksum(msg.Body) != msg.Checksum {
+		s.corrupt[msg.MessageId] = struct{}{}
+	}
+
+	if _, ok := s.bodies[msg.MessageId]; ok {
+		s.duplicates[msg.MessageId] = struct{}{}
+	}
+
+	s.bodies[msg.MessageId] = msg.Body
+	s.updated = time.Now()
+
+	if msg.End {
+		end := msg
+		s.end = &end
+
+		if s.endAt.IsZero() {
+			s.endAt = s.updated
+		}
+	}
+
+	return s.complete()
+}
+
+// Returns the series due to be verified at `now`, even though they aren't complete - those whose End message arrived
+// more than `grace` ago, since messages can still be redelivered after it, and those which haven't had a message for
+// `expiry` without ever receiving their End message. Verified series are forgotten after `expiry` too.
+func (v *SeriesVerifier) Due(now time.Time, grace time.Duration, expiry time.Duration) []string {
+	defer v.m.Unlock()
+
+	v.m.Lock()
+	var due []string
+	for id, s := range v.series {
+		if s.complete() ||
+			(s.end != nil && now.Sub(s.endAt) >= grace) ||
+			(s.end == nil && now.Sub(s.updated) >= expiry) {
+			due = append(due, id)
+		}
+	}
+
+	for id, at := range v.verified {
+		if now.Sub(at) >= expiry {
+			delete(v.verified, id)
+		}
+	}
+
+	sort.Strings(due)
+
+	return due
+}
+
+// Verifies the reassembled series and forgets about it, ignoring any more of its messages until they expire
+func (v *SeriesVerifier) Verify(seriesId string) VerificationResult {
+	defer v.m.Unlock()
+
+	v.m.Lock()
+	result := VerificationResult{MessageSeriesId: seriesId}
+
+	s, ok := v.series[seriesId]
+	if !ok {
+		return result
+	}
+	delete(v.series, seriesId)
+
+	if v.verified != nil {
+		v.verified[seriesId] = time.Now()
+	}
+
+	result.Received = len(s.bodies)
+	result.Duplicates = sortedIds(s.duplicates)
+	result.Corrupt = sortedIds(s.corrupt)
+
+	// Without the End message, the best we can do is assume the highest MessageId we've seen is the last
+	last := -1
+	if s.end != nil {
+		last = s.end.MessageId
+		result.EndReceived = true
+		result.ExpectedDigest = s.end.Digest
+	} else {
+		for id := range s.bodies {
+			if id > last {
+				last = id
+			}
+		}
+	}
+
+	result.Expected = last + 1
+
+	bodies := make([]string, 0, result.Expected)
+	for id := 0; id <= last; id++ {
+		if body, ok := s.bodies[id]; ok {
+			bodies = append(bodies, body)
+		} else {
+			result.Missing = append(result.Missing, id)
+		}
+	}
+
+	result.Digest = SeriesDigest(bodies)
+
+	return result
+}
+
+func sortedIds(set map[int]struct{}) []int {
+	if len(set) == 0 {
+		return nil
+	}
+
+	ids := make([]int, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
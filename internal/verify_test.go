@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func verifiableSeries(bodies []string) []Message {
+	digest := SeriesDigest(bodies)
+	messages := make([]Message, 0, len(bodies))
+
+	for i, body := range bodies {
+		msg := Message{MessageSeriesId: "abc", MessageId: i, Body: body, Checksum: Checksum(body)}
+		if i == len(bodies)-1 {
+			msg.End = true
+			msg.Digest = digest
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages
+}
+
+// Test that a complete series, even when received out of order, matches
+func TestSeriesVerifier_Match(t *testing.T) {
+	v := SeriesVerifier{}
+	messages := verifiableSeries([]string{"a", "b", "c", "\n"})
+
+	for _, i := range []int{0, 2, 1, 3} {
+		v.Add(messages[i])
+	}
+
+	result := v.Verify("abc")
+
+	assert.True(t, result.Match())
+	assert.Equal(t, 4, result.Expected)
+	assert.Equal(t, 4, result.Received)
+	assert.Empty(t, result.Missing)
+}
+
+// Test that missing and duplicated MessageIds are reported
+func TestSeriesVerifier_MissingAndDuplicates(t *testing.T) {
+	v := SeriesVerifier{}
+	messages := verifiableSeries([]string{"a", "b", "c", "d"})
+
+	v.Add(messages[0])
+	v.Add(messages[0])
+	v.Add(messages[3])
+
+	result := v.Verify("abc")
+
+	assert.False(t, result.Match())
+	assert.Equal(t, []int{1, 2}, result.Missing)
+	assert.Equal(t, []int{0}, result.Duplicates)
+}
+
+// Test that a body which doesn't match its checksum is reported as corrupt
+func TestSeriesVerifier_Corrupt(t *testing.T) {
+	v := SeriesVerifier{}
+	messages := verifiableSeries([]string{"a", "b"})
+	messages[0].Body = "z"
+
+	v.Add(messages[0])
+	v.Add(messages[1])
+
+	result := v.Verify("abc")
+
+	assert.False(t, result.Match())
+	assert.Equal(t, []int{0}, result.Corrupt)
+}
+
+// Test that a series is only complete once its End message and every message before it have arrived
+func TestSeriesVerifier_AddComplete(t *testing.T) {
+	v := SeriesVerifier{}
+	messages := verifiableSeries([]string{"a", "b", "c"})
+
+	assert.False(t, v.Add(messages[0]))
+	assert.False(t, v.Add(messages[2]), "1 is still missing")
+	assert.True(t, v.Add(messages[1]))
+
+	assert.True(t, v.Verify("abc").Match())
+
+	// Redelivered after the series was verified, so it doesn't start the series again
+	assert.False(t, v.Add(messages[1]))
+	assert.Empty(t, v.series)
+}
+
+// Test that incomplete series are due once their grace period has passed, and series without an End once they expire
+func TestSeriesVerifier_Due(t *testing.T) {
+	v := SeriesVerifier{}
+
+	ended := verifiableSeries([]string{"a", "b", "c"})
+	v.Add(ended[0])
+	v.Add(ended[2])
+
+	unended := Message{MessageSeriesId: "def", MessageId: 0, Body: "d"}
+	v.Add(unended)
+
+	now := time.Now()
+	assert.Empty(t, v.Due(now, time.Second, time.Minute))
+	assert.Equal(t, []string{"abc"}, v.Due(now.Add(time.Second), time.Second, time.Minute))
+	assert.Equal(t, []string{"abc", "def"}, v.Due(now.Add(time.Minute), time.Second, time.Minute))
+
+	// Late messages of a verified series are only ignored until it expires
+	result := v.Verify("abc")
+	assert.Equal(t, []int{1}, result.Missing)
+	assert.False(t, v.Add(ended[1]))
+
+	v.Due(now.Add(2*time.Minute), time.Second, time.Minute)
+	assert.Empty(t, v.verified)
+}